@@ -0,0 +1,422 @@
+// Arbitration of the primary site with leases granted by majority of voters
+package cluster
+
+import (
+    "errors"
+    "log"
+    "math/rand"
+    "net"
+    "sync"
+    "time"
+)
+
+/*
+Every node of the group is a voter. Nodes running in some site campaign for
+the primary lease on behalf of their site, nodes not running in any site are
+witnesses, they only vote:
+
+    A -> all  LEASE_OP_REQUEST   site, proposed term and lease duration
+    V -> A    LEASE_OP_GRANT     or LEASE_OP_DENY with site and term voter promised
+
+    N -> all  LEASE_OP_TERM      asks for the highest term voters know of
+    V -> N    LEASE_OP_GRANT     with the highest term voter has seen
+
+Voter promises the lease to one site at a time and keeps the promise for
+lease duration after it was given, renewing it for the same site only. Site
+holds the lease if majority of all voters granted it, counting duration from
+the moment the request was sent, so it expires at the site before it does at
+any voter. Two majorities always share a voter, so no two sites hold the lease
+at the same time.
+
+Site that got promises but not majority stays away for lease duration, so that
+the promises expire instead of being renewed, otherwise votes split among
+several sites would stay split for good.
+
+Majority is taken of all voters there are, not of members that are alive at
+the moment, otherwise a site cut off from the rest would take itself for
+majority. With two sites of the same size the witness in the third site gives
+the deciding vote, so the number of voters shall be odd.
+
+Term grows every time the lease goes to another site, so whoever acts upon
+being primary can fence off the previous primary by the term
+ */
+
+const (
+    LEASE_OP_REQUEST byte = iota
+    LEASE_OP_GRANT
+    LEASE_OP_DENY
+    LEASE_OP_TERM
+)
+
+const DefaultLeaseDuration = 10 * time.Second
+const leaseRequestTimeout = 1000 * time.Millisecond
+
+type Lease struct {
+    Site string
+    Holder string               // node that acquired or last renewed the lease
+    Term uint64
+    Expires time.Time           // by local clock
+}
+
+type LeaseDTO struct {
+    Site string
+    Holder string
+    Term uint64
+    Duration time.Duration
+}
+
+// Lease is not expired
+func (l *Lease) IsValid() bool {
+    return l != nil && time.Now().Before(l.Expires)
+}
+
+type ArbiterActivity struct {
+    c *Cluster
+    kind OperationType          // message type of the election
+    title string                // what lease holder is, for logs
+    mu sync.Mutex
+    site string                 // site campaigned for, empty for witness
+    voters int                  // all voters, witnesses included
+    duration time.Duration
+    promise *Lease              // granted by the node as voter
+    lease *Lease                // held by the node
+    term uint64                 // highest term seen
+    quit chan int
+}
+
+func NewArbiterActivity(c *Cluster) *ArbiterActivity {
+    return newArbiterActivity(c, LEASE, "primary")
+}
+
+func newArbiterActivity(c *Cluster, kind OperationType, title string) *ArbiterActivity {
+    return &ArbiterActivity{
+        c: c,
+        kind: kind,
+        title: title,
+        duration: DefaultLeaseDuration,
+        quit: nil,
+    }
+}
+
+func (a *ArbiterActivity) Route(r *Request) (h Handler, err error) {
+    if r.Message.Type == a.kind && (r.Message.Operation == LEASE_OP_REQUEST || r.Message.Operation == LEASE_OP_TERM) {
+        return a, nil
+    }
+
+    return nil, errors.New("Cannot handle this")
+}
+
+// Vote on lease request
+func (a *ArbiterActivity) Handle(r *Request) error {
+    var dto LeaseDTO
+    if err := DecodeLoad(r.Message.Load, &dto); err != nil {
+        return err
+    }
+
+    var granted bool
+    var promise LeaseDTO
+    if r.Message.Operation == LEASE_OP_TERM {
+        a.mu.Lock()
+        granted, promise = true, LeaseDTO{ Term: a.term }
+        a.mu.Unlock()
+    } else {
+        granted, promise = a.vote(dto, time.Now())
+    }
+
+    op := LEASE_OP_DENY
+    if granted {
+        op = LEASE_OP_GRANT
+    }
+
+    load := EncodeLoad(promise)
+    return a.c.Reply(r, &Message{
+        Version: ProtocolVersion,
+        Type: a.kind,
+        Operation: op,
+        ReplyTo: *a.c.proxy.Name,
+        Length: uint16(len(load)),
+        Load: load,
+    })
+}
+
+// Grant the lease if nothing else is promised or the promise is for the same site,
+// returns what is promised after voting
+func (a *ArbiterActivity) vote(dto LeaseDTO, now time.Time) (bool, LeaseDTO) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    p := a.promise
+    valid := p != nil && now.Before(p.Expires)
+
+    granted := false
+    switch {
+    case valid && p.Site == dto.Site:
+        // renewal, term stays
+        p.Holder, p.Expires = dto.Holder, now.Add(dto.Duration)
+        granted = true
+    case !valid && dto.Term > a.term:
+        a.promise = &Lease{
+            Site: dto.Site,
+            Holder: dto.Holder,
+            Term: dto.Term,
+            Expires: now.Add(dto.Duration),
+        }
+        a.term = dto.Term
+        granted = true
+    }
+
+    promise := LeaseDTO{
+        Term: a.term,
+    }
+    if a.promise != nil && now.Before(a.promise.Expires) {
+        promise.Site, promise.Holder, promise.Term = a.promise.Site, a.promise.Holder, a.promise.Term
+    }
+
+    return granted, promise
+}
+
+// Request the lease from all voters, the lease is held if majority granted it, returns number of grants
+func (a *ArbiterActivity) campaign() int {
+    a.mu.Lock()
+    site, voters, duration := a.site, a.voters, a.duration
+    term := a.term + 1
+    if a.lease.IsValid() {
+        term = a.lease.Term
+    }
+    a.mu.Unlock()
+
+    if voters == 0 {
+        voters = a.c.Size()
+    }
+
+    peers := a.c.proxy.Membership().Peers
+    replies := make(chan *Request, len(peers))
+    id := a.c.begin(HandlerFunc(func(r *Request) error {
+        replies <- r
+        return nil
+    }))
+    defer a.c.end(id)
+
+    load := EncodeLoad(LeaseDTO{
+        Site: site,
+        Holder: *a.c.proxy.Name,
+        Term: term,
+        Duration: duration,
+    })
+    m := &Message{
+        Version: ProtocolVersion,
+        Type: a.kind,
+        Operation: LEASE_OP_REQUEST,
+        ReplyTo: *a.c.proxy.Name,
+        Length: uint16(len(load)),
+        Load: load,
+    }
+
+    start := time.Now()
+    for _, p := range peers {
+        a.c.exchange.Request(&net.UDPAddr{
+            IP: p.AddrIPv4,
+            Port: p.Port,
+        }, m, id)
+    }
+
+    grants, granted, highest := 0, uint64(0), uint64(0)
+    timeout := time.After(leaseRequestTimeout)
+collect:
+    for answered := 0; answered < len(peers) && grants < quorum(voters); answered++ {
+        var r *Request
+        select {
+        case r = <- replies:
+        case <- timeout:
+            break collect
+        }
+
+        var promise LeaseDTO
+        if err := DecodeLoad(r.Message.Load, &promise); err != nil {
+            continue
+        }
+
+        if promise.Term > highest {
+            highest = promise.Term
+        }
+        if r.Message.Operation == LEASE_OP_GRANT && promise.Site == site {
+            grants++
+            if promise.Term > granted {
+                granted = promise.Term
+            }
+        }
+    }
+
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    if highest > a.term {
+        a.term = highest
+    }
+
+    if grants < quorum(voters) {
+        if a.lease != nil && !a.lease.IsValid() {
+            log.Printf("%s lost %s lease of term %d", site, a.title, a.lease.Term)
+            a.lease = nil
+        }
+        return grants
+    }
+
+    if !a.lease.IsValid() {
+        log.Printf("%s is %s, term %d", site, a.title, granted)
+    }
+
+    a.lease = &Lease{
+        Site: site,
+        Holder: *a.c.proxy.Name,
+        Term: granted,
+        Expires: start.Add(duration),
+    }
+    return grants
+}
+
+// Campaign for the primary lease on behalf of the site, voters is the number of
+// all voters in all sites, witnesses included, zero to take current group size
+func (a *ArbiterActivity) Campaign(site string, voters int) {
+    a.mu.Lock()
+    a.site, a.voters = site, voters
+    a.mu.Unlock()
+
+    if voters > 0 && voters % 2 == 0 {
+        log.Println("Even number of voters, sites of the same size cannot break a tie")
+    }
+
+    if a.quit == nil {
+        a.quit = make(chan int, 1)
+        go func(quit chan int) {
+            for {
+                grants := a.campaign()
+
+                // sites that split the votes shall not ask at the same time again
+                a.mu.Lock()
+                interval := a.duration / 3
+                switch {
+                case a.lease.IsValid():
+                case grants > 0:
+                    interval = a.duration + time.Duration(rand.Int63n(int64(a.duration / 2)))
+                default:
+                    interval = a.duration / 6 + time.Duration(rand.Int63n(int64(a.duration / 3)))
+                }
+                a.mu.Unlock()
+
+                select {
+                case <- time.After(interval):
+                case <- quit:
+                    return
+                }
+            }
+        }(a.quit)
+    }
+}
+
+// Stop campaigning, lease held expires on its own
+func (a *ArbiterActivity) Stop() {
+    if a.quit != nil {
+        a.quit <- 1
+        a.quit = nil
+    }
+}
+
+// Lease held by the node, or the one it granted as voter if it holds none
+func (a *ArbiterActivity) Primary() (Lease, bool) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    if a.lease.IsValid() {
+        return *a.lease, true
+    }
+
+    if a.promise.IsValid() {
+        return *a.promise, true
+    }
+
+    return Lease{}, false
+}
+
+// Lease held by the node itself
+func (a *ArbiterActivity) Held() (Lease, bool) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    if a.lease.IsValid() {
+        return *a.lease, true
+    }
+
+    return Lease{}, false
+}
+
+// Highest term known to majority of voters, false if majority did not answer
+func (a *ArbiterActivity) highestTerm() (uint64, bool) {
+    a.mu.Lock()
+    voters := a.voters
+    a.mu.Unlock()
+
+    if voters == 0 {
+        voters = a.c.Size()
+    }
+
+    peers := a.c.proxy.Membership().Peers
+    replies := make(chan *Request, len(peers))
+    id := a.c.begin(HandlerFunc(func(r *Request) error {
+        replies <- r
+        return nil
+    }))
+    defer a.c.end(id)
+
+    load := EncodeLoad(LeaseDTO{})
+    m := &Message{
+        Version: ProtocolVersion,
+        Type: a.kind,
+        Operation: LEASE_OP_TERM,
+        ReplyTo: *a.c.proxy.Name,
+        Length: uint16(len(load)),
+        Load: load,
+    }
+
+    for _, p := range peers {
+        a.c.exchange.Request(&net.UDPAddr{
+            IP: p.AddrIPv4,
+            Port: p.Port,
+        }, m, id)
+    }
+
+    highest, answers := uint64(0), 0
+    timeout := time.After(leaseRequestTimeout)
+    for answers < quorum(voters) {
+        select {
+        case r := <- replies:
+            var dto LeaseDTO
+            if err := DecodeLoad(r.Message.Load, &dto); err != nil {
+                continue
+            }
+            answers++
+            if dto.Term > highest {
+                highest = dto.Term
+            }
+        case <- timeout:
+            return 0, false
+        }
+    }
+
+    a.admit(highest)
+    return highest, true
+}
+
+// Term seen elsewhere is admitted unless lower than the highest one seen, promises
+// are only given for higher terms after that
+func (a *ArbiterActivity) admit(term uint64) bool {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    if term < a.term {
+        return false
+    }
+
+    a.term = term
+    return true
+}
@@ -0,0 +1,128 @@
+package cluster
+
+import (
+    "testing"
+    "time"
+)
+
+func TestArbiter_Vote(t *testing.T) {
+    a := NewArbiterActivity(nil)
+    now := time.Now()
+
+    if granted, _ := a.vote(LeaseDTO{ Site: "dc1", Term: 1, Duration: time.Second }, now); !granted {
+        t.Fatal("First request shall be granted")
+    }
+
+    if granted, promise := a.vote(LeaseDTO{ Site: "dc2", Term: 2, Duration: time.Second }, now); granted || promise.Site != "dc1" {
+        t.Fatal("Other site shall be denied while promise is valid")
+    }
+
+    if granted, promise := a.vote(LeaseDTO{ Site: "dc1", Term: 1, Duration: time.Second }, now.Add(900 * time.Millisecond)); !granted || promise.Term != 1 {
+        t.Fatal("Same site shall renew in the same term")
+    }
+
+    later := now.Add(2 * time.Second)
+    if granted, _ := a.vote(LeaseDTO{ Site: "dc2", Term: 1, Duration: time.Second }, later); granted {
+        t.Fatal("Stale term shall be denied")
+    }
+
+    if granted, promise := a.vote(LeaseDTO{ Site: "dc2", Term: 2, Duration: time.Second }, later); !granted || promise.Term != 2 {
+        t.Fatal("Expired promise shall not block other site")
+    }
+}
+
+func TestArbiter_Quorum(t *testing.T) {
+    if quorum(5) != 3 || quorum(4) != 3 || quorum(1) != 1 {
+        t.Fatal("Quorum shall be majority")
+    }
+
+    if client1.Cluster.Quorum() != 3 {
+        t.Error("Unexpected quorum of test cluster", client1.Cluster.Quorum())
+    }
+}
+
+func TestArbiter_Failover(t *testing.T) {
+    if testing.Short() {
+        t.Skip("Waits for leases to expire")
+    }
+
+    holds := func(c *Client) (Lease, bool) {
+        a := c.Cluster.arbiter
+        a.mu.Lock()
+        defer a.mu.Unlock()
+        if a.lease.IsValid() {
+            return *a.lease, true
+        }
+        return Lease{}, false
+    }
+
+    sites := map[string]*Client{ "dc1": client1, "dc2": client2 }
+    for site, c := range sites {
+        c.Cluster.arbiter.duration = 2 * time.Second
+        c.Campaign(site, 5)
+    }
+    defer client1.Cluster.arbiter.Stop()
+    defer client2.Cluster.arbiter.Stop()
+
+    var primary *Client
+    var lease Lease
+    for deadline := time.Now().Add(15 * time.Second); time.Now().Before(deadline); {
+        l1, ok1 := holds(client1)
+        l2, ok2 := holds(client2)
+        if ok1 && ok2 {
+            t.Fatal("Both sites hold the lease", l1, l2)
+        }
+
+        if ok1 {
+            primary, lease = client1, l1
+        }
+        if ok2 {
+            primary, lease = client2, l2
+        }
+        if primary != nil {
+            break
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+
+    if primary == nil {
+        t.Fatal("No site became primary")
+    }
+
+    // votes may be split, but majority shall be promised to the primary
+    promised := 0
+    for _, c := range []*Client{ client1, client2, client3, client4, client5 } {
+        a := c.Cluster.arbiter
+        a.mu.Lock()
+        if a.promise.IsValid() && a.promise.Site == lease.Site {
+            promised++
+        }
+        a.mu.Unlock()
+    }
+    if promised < quorum(5) {
+        t.Error("Lease is held without majority of promises", promised)
+    }
+
+    // primary site goes away, the other one takes over once lease expires
+    other := client1
+    if primary == client1 {
+        other = client2
+    }
+    primary.Cluster.arbiter.Stop()
+
+    for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+        l, ok := holds(other)
+        if ok {
+            if _, stillHolds := holds(primary); stillHolds {
+                t.Fatal("Both sites hold the lease")
+            }
+            if l.Term <= lease.Term {
+                t.Error("Term shall grow on failover", lease.Term, l.Term)
+            }
+            return
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+
+    t.Fatal("Other site did not take over")
+}
@@ -0,0 +1,318 @@
+// Loading and storing many keys at once
+package cluster
+
+import (
+    "errors"
+    "log"
+    "time"
+    "github.com/reusee/mmh3"
+)
+
+/*
+Batch groups keys by replicas that own them and sends every replica one
+message with all of its keys, instead of a round trip per key:
+
+    N -> R   BATCH_OP_GET   keys to load
+    R -> N   BATCH_OP_ACK   keys answered, versions of those the replica has
+
+    N -> R   BATCH_OP_PUT   versions to store
+    R -> N   BATCH_OP_ACK   keys stored
+
+Keys count as acked or not by every replica the same way as in single load and
+store, so each key gets the result it would get on its own. Messages are split
+once they grow past batchMaxSize. Replica leaves out values that do not fit
+into the reply, such keys are loaded one by one
+ */
+
+const (
+    BATCH_OP_GET byte = iota
+    BATCH_OP_PUT
+    BATCH_OP_ACK
+)
+
+const batchTimeout = storeTimeout
+const batchMaxSize = 1024 * 1024
+const batchMaxKeys = 256
+
+type BatchDTO struct {
+    Entries []StoreDTO          // only keys for loads
+}
+
+type BatchResultDTO struct {
+    Keys [][]byte               // answered keys
+    Found []StoreDTO            // versions of loaded keys the replica has
+    Skipped [][]byte            // loaded keys that did not fit into the reply
+}
+
+// Value of one key loaded in batch, Result is the same as Load returns
+type LoadResult struct {
+    Value []byte
+    Result int
+}
+
+type BatchActivity struct {
+    c *Cluster
+}
+
+func NewBatchActivity(c *Cluster) *BatchActivity {
+    return &BatchActivity{
+        c: c,
+    }
+}
+
+func (a *BatchActivity) Route(r *Request) (h Handler, err error) {
+    if r.Message.Type == BATCH && (r.Message.Operation == BATCH_OP_GET || r.Message.Operation == BATCH_OP_PUT) {
+        return a, nil
+    }
+
+    return nil, errors.New("Cannot handle this")
+}
+
+func (a *BatchActivity) Handle(r *Request) error {
+    var dto BatchDTO
+    if err := DecodeLoad(r.Message.Load, &dto); err != nil {
+        return err
+    }
+
+    result := BatchResultDTO{
+        Keys: make([][]byte, 0, len(dto.Entries)),
+        Found: make([]StoreDTO, 0),
+    }
+
+    size := 0
+    for _, e := range dto.Entries {
+        if r.Message.Operation == BATCH_OP_PUT {
+            // keys that could not be stored are left unanswered
+            if _, err := a.c.apply(e.Key, e.Version()); err != nil {
+                log.Printf("Cannot store %s: %v", e.Key, err)
+                continue
+            }
+            result.Keys = append(result.Keys, e.Key)
+            continue
+        }
+
+        version, ok := a.c.storage.Get(e.Key)
+        if ok {
+            if size > 0 && size + len(version.Value) > batchMaxSize {
+                result.Skipped = append(result.Skipped, e.Key)
+                continue
+            }
+            size += len(version.Value)
+            result.Found = append(result.Found, NewStoreDTO(e.Key, version))
+        }
+        result.Keys = append(result.Keys, e.Key)
+    }
+
+    load := EncodeLoad(result)
+    return a.c.Reply(r, &Message{
+        Version: ProtocolVersion,
+        Type: BATCH,
+        Operation: BATCH_OP_ACK,
+        ReplyTo: *a.c.proxy.Name,
+        Length: uint16(len(load)),
+        Load: load,
+    })
+}
+
+// Send entries to their peers in as few messages as fit, calls f with every reply
+func (c *Cluster) batch(op byte, groups map[string][]StoreDTO, f func(peer string, result *BatchResultDTO)) {
+    messages := make([]*Message, 0)
+    targets := make([]string, 0)
+    for peer, entries := range groups {
+        for len(entries) > 0 {
+            n, size := 0, 0
+            for n < len(entries) && n < batchMaxKeys {
+                size += len(entries[n].Key) + len(entries[n].Value)
+                if n > 0 && size > batchMaxSize {
+                    break
+                }
+                n++
+            }
+
+            load := EncodeLoad(BatchDTO{ Entries: entries[:n] })
+            messages = append(messages, &Message{
+                Version: ProtocolVersion,
+                Type: BATCH,
+                Operation: op,
+                ReplyTo: *c.proxy.Name,
+                Length: uint16(len(load)),
+                Load: load,
+            })
+            targets = append(targets, peer)
+            entries = entries[n:]
+        }
+    }
+
+    replies := make(chan *Request, len(messages))
+    id := c.begin(HandlerFunc(func(r *Request) error {
+        select {
+        case replies <- r:
+        default:
+        }
+        return nil
+    }))
+    defer c.end(id)
+
+    sent := 0
+    for i, m := range messages {
+        if !c.PeerSupports(targets[i], FeatureBatch) {
+            // keys of such peers count as not acked
+            log.Println("Peer does not take batches", targets[i])
+            continue
+        }
+
+        addr, err := c.GetPeerAddr(targets[i])
+        if err != nil {
+            log.Println("Cannot contact peer", targets[i])
+            continue
+        }
+
+        c.exchange.Request(addr, m, id)
+        sent++
+    }
+
+    // retransmitted requests may be answered more than once
+    answered := make(map[uint64]bool)
+    timeout := time.After(batchTimeout)
+    for len(answered) < sent {
+        select {
+        case r := <- replies:
+            var result BatchResultDTO
+            if answered[r.Message.RequestId] || DecodeLoad(r.Message.Load, &result) != nil {
+                continue
+            }
+            answered[r.Message.RequestId] = true
+            f(r.Message.ReplyTo, &result)
+        case <- timeout:
+            return
+        }
+    }
+}
+
+// Load values of the keys, resolved and repaired the same way as by Load
+func (c *Cluster) MultiLoad(keys [][]byte, level ConsistencyLevel) map[string]LoadResult {
+    level = c.AdjustedConsistencyLevel(level)
+
+    copies := make(map[string]int)
+    groups := make(map[string][]StoreDTO)
+    for _, key := range keys {
+        if _, ok := copies[string(key)]; ok {
+            continue
+        }
+
+        nodes := c.HashNodes(mmh3.Sum128(key), level)
+        copies[string(key)] = len(nodes)
+        for _, node := range nodes {
+            groups[*node.Name] = append(groups[*node.Name], StoreDTO{ Key: key })
+        }
+    }
+
+    versions := make(map[string][]*Version)
+    acks := make(map[string]int)
+    skipped := make(map[string]bool)
+    c.batch(BATCH_OP_GET, groups, func(peer string, result *BatchResultDTO) {
+        for _, dto := range result.Found {
+            versions[string(dto.Key)] = append(versions[string(dto.Key)], dto.Version())
+            acks[string(dto.Key)]++
+        }
+        for _, key := range result.Skipped {
+            skipped[string(key)] = true
+        }
+    })
+
+    results := make(map[string]LoadResult, len(copies))
+    repairs := make(map[string]*Version)
+    for key, n := range copies {
+        var result int
+        switch {
+        case n == 0:
+            results[key] = LoadResult{ Value: []byte{}, Result: LOAD_ERROR }
+            continue
+        case skipped[key]:
+            versions[key], result = c.load([]byte(key), level)
+        case acks[key] == n:
+            result = LOAD_SUCCESS
+        case acks[key] == 0:
+            result = LOAD_FAILURE
+        default:
+            result = LOAD_PARTIAL_SUCCESS
+        }
+
+        siblings := Siblings(versions[key])
+        if len(siblings) == 0 {
+            results[key] = LoadResult{ Value: []byte{}, Result: result }
+            continue
+        }
+
+        resolved := Resolve(siblings, c.Resolver)
+        if stale(resolved, versions[key], result) {
+            repairs[key] = resolved
+        }
+
+        if resolved.Deleted {
+            results[key] = LoadResult{ Value: []byte{}, Result: LOAD_FAILURE }
+        } else {
+            results[key] = LoadResult{ Value: resolved.Value, Result: result }
+        }
+    }
+
+    if len(repairs) > 0 {
+        c.multiStore(repairs, level)
+    }
+
+    return results
+}
+
+// Store values of the keys, returns result of every key as Store does
+func (c *Cluster) MultiStore(values map[string][]byte, level ConsistencyLevel) map[string]int {
+    versions := make(map[string]*Version, len(values))
+    for key, data := range values {
+        versions[key] = c.newVersion(data, nil)
+    }
+
+    return c.multiStore(versions, c.AdjustedConsistencyLevel(level))
+}
+
+func (c *Cluster) multiStore(versions map[string]*Version, level ConsistencyLevel) map[string]int {
+    owners := make(map[string][]*Peer, len(versions))
+    groups := make(map[string][]StoreDTO)
+    for key, version := range versions {
+        nodes := c.HashNodes(mmh3.Sum128([]byte(key)), level)
+        owners[key] = nodes
+        for _, node := range nodes {
+            groups[*node.Name] = append(groups[*node.Name], NewStoreDTO([]byte(key), version))
+        }
+    }
+
+    acked := make(map[string]map[string]bool)
+    c.batch(BATCH_OP_PUT, groups, func(peer string, result *BatchResultDTO) {
+        for _, key := range result.Keys {
+            if acked[string(key)] == nil {
+                acked[string(key)] = make(map[string]bool)
+            }
+            acked[string(key)][peer] = true
+        }
+    })
+
+    results := make(map[string]int, len(versions))
+    for key, nodes := range owners {
+        switch {
+        case len(nodes) == 0:
+            results[key] = STORE_ERROR
+        case len(acked[key]) == len(nodes):
+            results[key] = STORE_SUCCESS
+        case len(acked[key]) == 0:
+            results[key] = STORE_FAILURE
+        default:
+            // replicas that did not ack get hints, same as with single store
+            for _, node := range nodes {
+                if !acked[key][*node.Name] {
+                    c.Hints.Add(*node.Name, []byte(key), versions[key])
+                }
+            }
+            results[key] = STORE_PARTIAL_SUCCESS
+        }
+    }
+
+    return results
+}
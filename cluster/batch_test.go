@@ -0,0 +1,69 @@
+package cluster
+
+import (
+    "bytes"
+    "fmt"
+    "testing"
+)
+
+func TestBatch_StoreLoad(t *testing.T) {
+    values := make(map[string][]byte)
+    keys := make([][]byte, 0)
+    for i := 0; i < 50; i++ {
+        key := fmt.Sprintf("batch/%d", i)
+        values[key] = []byte(fmt.Sprintf("value %d", i))
+        keys = append(keys, []byte(key))
+    }
+
+    for key, result := range client1.MultiStore(values, ConsistencyLevelTwo) {
+        if result != STORE_SUCCESS {
+            t.Fatal("Cannot store", key, result)
+        }
+    }
+
+    client3.Delete([]byte("batch/7"), ConsistencyLevelTwo)
+
+    results := client2.MultiLoad(append(keys, []byte("batch/missing")), ConsistencyLevelTwo)
+    if len(results) != 51 {
+        t.Fatal("Unexpected number of results", len(results))
+    }
+
+    for key, value := range values {
+        if key == "batch/7" {
+            continue
+        }
+        if r := results[key]; r.Result != LOAD_SUCCESS || !bytes.Equal(r.Value, value) {
+            t.Fatal("Unexpected load of", key, r.Result, string(r.Value))
+        }
+    }
+
+    if r := results["batch/7"]; r.Result != LOAD_FAILURE {
+        t.Error("Deleted key shall not load", r.Result)
+    }
+    if r := results["batch/missing"]; r.Result != LOAD_FAILURE {
+        t.Error("Missing key shall not load", r.Result)
+    }
+}
+
+func TestBatch_Large(t *testing.T) {
+    // values do not fit into one message or reply
+    values := make(map[string][]byte)
+    keys := make([][]byte, 0)
+    for i := 0; i < 6; i++ {
+        key := fmt.Sprintf("batch/large/%d", i)
+        values[key] = bytes.Repeat([]byte{ byte(i) }, 600 * 1024)
+        keys = append(keys, []byte(key))
+    }
+
+    for key, result := range client4.MultiStore(values, ConsistencyLevelTwo) {
+        if result != STORE_SUCCESS {
+            t.Fatal("Cannot store", key, result)
+        }
+    }
+
+    for key, r := range client5.MultiLoad(keys, ConsistencyLevelTwo) {
+        if r.Result != LOAD_SUCCESS || !bytes.Equal(r.Value, values[key]) {
+            t.Fatal("Unexpected load of", key, r.Result, len(r.Value))
+        }
+    }
+}
@@ -13,8 +13,8 @@ import (
 When the real write shall happen What happens on concurrent writes to the
 same blob by different clients
     - locking mechanism
-    - exclusive locks
-    - optimistic locks
+    - exclusive locks, see Client.Lock, writers pass fencing token along
+    - optimistic locks, see Client.StoreIf
 
 The same question goes for simple block writes, not only for blobs
 
@@ -8,10 +8,10 @@ import (
     "os"
 )
 
-var client1, client2, client3 *Client
+var client1, client2, client3, client4, client5 *Client
 
 func TestMain(m *testing.M) {
-    client1, client2, client3, _, _ = startTestCluster()
+    client1, client2, client3, client4, client5 = startTestCluster()
     flag.Parse()
     os.Exit(m.Run())
 }
@@ -189,19 +189,19 @@ func TestBlob_WriteLarge(t *testing.T) {
 
 func startTestCluster() (*Client, *Client, *Client, *Client, *Client) {
     client1, err := NewClient(
-        "local.", "node1", "test", 127, "127.0.0.1", 9991)
+        "local.", "node1", "test", 127, "127.0.0.1", 9991, NewInMemoryStorage())
 
     client2, err := NewClient(
-        "local.", "node2", "test", 127, "127.0.0.1", 9992)
+        "local.", "node2", "test", 127, "127.0.0.1", 9992, NewInMemoryStorage())
 
     client3, err := NewClient(
-        "local.", "node3", "test", 127, "127.0.0.1", 9993)
+        "local.", "node3", "test", 127, "127.0.0.1", 9993, NewInMemoryStorage())
 
     client4, err := NewClient(
-        "local.", "node4", "test", 127, "127.0.0.1", 9994)
+        "local.", "node4", "test", 127, "127.0.0.1", 9994, NewInMemoryStorage())
 
     client5, err := NewClient(
-        "local.", "node5", "test", 127, "127.0.0.1", 9995)
+        "local.", "node5", "test", 127, "127.0.0.1", 9995, NewInMemoryStorage())
 
     if err != nil {
         log.Fatal("Error creating client", err)
@@ -0,0 +1,214 @@
+// Conditional writes
+package cluster
+
+import (
+    "bytes"
+    "errors"
+    "log"
+    "time"
+    "github.com/reusee/mmh3"
+)
+
+/*
+Conditional write goes to the first replica of the key, which reads the key at
+requested consistency level, checks the precondition against what it read and
+writes a successor of it, while no other conditional write goes through it:
+
+    N -> P   STORE_OP_PUT_IF   value, precondition and consistency level
+    P -> N   STORE_OP_ACK      with store result, or STORE_OP_NACK if precondition failed
+
+So conditional writes of the key are serialized as long as its first replica
+stays the same. While the ring changes two nodes may both consider themselves
+the first replica and both pass the check, as the lock is local to each, the
+writes then end up as concurrent versions. Precondition is only checked when
+every replica of the level answered the read, otherwise STORE_ERROR is returned.
+Unconditional writes are not serialized with them, writer that mixes both gets
+concurrent versions resolved as usual
+ */
+
+// Conditional writes wait for the first replica to read and write the key
+const storeIfTimeout = requestLifetime
+
+type Precondition struct {
+    Absent bool                 // key is missing or deleted
+    Clock VectorClock           // clocks of current versions merge into this one, as of LoadVersions
+    Hash []byte                 // current value hashes to this, see ValueHash
+}
+
+type StoreIfDTO struct {
+    Key []byte
+    Value []byte
+    If Precondition
+    Level ConsistencyLevel
+}
+
+type StoreResultDTO struct {
+    Result int
+}
+
+// Hash of the value for compare-and-swap
+func ValueHash(value []byte) []byte {
+    return mmh3.Sum128(value)
+}
+
+// Check the precondition against current versions of the key, all that is given shall hold
+func (p *Precondition) holds(versions []*Version, resolver Resolver) bool {
+    siblings := Siblings(versions)
+
+    var current *Version
+    if len(siblings) > 0 {
+        current = Resolve(siblings, resolver)
+    }
+    missing := current == nil || current.Deleted
+
+    if p.Absent && !missing {
+        return false
+    }
+
+    if p.Clock != nil {
+        clock := VectorClock{}
+        for _, v := range siblings {
+            clock = clock.Merge(v.Clock)
+        }
+        if clock.Compare(p.Clock) != ClockEqual {
+            return false
+        }
+    }
+
+    if p.Hash != nil && (missing || !bytes.Equal(ValueHash(current.Value), p.Hash)) {
+        return false
+    }
+
+    return true
+}
+
+type BucketStoreIfActivity struct {
+    c *Cluster
+}
+
+func NewBucketStoreIfActivity(c *Cluster) *BucketStoreIfActivity {
+    return &BucketStoreIfActivity{
+        c: c,
+    }
+}
+
+func (a *BucketStoreIfActivity) Route(r *Request) (h Handler, err error) {
+    if r.Message.Type == STORE && r.Message.Operation == STORE_OP_PUT_IF {
+        return a, nil
+    }
+
+    return nil, errors.New("Cannot handle this")
+}
+
+func (a *BucketStoreIfActivity) Handle(r *Request) error {
+    var dto StoreIfDTO
+    if err := DecodeLoad(r.Message.Load, &dto); err != nil {
+        return err
+    }
+
+    // reading and writing waits for replies, which come through the same server
+    go func() {
+        result := a.c.storeIf(dto.Key, dto.Value, dto.If, dto.Level)
+
+        op := STORE_OP_ACK
+        if result == STORE_PRECONDITION_FAILED {
+            op = STORE_OP_NACK
+        }
+
+        load := EncodeLoad(StoreResultDTO{ Result: result })
+        if err := a.c.Reply(r, &Message{
+            Version: ProtocolVersion,
+            Type: STORE,
+            Operation: op,
+            ReplyTo: *a.c.proxy.Name,
+            Length: uint16(len(load)),
+            Load: load,
+        }); err != nil {
+            log.Println(err)
+        }
+    }()
+
+    return nil
+}
+
+// Store the value if precondition holds, returns STORE_PRECONDITION_FAILED if it does not
+func (c *Cluster) StoreIf(key, data []byte, cond Precondition, level ConsistencyLevel) int {
+    level = c.AdjustedConsistencyLevel(level)
+
+    nodes := c.HashNodes(mmh3.Sum128(key), level)
+    if len(nodes) == 0 {
+        return STORE_ERROR
+    }
+
+    first := *nodes[0].Name
+    if first == *c.proxy.Name {
+        return c.storeIf(key, data, cond, level)
+    }
+
+    addr, err := c.GetPeerAddr(first)
+    if err != nil {
+        log.Println("Cannot contact peer", first)
+        return STORE_ERROR
+    }
+
+    replies := make(chan *Request, 1)
+    id := c.begin(HandlerFunc(func(r *Request) error {
+        replies <- r
+        return nil
+    }))
+    defer c.end(id)
+
+    load := EncodeLoad(StoreIfDTO{
+        Key: key,
+        Value: data,
+        If: cond,
+        Level: level,
+    })
+    c.exchange.Request(addr, &Message{
+        Version: ProtocolVersion,
+        Type: STORE,
+        Operation: STORE_OP_PUT_IF,
+        ReplyTo: *c.proxy.Name,
+        Length: uint16(len(load)),
+        Load: load,
+    }, id)
+
+    select {
+    case r := <- replies:
+        if r.Message.Operation == STORE_OP_NACK {
+            return STORE_PRECONDITION_FAILED
+        }
+
+        var result StoreResultDTO
+        if err := DecodeLoad(r.Message.Load, &result); err != nil {
+            return STORE_ERROR
+        }
+        return result.Result
+    case <- time.After(storeIfTimeout):
+        return STORE_FAILURE
+    }
+}
+
+// Check and write as the first replica of the key
+func (c *Cluster) storeIf(key, data []byte, cond Precondition, level ConsistencyLevel) int {
+    c.storeIfMu.Lock()
+    defer c.storeIfMu.Unlock()
+
+    // precondition holds only against what all replicas of the level said,
+    // silent replica may hold the version that makes it fail
+    versions, result, answers := c.loadAnswered(key, level)
+    if result == LOAD_ERROR || answers < c.Copies(level) {
+        return STORE_ERROR
+    }
+
+    if !cond.holds(versions, c.Resolver) {
+        return STORE_PRECONDITION_FAILED
+    }
+
+    context := VectorClock{}
+    for _, v := range versions {
+        context = context.Merge(v.Clock)
+    }
+
+    return c.store(key, c.newVersion(data, context), level, 0)
+}
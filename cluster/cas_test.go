@@ -0,0 +1,99 @@
+package cluster
+
+import (
+    "strconv"
+    "sync"
+    "testing"
+)
+
+func TestStoreIf_Holds(t *testing.T) {
+    v1 := &Version{ Value: []byte("1"), Clock: VectorClock{ "a": 1 } }
+    v2 := &Version{ Value: []byte("2"), Clock: VectorClock{ "a": 2 } }
+    gone := &Version{ Clock: VectorClock{ "a": 3 }, Deleted: true }
+
+    absent := Precondition{ Absent: true }
+    if !absent.holds(nil, LastWriteWins) || !absent.holds([]*Version{ v1, gone }, LastWriteWins) {
+        t.Error("Missing and deleted keys shall be absent")
+    }
+    if absent.holds([]*Version{ v1 }, LastWriteWins) {
+        t.Error("Stored key shall not be absent")
+    }
+
+    hash := Precondition{ Hash: ValueHash([]byte("2")) }
+    if !hash.holds([]*Version{ v1, v2 }, LastWriteWins) || hash.holds([]*Version{ v1 }, LastWriteWins) {
+        t.Error("Hash shall match current value only")
+    }
+
+    clock := Precondition{ Clock: VectorClock{ "a": 2 } }
+    if !clock.holds([]*Version{ v1, v2 }, LastWriteWins) || clock.holds([]*Version{ v1 }, LastWriteWins) {
+        t.Error("Clock shall match current version only")
+    }
+}
+
+func TestStoreIf_CompareAndSwap(t *testing.T) {
+    key := []byte("cas")
+    if result := client1.StoreIfAbsent(key, []byte("1"), ConsistencyLevelTwo); result != STORE_SUCCESS {
+        t.Fatal("Cannot create key", result)
+    }
+
+    if result := client2.StoreIfAbsent(key, []byte("2"), ConsistencyLevelTwo); result != STORE_PRECONDITION_FAILED {
+        t.Fatal("Existing key shall not be created", result)
+    }
+
+    if result := client2.CompareAndSwap(key, []byte("1"), []byte("2"), ConsistencyLevelTwo); result != STORE_SUCCESS {
+        t.Fatal("Cannot swap", result)
+    }
+
+    if result := client3.CompareAndSwap(key, []byte("1"), []byte("3"), ConsistencyLevelTwo); result != STORE_PRECONDITION_FAILED {
+        t.Fatal("Stale value shall not be swapped", result)
+    }
+
+    if data, _ := client4.Load(key, ConsistencyLevelTwo); string(data) != "2" {
+        t.Fatal("Unexpected value", string(data))
+    }
+}
+
+func TestStoreIf_Counter(t *testing.T) {
+    key := []byte("cas-counter")
+    if result := client1.Store(key, []byte("0"), ConsistencyLevelTwo); result != STORE_SUCCESS {
+        t.Fatal("Cannot store", result)
+    }
+
+    // increments from different nodes shall not be lost
+    var wg sync.WaitGroup
+    for _, c := range []*Client{ client1, client2, client3 } {
+        wg.Add(1)
+        go func(c *Client) {
+            defer wg.Done()
+            for i := 0; i < 3; {
+                data, _ := c.Load(key, ConsistencyLevelTwo)
+                n, _ := strconv.Atoi(string(data))
+                switch c.CompareAndSwap(key, data, []byte(strconv.Itoa(n + 1)), ConsistencyLevelTwo) {
+                case STORE_SUCCESS, STORE_PARTIAL_SUCCESS:
+                    i++
+                case STORE_PRECONDITION_FAILED:
+                default:
+                    t.Error("Cannot swap")
+                    return
+                }
+            }
+        }(c)
+    }
+    wg.Wait()
+
+    if data, _ := client5.Load(key, ConsistencyLevelTwo); string(data) != "9" {
+        t.Fatal("Increments were lost", string(data))
+    }
+}
+
+func TestStoreIf_UnreachableReplicas(t *testing.T) {
+    // peer never answers, its silence must not pass for a missing key
+    c, _ := standaloneCluster(t, NewInMemoryStorage(), "node-b", "partitions=1")
+
+    if result := c.storeIf([]byte("k"), []byte("v"), Precondition{ Absent: true }, ConsistencyLevelOne); result != STORE_ERROR {
+        t.Fatal("Precondition shall not be checked without all replicas", result)
+    }
+    if _, ok := c.storage.Get([]byte("k")); ok {
+        t.Error("Value shall not be stored")
+    }
+}
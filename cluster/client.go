@@ -2,6 +2,7 @@ package cluster
 
 import (
     "log"
+    "time"
 )
 
 /*
@@ -10,30 +11,42 @@ See http://stackoverflow.com/questions/900697/how-to-find-the-largest-udp-packet
 Empirically tested up to 6000 on loopback interface, however real-network
 testing was not done
 
-Limiting block size to 512 to guarantee packet delivery
+Limiting block size to 512 to guarantee packet delivery, values that do not
+fit into a datagram are moved over stream transport instead
  */
 const BlockSize = 512
 
+// Values up to this size are stored directly, bigger ones shall be written as blobs
+const MaxValueSize = 16 * 1024 * 1024
+
 type Client struct {
     Node    *Node
     Cluster *Cluster
 }
 
-func NewClient(domain string, name string, group string, partitions int, bind string, port int) (*Client, error) {
+func NewClient(domain string, name string, group string, partitions int, bind string, port int, storage Storage) (*Client, error) {
+    return NewClientWithDiscovery(domain, name, group, partitions, bind, port, storage, NewBonjourDiscovery())
+}
+
+// Same as NewClient, but finds peers with given discovery instead of Bonjour
+func NewClientWithDiscovery(domain string, name string, group string, partitions int, bind string, port int, storage Storage, discovery Discovery) (*Client, error) {
     node := NewNode(domain, name)
+    node.Discovery = discovery
     node.Bind = bind
     node.Port = port
     node.Group = &group
 
     node.AnnouncePresence()
-    node.StartDiscovery()
 
-    cluster, err := NewVia(node, partitions)
+    cluster, err := NewVia(node, partitions, storage)
 
     if err == nil {
         cluster.Connect()
     }
 
+    // discover once ready to answer peers
+    node.StartDiscovery()
+
     go func() {
         for {
             select {
@@ -42,9 +55,16 @@ func NewClient(domain string, name string, group string, partitions int, bind st
                     // stupid but anyways: once I notice I joined, I connect to cluster :D
                 }
                 log.Printf("%s joined with %d partitions", *peer.Name, peer.Partitions)
+                if cluster != nil {
+                    cluster.DeliverHints(*peer.Name)
+                }
             case peer := <- node.Left:
                 log.Println(*peer.Name, "left")
             }
+
+            if cluster != nil {
+                cluster.Rebalance()
+            }
         }
     }()
 
@@ -59,6 +79,14 @@ func (client *Client) Leave() {
     client.Cluster.Disconnect()
 }
 
+// Leave the cluster and release local storage
+func (client *Client) Close() error {
+    client.Node.StopDiscovery()
+    client.Leave()
+    client.Node.Shutdown()
+    return client.Cluster.storage.Close()
+}
+
 func (client *Client) Join(group string) {
     client.Node.AnnounceGroup(&group)
 }
@@ -92,35 +120,198 @@ func (client *Client) Load(key []byte, consistencyLevel ConsistencyLevel) ([]byt
 }
 
 func (client *Client) Store(key []byte, data []byte, consistencyLevel ConsistencyLevel) int {
-    if len(data) > BlockSize {
-        // load is limited to block size
+    if len(data) > MaxValueSize {
         return STORE_ERROR
     }
     return client.Cluster.Store(key, data, consistencyLevel)
 }
 
+// Store the value that expires after ttl, returns same results as Store
+func (client *Client) StoreTTL(key []byte, data []byte, ttl time.Duration, consistencyLevel ConsistencyLevel) int {
+    if len(data) > MaxValueSize {
+        return STORE_ERROR
+    }
+    return client.Cluster.StoreTTL(key, data, ttl, consistencyLevel)
+}
+
+// Start building a transaction, its writes are applied all or none on Commit
+func (client *Client) Txn() *Txn {
+    return client.Cluster.Txn()
+}
+
+// Load values of many keys at once, one message per replica
+func (client *Client) MultiLoad(keys [][]byte, consistencyLevel ConsistencyLevel) map[string]LoadResult {
+    return client.Cluster.MultiLoad(keys, consistencyLevel)
+}
+
+// Store values of many keys at once, one message per replica, returns result of every key
+func (client *Client) MultiStore(values map[string][]byte, consistencyLevel ConsistencyLevel) map[string]int {
+    results := make(map[string]int, len(values))
+    accepted := make(map[string][]byte, len(values))
+    for key, data := range values {
+        if len(data) > MaxValueSize {
+            results[key] = STORE_ERROR
+        } else {
+            accepted[key] = data
+        }
+    }
+
+    for key, result := range client.Cluster.MultiStore(accepted, consistencyLevel) {
+        results[key] = result
+    }
+    return results
+}
+
+// Delete the key, returns same results as Store
+func (client *Client) Delete(key []byte, consistencyLevel ConsistencyLevel) int {
+    return client.Cluster.Delete(key, consistencyLevel)
+}
+
+// Load all concurrent versions of the value, see Cluster.LoadVersions
+func (client *Client) LoadVersions(key []byte, consistencyLevel ConsistencyLevel) ([]*Version, int) {
+    return client.Cluster.LoadVersions(key, consistencyLevel)
+}
+
+// Store the value superseding the version with given clock
+func (client *Client) StoreVersion(key []byte, data []byte, context VectorClock, consistencyLevel ConsistencyLevel) int {
+    if len(data) > MaxValueSize {
+        return STORE_ERROR
+    }
+    return client.Cluster.StoreVersion(key, data, context, consistencyLevel)
+}
+
+// Store the value if precondition holds, STORE_PRECONDITION_FAILED if it does not
+func (client *Client) StoreIf(key []byte, data []byte, cond Precondition, consistencyLevel ConsistencyLevel) int {
+    if len(data) > MaxValueSize {
+        return STORE_ERROR
+    }
+    return client.Cluster.StoreIf(key, data, cond, consistencyLevel)
+}
+
+// Store the value only if the key is missing or deleted
+func (client *Client) StoreIfAbsent(key []byte, data []byte, consistencyLevel ConsistencyLevel) int {
+    return client.StoreIf(key, data, Precondition{ Absent: true }, consistencyLevel)
+}
+
+// Replace the value only if it is still the old one
+func (client *Client) CompareAndSwap(key []byte, old []byte, data []byte, consistencyLevel ConsistencyLevel) int {
+    return client.StoreIf(key, data, Precondition{ Hash: ValueHash(old) }, consistencyLevel)
+}
+
+// First page of keys with the prefix in order, at most limit of them
+func (client *Client) Scan(prefix []byte, limit int) (*ScanPage, error) {
+    return client.Cluster.Scan(prefix, nil, limit)
+}
+
+// Page of keys with the prefix following the cursor of the previous page
+func (client *Client) ScanAfter(prefix []byte, cursor []byte, limit int) (*ScanPage, error) {
+    return client.Cluster.Scan(prefix, cursor, limit)
+}
+
+// Watch the key, changes come to the channel of the watch until it is cancelled
+func (client *Client) Watch(key []byte) *Watch {
+    return client.Cluster.Watch(key)
+}
+
+func (client *Client) WatchPrefix(prefix []byte) *Watch {
+    return client.Cluster.WatchPrefix(prefix)
+}
+
+// Set the function that picks the value out of concurrent versions
+func (client *Client) SetResolver(resolver Resolver) {
+    client.Cluster.Resolver = resolver
+}
+
 func (client *Client) KeyNodes(key []byte, consistencyLevel ConsistencyLevel) []*Peer {
     return client.Cluster.HashNodes(key, consistencyLevel)
 }
 
 func (client *Client) DiscoverPeers() []*Peer {
-    if (! client.Node.IsDiscoveryActive() || len(client.Node.Peers) == 0) {
+    if (! client.Node.IsDiscoveryActive() || len(client.Node.Membership().Peers) == 0) {
         client.Node.DiscoverPeers()
     }
 
     return client.Cluster.Peers()
 }
 
+// Suspicion levels of peers as phi, see Cluster.Suspicions
+func (client *Client) Suspicions() map[string]float64 {
+    return client.Cluster.Suspicions()
+}
+
+// Check if the peer is suspected to have failed
+func (client *Client) IsSuspected(peer string) bool {
+    return client.Cluster.IsSuspected(peer)
+}
+
+// Campaign for the primary lease on behalf of the site, voters is the number of all voters, witnesses included
+func (client *Client) Campaign(site string, voters int) {
+    client.Cluster.Campaign(site, voters)
+}
+
+// Primary site lease as known to the node
+func (client *Client) Primary() (Lease, bool) {
+    return client.Cluster.Primary()
+}
+
+// Campaign for leadership of the group, voters is the number of all voters, current group size if zero
+func (client *Client) Elect(voters int) {
+    client.Cluster.Elect(voters)
+}
+
+// Leader lease as known to the node, lease site is the name of the leader
+func (client *Client) Leader() (Lease, bool) {
+    return client.Cluster.Leader()
+}
+
+func (client *Client) IsLeader() bool {
+    return client.Cluster.IsLeader()
+}
+
+func (client *Client) FencingToken() (uint64, error) {
+    return client.Cluster.FencingToken()
+}
+
+func (client *Client) LeaderChanges() <-chan LeaderChange {
+    return client.Cluster.LeaderChanges()
+}
+
+// Store the value as leader with fencing token from FencingToken
+func (client *Client) StoreFenced(key []byte, data []byte, token uint64, consistencyLevel ConsistencyLevel) int {
+    if len(data) > MaxValueSize {
+        return STORE_ERROR
+    }
+    return client.Cluster.StoreFenced(key, data, token, consistencyLevel)
+}
+
+// Acquire the lock for ttl, returns fencing token that only grows from one holder to the next
+func (client *Client) Lock(name string, ttl time.Duration) (uint64, error) {
+    return client.Cluster.Lock(name, ttl)
+}
+
+// Extend the lock held by the node for ttl from now
+func (client *Client) Renew(name string, ttl time.Duration) error {
+    return client.Cluster.Renew(name, ttl)
+}
+
+func (client *Client) Unlock(name string) error {
+    return client.Cluster.Unlock(name)
+}
+
+func (client *Client) Locks() []HeldLock {
+    return client.Cluster.Locks()
+}
+
 func (client *Client) DiscoverGroups() map[string]Data {
-    if (! client.Node.IsDiscoveryActive() || len(client.Node.Peers) == 0) {
+    if (! client.Node.IsDiscoveryActive() || len(client.Node.Membership().Peers) == 0) {
         client.Node.DiscoverPeers()
     }
 
-    return client.Node.Groups;
+    return client.Node.Membership().Groups;
 }
 
 func (client *Client) Partitions() []*PeerPartition {
-    if (! client.Node.IsDiscoveryActive() || len(client.Node.Peers) == 0) {
+    if (! client.Node.IsDiscoveryActive() || len(client.Node.Membership().Peers) == 0) {
         client.Node.DiscoverPeers()
     }
 
@@ -4,8 +4,10 @@ package cluster
 import (
     "errors"
     "fmt"
+    "log"
     "net"
-    "container/list"
+    "sync"
+    "time"
 )
 
 type Cluster struct {
@@ -13,32 +15,94 @@ type Cluster struct {
     storage Storage
     Server *Server
     Name string
-    handlers *list.List
+    ReplicationLevel ConsistencyLevel
+    handlers *Registry
+    exchange *Exchange
+    activitiesMu sync.Mutex
+    activities map[uint64]Handler   // running activities by id
+    lastActivityId uint64
+    ringMu sync.Mutex
+    ring []*PeerPartition           // cached ring of membership version
+    ringVersion uint64
+    gossip *GossipActivity
+    detector *PhiDetector
+    PhiThreshold float64            // peers suspected more are passed over by HashNodes
+    entropy *AntiEntropyActivity
+    handoff *HandoffActivity
+    rebalancer *Rebalancer
+    collector *TombstoneCollector
+    arbiter *ArbiterActivity
+    leader *LeaderElection
+    locks *LockActivity
+    watches *WatchActivity
+    txns *TxnActivity
+    Resolver Resolver
+    TombstoneGracePeriod time.Duration
+    clock clockSource
+    applyMu sync.Mutex
+    storeIfMu sync.Mutex            // conditional writes coordinated by the node
+    Hints *HintStore
+    hintsMu sync.Mutex
+    replaying map[string]bool
 }
 
 const DefaultPartitions = 127
 const partitionsKey string = "partitions"
 
-// Create a cluster instance with node as a communication proxy
-func NewVia(node *Node, partitions int) (c *Cluster, err error) {
+// Create a cluster instance with node as a communication proxy, keeping local data in storage
+func NewVia(node *Node, partitions int, storage Storage) (c *Cluster, err error) {
     if ! node.IsOperational() {
         return nil, errors.New("Node is not ready")
     }
 
     node.SetText(map[string] string {
-        "partitions": fmt.Sprintf("%d", partitions),
+        partitionsKey: fmt.Sprintf("%d", partitions),
+        protocolKey: protocolText(),
+        featuresKey: featuresText(),
     })
 
     c = &Cluster{
         proxy: node,
-        storage: NewInMemoryStorage(),
+        storage: storage,
         Name: *node.Group,
-        handlers: list.New(),
+        ReplicationLevel: ConsistencyLevelTwo,
+        handlers: NewRegistry(),
+        activities: make(map[uint64]Handler),
+        Resolver: LastWriteWins,
+        TombstoneGracePeriod: DefaultTombstoneGracePeriod,
+        detector: NewPhiDetector(),
+        PhiThreshold: DefaultPhiThreshold,
+        Hints: NewHintStore(DefaultHintTTL, DefaultHintStoreSize),
+        replaying: make(map[string]bool),
     }
 
-    c.handlers.PushBack(NewPongActivity(c))
-    c.handlers.PushBack(NewBucketStoreActivity(c))
-    c.handlers.PushBack(NewBucketLoadActivity(c))
+    c.exchange = NewExchange(c)
+    c.gossip = NewGossipActivity(c)
+    c.entropy = NewAntiEntropyActivity(c)
+    c.handoff = NewHandoffActivity(c)
+    c.rebalancer = NewRebalancer(c)
+    c.collector = NewTombstoneCollector(c)
+    c.arbiter = NewArbiterActivity(c)
+    c.leader = NewLeaderElection(c)
+    c.locks = NewLockActivity(c)
+    c.watches = NewWatchActivity(c)
+    c.txns = NewTxnActivity(c)
+
+    c.handlers.Add(NewPongActivity(c))
+    c.handlers.Add(NewJoinActivity(c))
+    c.handlers.Add(c.gossip)
+    c.handlers.Add(NewBucketStoreActivity(c))
+    c.handlers.Add(NewBucketStoreIfActivity(c))
+    c.handlers.Add(NewBucketLoadActivity(c))
+    c.handlers.Add(c.entropy)
+    c.handlers.Add(c.handoff)
+    c.handlers.Add(c.arbiter)
+    c.handlers.Add(c.leader.arbiter)
+    c.handlers.Add(c.locks)
+    c.handlers.Add(c.watches)
+    c.handlers.Add(NewScanActivity(c))
+    c.handlers.Add(NewBatchActivity(c))
+    c.handlers.Add(c.txns)
     return c, nil
 }
 
@@ -48,24 +112,78 @@ func (c *Cluster) Connect() {
     c.Name = *c.proxy.Group
     c.Server = NewServer(c.proxy.Port, c)
     c.Server.Start()
+    c.gossip.Start()
+    c.entropy.Start()
+    c.rebalancer.Start()
+    c.collector.Start()
+    c.watches.Start()
+    c.txns.Start()
 }
 
 // Disconnect from the cluster and stop responding to cluster communications
 func (c *Cluster) Disconnect() {
+    c.arbiter.Stop()
+    c.leader.Stop()
+    c.gossip.Stop()
+    c.entropy.Stop()
+    c.rebalancer.Stop()
+    c.collector.Stop()
+    c.watches.Stop()
+    c.txns.Stop()
     if c.Server != nil {
         c.Server.Shutdown()
         c.Server = nil
     }
 }
 
-// Returns one primary node and as much consistently determined replication nodes as needed for meeting consistency level
+// Returns one primary node and as much consistently determined replication nodes as needed for meeting consistency level,
+// suspected peers are replaced with next ones on the ring as long as there are enough others
 func (c *Cluster) HashNodes(objectHash []byte, level ConsistencyLevel) []*Peer {
-    copies := c.Copies(level)
-    nodes := make([]*Peer, 0, copies)
-    partitions := c.Partitions()
+    partitions, copies := c.Partitions(), c.Copies(level)
 
-    // first of all determine the primary node
-    h, l, r, lenPeers := 0, 0, len(partitions) - 1, len(partitions)
+    nodes := walkRing(partitions, objectHash, copies, func(p *Peer) bool {
+        return !c.IsSuspected(*p.Name)
+    })
+
+    if len(nodes) < copies {
+        // not enough healthy peers, suspected ones are better than none
+        for _, p := range c.hashNodes(partitions, objectHash, copies) {
+            if len(nodes) < copies && !containsPeer(nodes, *p.Name) {
+                nodes = append(nodes, p)
+            }
+        }
+    }
+
+    return nodes
+}
+
+// Suspicion level of the peer as phi, see PhiDetector
+func (c *Cluster) Suspicion(peer string) float64 {
+    return c.detector.Phi(peer)
+}
+
+// Suspicion levels of all peers
+func (c *Cluster) Suspicions() map[string]float64 {
+    suspicions := make(map[string]float64)
+    for name := range c.proxy.Membership().Peers {
+        suspicions[name] = c.Suspicion(name)
+    }
+
+    return suspicions
+}
+
+// Check if the peer is suspected by gossip or its phi is over threshold
+func (c *Cluster) IsSuspected(peer string) bool {
+    if m, ok := c.proxy.Membership().Members[peer]; ok && m.Status == MemberSuspect {
+        return true
+    }
+
+    return c.Suspicion(peer) > c.PhiThreshold
+}
+
+// Index of the partition on the sorted ring that is primary for the hash
+func primaryPartition(partitions []*PeerPartition, objectHash []byte) int {
+    h, l, r := 0, 0, len(partitions) - 1
     if Clockwise(partitions[r].Hash(), objectHash, partitions[l].Hash()) {
         h = r
     } else {
@@ -83,21 +201,31 @@ func (c *Cluster) HashNodes(objectHash []byte, level ConsistencyLevel) []*Peer {
         h = l
     }
 
+    return h
+}
+
+// Same as HashNodes, but over already built ring and number of copies, suspected peers included
+func (c *Cluster) hashNodes(partitions []*PeerPartition, objectHash []byte, copies int) []*Peer {
+    return walkRing(partitions, objectHash, copies, func(*Peer) bool {
+        return true
+    })
+}
+
+// Peers of partitions starting from primary one for the hash, accepted ones only, up to copies,
+// fewer if the whole ring was walked
+func walkRing(partitions []*PeerPartition, objectHash []byte, copies int, accept func(*Peer) bool) []*Peer {
+    nodes := make([]*Peer, 0, copies)
+    lenPeers := len(partitions)
+
+    // first of all determine the primary node
+    h := primaryPartition(partitions, objectHash)
+
     // build up the array - we take the pivot partition and find as many *other* peers as we need
 
-    for j := 0; len(nodes) < copies; j++ {
+    for j := 0; len(nodes) < copies && j < lenPeers; j++ {
         partition := partitions[(h - j + lenPeers) % lenPeers]
         // if partition peer is not in nodes yet - we can add this partition
-        peerPresent := false
-        for k := 0; k < len(nodes); k++ {
-            if partition.Peer == nodes[k] {
-                // partition is from already added peer
-                peerPresent = true
-                break
-            }
-        }
-
-        if ! peerPresent {
+        if !containsPeer(nodes, *partition.Peer.Name) && accept(partition.Peer) {
             nodes = append(nodes, partition.Peer)
         }
     }
@@ -107,57 +235,226 @@ func (c *Cluster) HashNodes(objectHash []byte, level ConsistencyLevel) []*Peer {
 
 // Route cluster request to concrete handler, makes Cluster a Router
 func (c *Cluster) Route(r *Request) (h Handler, err error) {
-    for e := c.handlers.Front(); e != nil; e = e.Next() {
-        h, err := e.Value.(Router).Route(r)
-        if h != nil && err == nil {
-            return h, nil
+    if r.Message.Version < idVersion {
+        reply, ok := v1Operations[r.Message.Type][r.Message.Operation]
+        if !ok {
+            return nil, ErrUnsupportedMessage
+        }
+        if reply {
+            c.exchange.correlate(r)
+        }
+    }
+
+    if r.Message.Flags & FlagReply != 0 {
+        if c.exchange.awaited(r.Message) {
+            if h, ok := c.activity(r.Message.ActivityId); ok {
+                return h, nil
+            }
         }
+
+        return discard, nil
     }
 
-    return nil, errors.New("Not supported")
+    if c.exchange.seen(r) {
+        return discard, nil
+    }
+
+    return c.handlers.Route(r)
+}
+
+// Register running activity, replies to its requests are routed to it until it ends
+func (c *Cluster) begin(h Handler) uint64 {
+    c.activitiesMu.Lock()
+    defer c.activitiesMu.Unlock()
+
+    c.lastActivityId++
+    c.activities[c.lastActivityId] = h
+    return c.lastActivityId
+}
+
+// Unregister the activity and cancel its outstanding requests
+func (c *Cluster) end(id uint64) {
+    c.activitiesMu.Lock()
+    delete(c.activities, id)
+    c.activitiesMu.Unlock()
+
+    c.exchange.CancelActivity(id)
+}
+
+func (c *Cluster) activity(id uint64) (Handler, bool) {
+    c.activitiesMu.Lock()
+    defer c.activitiesMu.Unlock()
+
+    h, ok := c.activities[id]
+    return h, ok
 }
 
 // Ping another cluster peer
 func (c *Cluster) Ping(peer string) int {
     activity := NewPingActivity(c)
-
-    e := c.handlers.PushBack(activity)
-    defer c.handlers.Remove(e)
+    activity.id = c.begin(activity)
+    defer c.end(activity.id)
 
     activity.Run(peer)
-    return <- activity.Result
+    result := <- activity.Result
+
+    if result == PING_SUCCESS {
+        // peer is reachable, good time to catch it up
+        c.DeliverHints(peer)
+    }
+
+    return result
 }
 
+// Store the value as a new version, concurrent to whatever replicas have
 func (c *Cluster) Store(key, data []byte, level ConsistencyLevel) int {
-    activity := NewStoreActivity(c, c.AdjustedConsistencyLevel(level))
+    return c.StoreVersion(key, data, nil, level)
+}
+
+// Store the value as a successor of the version with context clock, as returned by LoadVersions
+func (c *Cluster) StoreVersion(key, data []byte, context VectorClock, level ConsistencyLevel) int {
+    return c.store(key, c.newVersion(data, context), c.AdjustedConsistencyLevel(level), 0)
+}
 
-    e := c.handlers.PushBack(activity)
-    defer c.handlers.Remove(e)
+// Store the value as leader, replicas reject it if voters know of a newer leader and STORE_FENCED is returned
+func (c *Cluster) StoreFenced(key, data []byte, token uint64, level ConsistencyLevel) int {
+    return c.store(key, c.newVersion(data, nil), c.AdjustedConsistencyLevel(level), token)
+}
+
+// Delete the key, tombstone supersedes every version replicas currently have
+func (c *Cluster) Delete(key []byte, level ConsistencyLevel) int {
+    versions, _ := c.load(key, c.AdjustedConsistencyLevel(level))
+
+    context := VectorClock{}
+    for _, v := range versions {
+        context = context.Merge(v.Clock)
+    }
+
+    return c.DeleteVersion(key, context, level)
+}
+
+// Delete the key superseding the version with context clock, as returned by LoadVersions
+func (c *Cluster) DeleteVersion(key []byte, context VectorClock, level ConsistencyLevel) int {
+    tombstone := c.newVersion(nil, context)
+    tombstone.Deleted = true
+
+    return c.store(key, tombstone, c.AdjustedConsistencyLevel(level), 0)
+}
+
+func (c *Cluster) store(key []byte, version *Version, level ConsistencyLevel, token uint64) int {
+    var activity *StoreActivity
+    if version.Deleted {
+        activity = NewDeleteActivity(c, level)
+    } else {
+        activity = NewStoreActivity(c, level)
+    }
+    activity.token = token
+    activity.id = c.begin(activity)
+    defer c.end(activity.id)
 
-    activity.Run(key, data)
+    activity.Run(key, version)
     return <- activity.Result
 }
 
+// Load the value, concurrent versions are resolved with cluster resolver and written back,
+// deleted keys load as missing ones
 func (c *Cluster) Load(key []byte, level ConsistencyLevel) ([]byte, int) {
     adjustedLevel := c.AdjustedConsistencyLevel(level)
-    activity := NewLoadActivity(c, adjustedLevel)
+    versions, result := c.load(key, adjustedLevel)
 
-    e := c.handlers.PushBack(activity)
-    defer c.handlers.Remove(e)
+    siblings := Siblings(versions)
+    if len(siblings) == 0 {
+        return []byte {}, result
+    }
+
+    resolved := Resolve(siblings, c.Resolver)
+    c.repair(key, resolved, versions, result, adjustedLevel)
+
+    if resolved.Deleted {
+        return []byte {}, LOAD_FAILURE
+    }
+
+    return resolved.Value, result
+}
+
+// Load all concurrent versions of the value, leaving resolution to the caller,
+// replicas are only repaired if one version supersedes all others. Tombstones
+// of deleted value are returned as well
+func (c *Cluster) LoadVersions(key []byte, level ConsistencyLevel) ([]*Version, int) {
+    adjustedLevel := c.AdjustedConsistencyLevel(level)
+    versions, result := c.load(key, adjustedLevel)
+
+    siblings := Siblings(versions)
+    if len(siblings) == 1 {
+        c.repair(key, siblings[0], versions, result, adjustedLevel)
+    }
+
+    return siblings, result
+}
+
+func (c *Cluster) load(key []byte, level ConsistencyLevel) ([]*Version, int) {
+    versions, result, _ := c.loadAnswered(key, level)
+    return versions, result
+}
+
+// Load and count replicas that actually replied, missing key and timeout both
+// end up as LOAD_FAILURE but only the former is an answer
+func (c *Cluster) loadAnswered(key []byte, level ConsistencyLevel) ([]*Version, int, int) {
+    activity := NewLoadActivity(c, level)
+    activity.id = c.begin(activity)
+    defer c.end(activity.id)
 
     activity.Run(key)
+    result := <- activity.Result
 
-    data, result := activity.Data, <- activity.Result
+    activity.mu.Lock()
+    defer activity.mu.Unlock()
+    return activity.Versions, result, len(activity.answered)
+}
 
+// Read repair: write the version back if some replicas did not return it
+func (c *Cluster) repair(key []byte, version *Version, versions []*Version, result int, level ConsistencyLevel) {
+    if stale(version, versions, result) {
+        c.store(key, version, level, 0)
+    }
+}
+
+// Some replicas did not return the version
+func stale(version *Version, versions []*Version, result int) bool {
     if result == LOAD_PARTIAL_SUCCESS {
-        c.Store(key, data, adjustedLevel)
+        return true
+    }
+    for _, v := range versions {
+        if v.Clock.Compare(version.Clock) != ClockEqual {
+            return true
+        }
     }
+    return false
+}
 
-    return data, result
+// Schedule moving keys to their owners after ring membership change
+func (c *Cluster) Rebalance() {
+    c.rebalancer.Trigger()
 }
 
-// Send cluster message as UDP packet
+// Send cluster message as UDP packet, or over TCP if it does not fit into one
 func (c *Cluster) Send(to *net.UDPAddr, m *Message) error {
+    m, err := c.adapt(to, m)
+    if err != nil {
+        return err
+    }
+
+    if !FitsDatagram(m) {
+        tcpCl, err := NewTcpClient(to)
+        if err != nil {
+            return err
+        }
+
+        defer tcpCl.Close()
+
+        return tcpCl.Send(m)
+    }
+
     udpCl, err := NewUdpClient(to)
     if err != nil {
         return err
@@ -168,11 +465,29 @@ func (c *Cluster) Send(to *net.UDPAddr, m *Message) error {
     return udpCl.Send(m)
 }
 
+// Ring of partitions for current membership, shared between callers and shall not be modified
 func (c *Cluster) Partitions() []*PeerPartition {
-    peersMap := c.proxy.Peers
+    view := c.proxy.Membership()
+
+    c.ringMu.Lock()
+    defer c.ringMu.Unlock()
+
+    if c.ring == nil || c.ringVersion != view.Version {
+        c.ring, c.ringVersion = buildRing(view.Peers), view.Version
+    }
+
+    return c.ring
+}
+
+func buildRing(peersMap map[string]Peer) []*PeerPartition {
     partitions := make([]*PeerPartition, 0, DefaultPartitions*len(peersMap))
 
     for _, p := range peersMap {
+        if _, ok := negotiate(p.Protocol()); !ok {
+            log.Printf("Peer %s speaks no protocol version in common, leaving it out", *p.Name)
+            continue
+        }
+
         pp := p.Clone()
         for i := uint32(0); i < p.Partitions; i++ {
             partitions = append(partitions, &PeerPartition{
@@ -186,8 +501,7 @@ func (c *Cluster) Partitions() []*PeerPartition {
 }
 
 func (c *Cluster) Peers() []*Peer {
-    // TODO: potential shared memory access
-    peersMap := c.proxy.Peers
+    peersMap := c.proxy.Membership().Peers
     peers := make([]*Peer, 0, len(peersMap))
 
     for _, p := range peersMap {
@@ -197,17 +511,89 @@ func (c *Cluster) Peers() []*Peer {
     return peers
 }
 
+// Campaign for the primary lease on behalf of the site, see ArbiterActivity.Campaign
+func (c *Cluster) Campaign(site string, voters int) {
+    c.arbiter.Campaign(site, voters)
+}
+
+// Primary site lease as known to the node
+func (c *Cluster) Primary() (Lease, bool) {
+    return c.arbiter.Primary()
+}
+
+// Campaign for leadership of the group, see LeaderElection.Start
+func (c *Cluster) Elect(voters int) {
+    c.leader.Start(voters)
+}
+
+// Leader lease as known to the node
+func (c *Cluster) Leader() (Lease, bool) {
+    return c.leader.Leader()
+}
+
+func (c *Cluster) IsLeader() bool {
+    return c.leader.IsLeader()
+}
+
+// Token to pass to StoreFenced, ErrNotLeader if the node does not lead
+func (c *Cluster) FencingToken() (uint64, error) {
+    return c.leader.FencingToken()
+}
+
+// Changes of leadership as seen by the node
+func (c *Cluster) LeaderChanges() <-chan LeaderChange {
+    return c.leader.Changes()
+}
+
+// Acquire the lock for ttl, returns fencing token, see LockActivity
+func (c *Cluster) Lock(name string, ttl time.Duration) (uint64, error) {
+    return c.locks.Lock(name, ttl)
+}
+
+func (c *Cluster) Renew(name string, ttl time.Duration) error {
+    return c.locks.Renew(name, ttl)
+}
+
+func (c *Cluster) Unlock(name string) error {
+    return c.locks.Unlock(name)
+}
+
+// Locks held by the node
+func (c *Cluster) Locks() []HeldLock {
+    return c.locks.Held()
+}
+
+// Watch the key for changes, see WatchActivity
+func (c *Cluster) Watch(key []byte) *Watch {
+    return c.watches.Watch(key, false)
+}
+
+// Watch all keys with the prefix for changes
+func (c *Cluster) WatchPrefix(prefix []byte) *Watch {
+    return c.watches.Watch(prefix, true)
+}
+
+// Keep transaction log in l and finish transactions left unfinished in it
+func (c *Cluster) SetTxnLog(l TxnLog) {
+    c.txns.SetLog(l)
+}
+
+// Majority of current group members
 func (c *Cluster) Quorum() int {
-    return len(c.proxy.Peers) + 1
+    return quorum(c.Size())
+}
+
+func quorum(n int) int {
+    return n / 2 + 1
 }
 
 func (c *Cluster) Size() int {
-    return len(c.proxy.Peers)
+    return len(c.proxy.Membership().Peers)
 }
 
 // Resolve cluster peer IP address by peer name
 func (c *Cluster) GetPeerAddr(peer string) (*net.UDPAddr, error) {
-    p, ok := c.proxy.Peers[peer]
+    p, ok := c.proxy.Membership().Peers[peer]
     if !ok {
         return nil, fmt.Errorf("Peer not available: %s", peer)
     }
@@ -0,0 +1,367 @@
+// Compact encoding of message loads
+package cluster
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "reflect"
+    "sort"
+)
+
+/*
+Since protocol version 3 message loads are encoded in protobuf wire format, so
+peers can be written in any language with a protobuf library or by hand:
+
+    load        0x00 type field*
+    type        uvarint     number of the load type from loadTypes
+    field       key value
+    key         uvarint     field number << 3 | wire type
+    value       uvarint                         wire type 0
+                uvarint length, bytes           wire type 2
+
+Fields of load types are numbered in declaration order starting from 1, new
+fields are only added at the end. Values map to wire types as follows:
+
+    bool, unsigned integers         0, as is (proto bool, uint32, uint64)
+    signed integers, durations      0, zigzag encoded (proto sint32, sint64)
+    strings, bytes, addresses       2, as is (proto string, bytes)
+    structs                         2, encoded fields (proto message)
+    slices of integers              2, packed uvarints (proto packed repeated)
+    other slices                    one field per element (proto repeated)
+    VectorClock                     one field per entry, an entry has the
+                                    node as field 1 and counter as field 2
+                                    (proto map<string, uint64>)
+
+Fields with zero values are left out, elements of slices are not. Fields
+unknown to the node are skipped. Loads of older versions are gob encoded and
+never start with 0x00, which gob does not write
+ */
+
+// First protocol version with compact loads
+const compactVersion byte = 3
+
+const loadMarker byte = 0
+
+const (
+    wireVarint byte = 0
+    wireBytes byte = 2
+)
+
+var ErrMalformedLoad = errors.New("Malformed message load")
+
+// Load types by number, numbers are part of the protocol and never reused
+var loadTypes = map[uint64]reflect.Type{
+    1: reflect.TypeOf(StoreDTO{}),
+    2: reflect.TypeOf(JoinDTO{}),
+    3: reflect.TypeOf(GossipDTO{}),
+    4: reflect.TypeOf(SyncDTO{}),
+    5: reflect.TypeOf(LeaseDTO{}),
+    6: reflect.TypeOf(LockDTO{}),
+    7: reflect.TypeOf(StoreIfDTO{}),
+    8: reflect.TypeOf(StoreResultDTO{}),
+    9: reflect.TypeOf(WatchDTO{}),
+    10: reflect.TypeOf(ScanDTO{}),
+    11: reflect.TypeOf(ScanResultDTO{}),
+    12: reflect.TypeOf(BatchDTO{}),
+    13: reflect.TypeOf(BatchResultDTO{}),
+    14: reflect.TypeOf(TxnDTO{}),
+    15: reflect.TypeOf(TxnVoteDTO{}),
+}
+
+var loadTypeNumbers = make(map[reflect.Type]uint64)
+
+func init() {
+    for n, t := range loadTypes {
+        loadTypeNumbers[t] = n
+    }
+}
+
+func encodeCompact(v interface{}) []byte {
+    rv := reflect.Indirect(reflect.ValueOf(v))
+    n, ok := loadTypeNumbers[rv.Type()]
+    if !ok {
+        panic(fmt.Sprintf("Unknown load type %s", rv.Type()))
+    }
+
+    buf := appendUvarint([]byte{ loadMarker }, n)
+    return appendFields(buf, rv)
+}
+
+func decodeCompact(load []byte, v interface{}) error {
+    rv := reflect.ValueOf(v)
+    if rv.Kind() != reflect.Ptr || rv.IsNil() {
+        return errors.New("Load shall be decoded into pointer")
+    }
+    rv = rv.Elem()
+
+    if len(load) == 0 || load[0] != loadMarker {
+        return ErrMalformedLoad
+    }
+    n, k := binary.Uvarint(load[1:])
+    if k <= 0 {
+        return ErrMalformedLoad
+    }
+    if t, ok := loadTypes[n]; !ok || t != rv.Type() {
+        return fmt.Errorf("Load of type %d cannot be decoded into %s", n, rv.Type())
+    }
+
+    return decodeFields(load[1 + k:], structField(rv))
+}
+
+// Gob encoded copy of compact load, for peers of older versions
+func gobLoad(load []byte) ([]byte, error) {
+    if len(load) == 0 || load[0] != loadMarker {
+        return load, nil
+    }
+
+    n, k := binary.Uvarint(load[1:])
+    t, ok := loadTypes[n]
+    if k <= 0 || !ok {
+        return nil, ErrMalformedLoad
+    }
+
+    v := reflect.New(t)
+    if err := decodeCompact(load, v.Interface()); err != nil {
+        return nil, err
+    }
+    return encodeGob(v.Interface())
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+    var tmp [binary.MaxVarintLen64]byte
+    n := binary.PutUvarint(tmp[:], x)
+    return append(buf, tmp[:n]...)
+}
+
+func appendKey(buf []byte, field int, wire byte) []byte {
+    return appendUvarint(buf, uint64(field) << 3 | uint64(wire))
+}
+
+func appendBytes(buf []byte, field int, b []byte) []byte {
+    buf = appendKey(buf, field, wireBytes)
+    buf = appendUvarint(buf, uint64(len(b)))
+    return append(buf, b...)
+}
+
+func isScalar(k reflect.Kind) bool {
+    switch k {
+    case reflect.Bool,
+        reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return true
+    }
+    return false
+}
+
+func scalar(v reflect.Value) uint64 {
+    switch v.Kind() {
+    case reflect.Bool:
+        if v.Bool() {
+            return 1
+        }
+        return 0
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        i := v.Int()
+        return uint64(i << 1) ^ uint64(i >> 63)
+    default:
+        return v.Uint()
+    }
+}
+
+func setScalar(v reflect.Value, x uint64) error {
+    switch v.Kind() {
+    case reflect.Bool:
+        v.SetBool(x != 0)
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        i := int64(x >> 1) ^ -int64(x & 1)
+        if v.OverflowInt(i) {
+            return ErrMalformedLoad
+        }
+        v.SetInt(i)
+    default:
+        if v.OverflowUint(x) {
+            return ErrMalformedLoad
+        }
+        v.SetUint(x)
+    }
+    return nil
+}
+
+func appendFields(buf []byte, v reflect.Value) []byte {
+    for i := 0; i < v.NumField(); i++ {
+        if v.Type().Field(i).PkgPath != "" {
+            continue
+        }
+        buf = appendField(buf, i + 1, v.Field(i), false)
+    }
+    return buf
+}
+
+// Zero values are left out unless they are elements of a slice
+func appendField(buf []byte, field int, v reflect.Value, element bool) []byte {
+    switch {
+    case isScalar(v.Kind()):
+        if x := scalar(v); x != 0 {
+            buf = appendKey(buf, field, wireVarint)
+            buf = appendUvarint(buf, x)
+        }
+    case v.Kind() == reflect.String:
+        if v.Len() > 0 || element {
+            buf = appendBytes(buf, field, []byte(v.String()))
+        }
+    case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+        if v.Len() > 0 || element {
+            buf = appendBytes(buf, field, v.Bytes())
+        }
+    case v.Kind() == reflect.Slice && isScalar(v.Type().Elem().Kind()):
+        if v.Len() > 0 {
+            packed := make([]byte, 0, v.Len())
+            for i := 0; i < v.Len(); i++ {
+                packed = appendUvarint(packed, scalar(v.Index(i)))
+            }
+            buf = appendBytes(buf, field, packed)
+        }
+    case v.Kind() == reflect.Slice:
+        for i := 0; i < v.Len(); i++ {
+            buf = appendField(buf, field, v.Index(i), true)
+        }
+    case v.Kind() == reflect.Map:
+        // sorted, so equal maps are encoded the same
+        keys := v.MapKeys()
+        sort.Slice(keys, func(i, j int) bool {
+            return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+        })
+        for _, k := range keys {
+            entry := appendField(nil, 1, k, false)
+            entry = appendField(entry, 2, v.MapIndex(k), false)
+            buf = appendBytes(buf, field, entry)
+        }
+    case v.Kind() == reflect.Struct:
+        if body := appendFields(nil, v); len(body) > 0 || element {
+            buf = appendBytes(buf, field, body)
+        }
+    default:
+        panic(fmt.Sprintf("Cannot encode %s", v.Type()))
+    }
+    return buf
+}
+
+// Exported fields of the struct by number
+func structField(v reflect.Value) func(uint64) (reflect.Value, bool) {
+    return func(n uint64) (reflect.Value, bool) {
+        if n == 0 || n > uint64(v.NumField()) || v.Type().Field(int(n - 1)).PkgPath != "" {
+            return reflect.Value{}, false
+        }
+        return v.Field(int(n - 1)), true
+    }
+}
+
+func decodeFields(b []byte, fieldAt func(uint64) (reflect.Value, bool)) error {
+    for len(b) > 0 {
+        key, n := binary.Uvarint(b)
+        if n <= 0 {
+            return ErrMalformedLoad
+        }
+        b = b[n:]
+
+        var x uint64
+        var raw []byte
+        wire := byte(key & 7)
+        switch wire {
+        case wireVarint:
+            if x, n = binary.Uvarint(b); n <= 0 {
+                return ErrMalformedLoad
+            }
+            b = b[n:]
+        case wireBytes:
+            l, n := binary.Uvarint(b)
+            if n <= 0 || l > uint64(len(b) - n) {
+                return ErrMalformedLoad
+            }
+            raw, b = b[n:n + int(l)], b[n + int(l):]
+        default:
+            return ErrMalformedLoad
+        }
+
+        f, ok := fieldAt(key >> 3)
+        if !ok {
+            // written by newer node
+            continue
+        }
+        if err := decodeField(f, wire, x, raw); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func decodeField(v reflect.Value, wire byte, x uint64, raw []byte) error {
+    switch {
+    case isScalar(v.Kind()):
+        if wire != wireVarint {
+            return ErrMalformedLoad
+        }
+        return setScalar(v, x)
+    case v.Kind() == reflect.Slice && isScalar(v.Type().Elem().Kind()) && wire == wireVarint:
+        // not packed
+        e := reflect.New(v.Type().Elem()).Elem()
+        if err := setScalar(e, x); err != nil {
+            return err
+        }
+        v.Set(reflect.Append(v, e))
+    case wire != wireBytes:
+        return ErrMalformedLoad
+    case v.Kind() == reflect.String:
+        v.SetString(string(raw))
+    case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+        // packet buffer is not kept
+        b := reflect.MakeSlice(v.Type(), len(raw), len(raw))
+        reflect.Copy(b, reflect.ValueOf(raw))
+        v.Set(b)
+    case v.Kind() == reflect.Slice && isScalar(v.Type().Elem().Kind()):
+        for len(raw) > 0 {
+            x, n := binary.Uvarint(raw)
+            if n <= 0 {
+                return ErrMalformedLoad
+            }
+            raw = raw[n:]
+
+            e := reflect.New(v.Type().Elem()).Elem()
+            if err := setScalar(e, x); err != nil {
+                return err
+            }
+            v.Set(reflect.Append(v, e))
+        }
+    case v.Kind() == reflect.Slice:
+        e := reflect.New(v.Type().Elem()).Elem()
+        if err := decodeField(e, wire, x, raw); err != nil {
+            return err
+        }
+        v.Set(reflect.Append(v, e))
+    case v.Kind() == reflect.Map:
+        k := reflect.New(v.Type().Key()).Elem()
+        e := reflect.New(v.Type().Elem()).Elem()
+        err := decodeFields(raw, func(n uint64) (reflect.Value, bool) {
+            switch n {
+            case 1:
+                return k, true
+            case 2:
+                return e, true
+            }
+            return reflect.Value{}, false
+        })
+        if err != nil {
+            return err
+        }
+        if v.IsNil() {
+            v.Set(reflect.MakeMap(v.Type()))
+        }
+        v.SetMapIndex(k, e)
+    case v.Kind() == reflect.Struct:
+        return decodeFields(raw, structField(v))
+    default:
+        return fmt.Errorf("Cannot decode %s", v.Type())
+    }
+    return nil
+}
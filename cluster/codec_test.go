@@ -0,0 +1,116 @@
+package cluster
+
+import (
+    "bytes"
+    "net"
+    "reflect"
+    "testing"
+    "time"
+)
+
+var codecSamples = []interface{}{
+    StoreDTO{ Key: []byte("site"), Value: []byte("b"), Clock: VectorClock{ "node-a": 7, "node-b": 1 }, Timestamp: 1700000000000000000, Expires: -1 },
+    GossipDTO{
+        From: MemberDTO{ Peer: PeerDTO{ Name: "node-a", Addr: net.ParseIP("10.0.0.1").To4(), Port: 9999, Text: []string{ "proto=1-3", "" } }, Incarnation: 3 },
+        Members: []MemberDTO{ { Status: MemberSuspect }, { Peer: PeerDTO{ Name: "node-b" } } },
+    },
+    SyncDTO{ From: []byte("a"), Hashes: [][]byte{ []byte{ 1, 2 }, []byte{} }, Leaves: []int{ 0, -1, 300 }, Entries: []SyncEntry{ { Key: []byte("k") } } },
+    LeaseDTO{ Site: "dc1", Holder: "node-a", Term: 5, Duration: 10 * time.Second },
+    StoreIfDTO{ Key: []byte("k"), If: Precondition{ Absent: true, Clock: VectorClock{ "a": 1 } }, Level: ConsistencyLevelQuorum },
+    TxnDTO{ Id: "a/1", Coordinator: "a", Writes: []StoreDTO{ { Key: []byte("x"), Deleted: true } }, Checks: []TxnCheck{ { Key: []byte("y"), If: Precondition{ Hash: []byte{ 0xFF } } } } },
+    WatchDTO{ Id: 1, Key: []byte("k"), Event: WatchEvent{ Key: []byte("k"), Value: []byte("v"), Clock: VectorClock{ "a": 2 } } },
+    ScanResultDTO{ Entries: []ScanEntry{ { Key: []byte("a") }, { Key: []byte("b"), Deleted: true } }, More: true },
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+    for _, v := range codecSamples {
+        load := EncodeLoad(v)
+        decoded := reflect.New(reflect.TypeOf(v))
+        if err := DecodeLoad(load, decoded.Interface()); err != nil {
+            t.Fatal(err)
+        }
+        if !reflect.DeepEqual(decoded.Elem().Interface(), v) {
+            t.Errorf("Decoded %+v, expected %+v", decoded.Elem().Interface(), v)
+        }
+
+        if gob, _ := encodeGob(v); len(load) >= len(gob) {
+            t.Errorf("Load of %T takes %d bytes, gob %d", v, len(load), len(gob))
+        }
+    }
+}
+
+func TestCodec_Wire(t *testing.T) {
+    load := EncodeLoad(StoreDTO{ Key: []byte("k"), Value: []byte("v"), Clock: VectorClock{ "a": 1 }, Timestamp: 1 })
+    expected := []byte{
+        0x00, 0x01,                                 // compact load of type 1
+        0x0A, 0x01, 'k',                            // field 1, bytes
+        0x12, 0x01, 'v',                            // field 2, bytes
+        0x1A, 0x05, 0x0A, 0x01, 'a', 0x10, 0x01,    // field 3, map entry
+        0x20, 0x02,                                 // field 4, zigzag varint
+    }
+    if !bytes.Equal(load, expected) {
+        t.Errorf("Unexpected encoding % x", load)
+    }
+
+    // fields of newer versions are skipped
+    var dto StoreDTO
+    if err := DecodeLoad(append(load, 0xF8, 0x07, 0x01), &dto); err != nil || string(dto.Key) != "k" {
+        t.Error("Unknown field shall be skipped", err)
+    }
+
+    if err := DecodeLoad(load, &LockDTO{}); err == nil {
+        t.Error("Load shall not be decoded into another type")
+    }
+    if err := DecodeLoad(load[:len(load) - 1], &dto); err != ErrMalformedLoad {
+        t.Error("Truncated load shall be rejected", err)
+    }
+}
+
+func TestCodec_Translate(t *testing.T) {
+    v := codecSamples[0].(StoreDTO)
+    load := EncodeLoad(v)
+    m := &Message{ Version: ProtocolVersion, Type: STORE, Length: uint16(len(load)), Load: load }
+
+    old, err := translate(m, compactVersion - 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if old.Version != compactVersion - 1 || old.Load[0] == loadMarker || int(old.Length) != len(old.Load) {
+        t.Fatal("Load shall be gob encoded for older version", old)
+    }
+    if m.Version != ProtocolVersion || !bytes.Equal(m.Load, load) {
+        t.Error("Original message shall be left as is")
+    }
+
+    var dto StoreDTO
+    if err := DecodeLoad(old.Load, &dto); err != nil || !reflect.DeepEqual(dto, v) {
+        t.Error("Unexpected load", dto, err)
+    }
+}
+
+func FuzzDecodeLoad(f *testing.F) {
+    for _, v := range codecSamples {
+        f.Add(EncodeLoad(v))
+        gob, _ := encodeGob(v)
+        f.Add(gob)
+    }
+
+    f.Fuzz(func(t *testing.T, load []byte) {
+        for _, typ := range loadTypes {
+            v := reflect.New(typ)
+            if DecodeLoad(load, v.Interface()) != nil {
+                continue
+            }
+
+            // what was decoded encodes the same every time
+            encoded := EncodeLoad(v.Interface())
+            w := reflect.New(typ)
+            if err := DecodeLoad(encoded, w.Interface()); err != nil {
+                t.Fatal(err)
+            }
+            if !bytes.Equal(EncodeLoad(w.Interface()), encoded) {
+                t.Errorf("Load of %s changed after decoding", typ)
+            }
+        }
+    })
+}
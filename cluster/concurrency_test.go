@@ -0,0 +1,56 @@
+package cluster
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestConcurrency_ParallelLoads(t *testing.T) {
+    if testing.Short() {
+        t.Skip("Starts own cluster")
+    }
+
+    clients := make([]*Client, 0, 3)
+    for i := 1; i <= 3; i++ {
+        client, err := NewClient(
+            "local.", fmt.Sprintf("parallel%d", i), "parallel", 127, "127.0.0.1", 9980 + i, NewInMemoryStorage())
+        if err != nil {
+            t.Fatal("Error creating client", err)
+        }
+        defer client.Close()
+        clients = append(clients, client)
+    }
+
+    time.Sleep(11 * time.Second)
+
+    const keys = 300
+    for i := 0; i < keys; i++ {
+        key, value := fmt.Sprintf("parallel%d", i), fmt.Sprintf("value%d", i)
+        if clients[0].Store([]byte(key), []byte(value), ConsistencyLevelTwo) != STORE_SUCCESS {
+            t.Fatal("Cannot store", key)
+        }
+    }
+
+    // every load shall get its own value, never one loaded by another activity
+    var wg sync.WaitGroup
+    errs := make(chan string, keys)
+    for i := 0; i < keys; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            key, value := fmt.Sprintf("parallel%d", i), fmt.Sprintf("value%d", i)
+            data, result := clients[i % len(clients)].Load([]byte(key), ConsistencyLevelTwo)
+            if result != LOAD_SUCCESS || string(data) != value {
+                errs <- fmt.Sprintf("%s: got %q, result %d", key, data, result)
+            }
+        }(i)
+    }
+    wg.Wait()
+    close(errs)
+
+    for err := range errs {
+        t.Error(err)
+    }
+}
@@ -0,0 +1,90 @@
+// Ways for the node to announce itself and find peers
+package cluster
+
+import (
+    "os"
+    "time"
+    "github.com/noroutine/bonjour"
+)
+
+type Discovery interface {
+    // Make the node visible to peers
+    Announce(node *Node) error
+    // Update text announced with the node
+    SetText(text []string)
+    // Stop announcing the node
+    Shutdown()
+    // Peers of all groups that are visible now, the node itself included
+    Browse(node *Node) ([]Peer, error)
+}
+
+// Discovery through mDNS, only works within one network segment
+type BonjourDiscovery struct {
+    server *bonjour.Server
+}
+
+func NewBonjourDiscovery() *BonjourDiscovery {
+    return &BonjourDiscovery{
+        server: nil,
+    }
+}
+
+func (d *BonjourDiscovery) Announce(node *Node) error {
+    hostname, _ := os.Hostname()
+    s, err := bonjour.RegisterProxy(*node.Name, ServiceType, *node.Domain, node.Port, hostname, node.Bind, node.getNodeText(), nil)
+    if err != nil {
+        return err
+    }
+
+    d.server = s
+    return nil
+}
+
+func (d *BonjourDiscovery) SetText(text []string) {
+    if d.server != nil {
+        d.server.SetText(text)
+    }
+}
+
+func (d *BonjourDiscovery) Shutdown() {
+    if d.server != nil {
+        d.server.Shutdown()
+        d.server = nil
+    }
+}
+
+func (d *BonjourDiscovery) Browse(node *Node) ([]Peer, error) {
+    resolver, err := bonjour.NewResolver(nil)
+    if err != nil {
+        return nil, err
+    }
+
+    results := make(chan *bonjour.ServiceEntry)
+
+    err = resolver.Browse(ServiceType, *node.Domain, results)
+    if err != nil {
+        return nil, err
+    }
+
+    peers := make([]Peer, 0)
+    for {
+        select {
+        case e := <- results:
+            name, hostName := e.Instance, e.HostName
+            peers = append(peers, Peer{
+                Domain:       node.Domain,
+                Name:         &name,
+                Group:        getPeerGroup(e.Text),
+                HostName:     &hostName,
+                Partitions:   getPeerPartitions(e.Text),
+                Port:         e.Port,
+                AddrIPv4:     e.AddrIPv4,
+                AddrIPv6:     e.AddrIPv6,
+                Text:         e.Text,
+            })
+        case <- time.After(browseWindow):
+            resolver.Exit <- true
+            return peers, nil
+        }
+    }
+}
@@ -0,0 +1,461 @@
+// Durable storage: append-only log of records with in-memory index
+package cluster
+
+import (
+    "encoding/binary"
+    "errors"
+    "hash/crc32"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+/*
+Log record layout, all integers are big endian
+
+    crc32       uint32      checksum of everything that follows
+    kind        byte        record kind, see recordPut
+    keyLength   uint32
+    valueLength uint32
+    key         []byte
+    value       []byte      encoded version, see EncodeVersion
+
+Records are only ever appended. On open the whole log is scanned to rebuild
+the index, a torn or corrupted tail (crash in the middle of a write) is cut
+off at the last valid record.
+
+Once the log is big enough and more than half of it is taken by overwritten
+or deleted records, it is compacted: live records are written to a temporary
+file which then replaces the log, so a crash leaves either the old or the new
+log in place
+ */
+
+type SyncPolicy int
+
+const (
+    SyncAlways SyncPolicy = iota          // fsync after every write
+    SyncInterval                          // fsync periodically in background
+    SyncNever                             // leave flushing to the OS
+)
+
+const (
+    recordPut byte = iota + 1
+    recordDelete                          // key removal, value is empty
+)
+
+const logFileName = "data.log"
+const recordHeaderSize = 13
+const DefaultSyncInterval = 1 * time.Second
+const DefaultCompactMinSize = 4 << 20
+
+type indexEntry struct {
+    offset int64        // offset of the value in the log
+    length uint32       // length of the value
+}
+
+type DiskStorage struct {
+    mu sync.RWMutex
+    path string
+    file *os.File
+    size int64
+    live int64          // bytes taken by records in the index
+    compactMinSize int64
+    index map[string]indexEntry
+    policy SyncPolicy
+    dirty bool
+    quit chan int
+}
+
+// Open or create disk storage in given directory, recovering the index from the log
+func NewDiskStorage(dir string, policy SyncPolicy) (*DiskStorage, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+
+    path := filepath.Join(dir, logFileName)
+    f, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE, 0644)
+    if err != nil {
+        return nil, err
+    }
+
+    s := &DiskStorage{
+        path: path,
+        file: f,
+        compactMinSize: DefaultCompactMinSize,
+        index: make(map[string]indexEntry),
+        policy: policy,
+    }
+
+    if err := s.recover(); err != nil {
+        f.Close()
+        return nil, err
+    }
+    s.compactIfWasteful()
+
+    if policy == SyncInterval {
+        s.quit = make(chan int, 1)
+        go s.syncLoop(DefaultSyncInterval, s.quit)
+    }
+
+    return s, nil
+}
+
+// Rebuild the index from the log and truncate a torn tail
+func (s *DiskStorage) recover() error {
+    info, err := s.file.Stat()
+    if err != nil {
+        return err
+    }
+
+    var offset int64
+    header := make([]byte, recordHeaderSize)
+    for offset < info.Size() {
+        if _, err := s.file.ReadAt(header, offset); err != nil {
+            break
+        }
+
+        kind := header[4]
+        keyLength := binary.BigEndian.Uint32(header[5:9])
+        valueLength := binary.BigEndian.Uint32(header[9:13])
+        bodyLength := int64(keyLength) + int64(valueLength)
+        if offset + recordHeaderSize + bodyLength > info.Size() {
+            break
+        }
+
+        body := make([]byte, bodyLength)
+        if _, err := s.file.ReadAt(body, offset + recordHeaderSize); err != nil {
+            break
+        }
+
+        crc := crc32.NewIEEE()
+        crc.Write(header[4:])
+        crc.Write(body)
+        if crc.Sum32() != binary.BigEndian.Uint32(header[0:4]) {
+            break
+        }
+
+        switch kind {
+        case recordPut:
+            s.set(string(body[:keyLength]), indexEntry{
+                offset: offset + recordHeaderSize + int64(keyLength),
+                length: valueLength,
+            })
+        case recordDelete:
+            s.unset(string(body[:keyLength]))
+        default:
+            return errors.New("Unknown record kind in storage log")
+        }
+
+        offset += recordHeaderSize + bodyLength
+    }
+
+    if offset < info.Size() {
+        log.Printf("Storage log is damaged at offset %d, discarding %d bytes", offset, info.Size() - offset)
+        if err := s.file.Truncate(offset); err != nil {
+            return err
+        }
+        if err := s.file.Sync(); err != nil {
+            return err
+        }
+    }
+
+    s.size = offset
+    return nil
+}
+
+func (s *DiskStorage) syncLoop(interval time.Duration, quit chan int) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <- ticker.C:
+            s.Sync()
+        case <- quit:
+            return
+        }
+    }
+}
+
+func encodeRecord(kind byte, key, value []byte) []byte {
+    buf := make([]byte, recordHeaderSize + len(key) + len(value))
+    buf[4] = kind
+    binary.BigEndian.PutUint32(buf[5:9], uint32(len(key)))
+    binary.BigEndian.PutUint32(buf[9:13], uint32(len(value)))
+    copy(buf[recordHeaderSize:], key)
+    copy(buf[recordHeaderSize + len(key):], value)
+    binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+    return buf
+}
+
+// Append one record to the log, caller must hold the write lock
+func (s *DiskStorage) append(kind byte, key, value []byte) (int64, error) {
+    buf := encodeRecord(kind, key, value)
+
+    offset := s.size
+    if _, err := s.file.WriteAt(buf, offset); err != nil {
+        // drop whatever part of the record made it to the file
+        s.file.Truncate(offset)
+        return 0, err
+    }
+    s.size += int64(len(buf))
+
+    switch s.policy {
+    case SyncAlways:
+        if err := s.file.Sync(); err != nil {
+            // record is not durable, it shall not come back on reopen either
+            s.file.Truncate(offset)
+            s.size = offset
+            return 0, err
+        }
+    default:
+        s.dirty = true
+    }
+
+    return offset, nil
+}
+
+// Index the record of the key, caller must hold the write lock
+func (s *DiskStorage) set(key string, e indexEntry) {
+    s.unset(key)
+    s.index[key] = e
+    s.live += recordHeaderSize + int64(len(key)) + int64(e.length)
+}
+
+func (s *DiskStorage) unset(key string) {
+    if e, ok := s.index[key]; ok {
+        s.live -= recordHeaderSize + int64(len(key)) + int64(e.length)
+        delete(s.index, key)
+    }
+}
+
+// Read version at index entry, caller must hold the lock
+func (s *DiskStorage) read(e indexEntry) (*Version, error) {
+    raw := make([]byte, e.length)
+    if _, err := s.file.ReadAt(raw, e.offset); err != nil && err != io.EOF {
+        return nil, err
+    }
+
+    return DecodeVersion(raw)
+}
+
+func (s *DiskStorage) Get(key []byte) (*Version, bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    e, ok := s.index[string(key)]
+    if !ok {
+        return nil, false
+    }
+
+    v, err := s.read(e)
+    if err != nil {
+        log.Println("Cannot read value from storage log:", err)
+        return nil, false
+    }
+
+    return live(v, time.Now()), true
+}
+
+// Index is only updated once the record is in the log, so failed write leaves previous version in place
+func (s *DiskStorage) Put(key []byte, version *Version) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    value := EncodeVersion(version)
+    offset, err := s.append(recordPut, key, value)
+    if err != nil {
+        return err
+    }
+
+    s.set(string(key), indexEntry{
+        offset: offset + recordHeaderSize + int64(len(key)),
+        length: uint32(len(value)),
+    })
+    s.compactIfWasteful()
+    return nil
+}
+
+func (s *DiskStorage) Delete(key []byte) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.index[string(key)]; !ok {
+        return nil
+    }
+
+    if _, err := s.append(recordDelete, key, nil); err != nil {
+        return err
+    }
+
+    s.unset(string(key))
+    s.compactIfWasteful()
+    return nil
+}
+
+func (s *DiskStorage) ForEach(f func([]byte, *Version) bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    now := time.Now()
+    for k, e := range s.index {
+        v, err := s.read(e)
+        if err != nil {
+            log.Println("Cannot read value from storage log:", err)
+            continue
+        }
+
+        if !f([]byte(k), live(v, now)) {
+            return
+        }
+    }
+}
+
+func (s *DiskStorage) Scan(from []byte, f func([]byte, *Version) bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    now := time.Now()
+    keys := make([]string, 0, len(s.index))
+    for k := range s.index {
+        keys = append(keys, k)
+    }
+    for _, k := range sortedFrom(keys, from) {
+        v, err := s.read(s.index[k])
+        if err != nil {
+            log.Println("Cannot read value from storage log:", err)
+            continue
+        }
+
+        if !f([]byte(k), live(v, now)) {
+            return
+        }
+    }
+}
+
+func (s *DiskStorage) Expire() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    now := time.Now()
+    expired := 0
+    for k, e := range s.index {
+        v, err := s.read(e)
+        if err != nil || !v.expiredBy(now) {
+            continue
+        }
+
+        value := EncodeVersion(live(v, now))
+        offset, err := s.append(recordPut, []byte(k), value)
+        if err != nil {
+            log.Println("Cannot write to storage log:", err)
+            return expired
+        }
+
+        s.set(k, indexEntry{
+            offset: offset + recordHeaderSize + int64(len(k)),
+            length: uint32(len(value)),
+        })
+        expired++
+    }
+
+    if expired > 0 {
+        s.compactIfWasteful()
+    }
+    return expired
+}
+
+// Compact once the log is big and mostly dead records, caller must hold the write lock
+func (s *DiskStorage) compactIfWasteful() {
+    if s.size < s.compactMinSize || s.live * 2 > s.size {
+        return
+    }
+
+    if err := s.compact(); err != nil {
+        // log stays as it was
+        log.Println("Cannot compact storage log:", err)
+    }
+}
+
+// Rewrite the log with live records only
+func (s *DiskStorage) Compact() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.compact()
+}
+
+// Write live records to temporary file and replace the log with it, caller must hold the write lock
+func (s *DiskStorage) compact() error {
+    tmp := s.path + ".tmp"
+    f, err := os.OpenFile(tmp, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+
+    fail := func(err error) error {
+        f.Close()
+        os.Remove(tmp)
+        return err
+    }
+
+    index := make(map[string]indexEntry, len(s.index))
+    var offset int64
+    for k, e := range s.index {
+        value := make([]byte, e.length)
+        if _, err := s.file.ReadAt(value, e.offset); err != nil && err != io.EOF {
+            return fail(err)
+        }
+
+        buf := encodeRecord(recordPut, []byte(k), value)
+        if _, err := f.WriteAt(buf, offset); err != nil {
+            return fail(err)
+        }
+        index[k] = indexEntry{
+            offset: offset + recordHeaderSize + int64(len(k)),
+            length: e.length,
+        }
+        offset += int64(len(buf))
+    }
+
+    if err := f.Sync(); err != nil {
+        return fail(err)
+    }
+    if err := os.Rename(tmp, s.path); err != nil {
+        return fail(err)
+    }
+
+    log.Printf("Compacted storage log from %d to %d bytes", s.size, offset)
+    s.file.Close()
+    s.file, s.index, s.size, s.live, s.dirty = f, index, offset, offset, false
+
+    // old log may come back after crash until the rename is synced, it still holds every live record
+    return syncDir(filepath.Dir(s.path))
+}
+
+// Flush pending writes to disk
+func (s *DiskStorage) Sync() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if !s.dirty {
+        return nil
+    }
+
+    s.dirty = false
+    return s.file.Sync()
+}
+
+func (s *DiskStorage) Close() error {
+    if s.quit != nil {
+        s.quit <- 1
+        s.quit = nil
+    }
+
+    if err := s.Sync(); err != nil {
+        return err
+    }
+
+    return s.file.Close()
+}
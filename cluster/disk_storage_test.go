@@ -0,0 +1,165 @@
+package cluster
+
+import (
+    "testing"
+    "os"
+    "path/filepath"
+)
+
+func TestDiskStorage_Reopen(t *testing.T) {
+    dir := t.TempDir()
+
+    s, err := NewDiskStorage(dir, SyncAlways)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    s.Put([]byte("a"), &Version{ Value: []byte("1") })
+    s.Put([]byte("b"), &Version{ Value: []byte("2") })
+    s.Put([]byte("a"), &Version{ Value: []byte("3") })
+    s.Put([]byte("c"), &Version{ Value: []byte("4") })
+    s.Delete([]byte("c"))
+    s.Close()
+
+    s, err = NewDiskStorage(dir, SyncAlways)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+
+    if v, ok := s.Get([]byte("a")); !ok || string(v.Value) != "3" {
+        t.Fatal("Latest value shall survive reopen", v)
+    }
+
+    if v, ok := s.Get([]byte("b")); !ok || string(v.Value) != "2" {
+        t.Fatal("Value shall survive reopen", v)
+    }
+
+    if _, ok := s.Get([]byte("c")); ok {
+        t.Fatal("Deleted key shall not be found")
+    }
+}
+
+func TestDiskStorage_TornTail(t *testing.T) {
+    dir := t.TempDir()
+
+    s, err := NewDiskStorage(dir, SyncNever)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.Put([]byte("a"), &Version{ Value: []byte("1") })
+    s.Put([]byte("b"), &Version{ Value: []byte("2") })
+    s.Close()
+
+    // simulate crash in the middle of the last write
+    path := filepath.Join(dir, logFileName)
+    info, _ := os.Stat(path)
+    if err := os.Truncate(path, info.Size() - 1); err != nil {
+        t.Fatal(err)
+    }
+
+    s, err = NewDiskStorage(dir, SyncNever)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if v, ok := s.Get([]byte("a")); !ok || string(v.Value) != "1" {
+        t.Fatal("Intact record shall be recovered", v)
+    }
+
+    if _, ok := s.Get([]byte("b")); ok {
+        t.Fatal("Torn record shall be discarded")
+    }
+
+    // log shall be usable after recovery
+    s.Put([]byte("c"), &Version{ Value: []byte("3") })
+    s.Close()
+
+    s, _ = NewDiskStorage(dir, SyncNever)
+    defer s.Close()
+    if v, ok := s.Get([]byte("c")); !ok || string(v.Value) != "3" {
+        t.Fatal("Write after recovery shall survive reopen", v)
+    }
+}
+
+func TestDiskStorage_FailedWrite(t *testing.T) {
+    dir := t.TempDir()
+
+    s, err := NewDiskStorage(dir, SyncAlways)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+
+    if err := s.Put([]byte("a"), &Version{ Value: []byte("1") }); err != nil {
+        t.Fatal(err)
+    }
+
+    // log that cannot be written to
+    f, err := os.Open(filepath.Join(dir, logFileName))
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.file.Close()
+    s.file = f
+
+    if err := s.Put([]byte("a"), &Version{ Value: []byte("2") }); err == nil {
+        t.Error("Failed write shall be reported")
+    }
+    if err := s.Delete([]byte("a")); err == nil {
+        t.Error("Failed delete shall be reported")
+    }
+    if v, ok := s.Get([]byte("a")); !ok || string(v.Value) != "1" {
+        t.Error("Failed write shall keep previous version", v)
+    }
+}
+
+func TestDiskStorage_Compact(t *testing.T) {
+    dir := t.TempDir()
+
+    s, err := NewDiskStorage(dir, SyncNever)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.compactMinSize = 1024
+
+    value := make([]byte, 100)
+    for i := 0; i < 100; i++ {
+        s.Put([]byte("a"), &Version{ Value: value })
+        s.Put([]byte("b"), &Version{ Value: []byte("2") })
+    }
+    s.Put([]byte("c"), &Version{ Value: []byte("3") })
+    s.Delete([]byte("c"))
+
+    if s.size >= 2 * s.compactMinSize {
+        t.Error("Log shall be compacted while written", s.size)
+    }
+
+    if err := s.Compact(); err != nil {
+        t.Fatal(err)
+    }
+    if s.size != s.live {
+        t.Error("Compacted log shall hold live records only", s.size, s.live)
+    }
+    s.Close()
+
+    if _, err := os.Stat(filepath.Join(dir, logFileName + ".tmp")); !os.IsNotExist(err) {
+        t.Error("Temporary file shall be gone", err)
+    }
+
+    s, err = NewDiskStorage(dir, SyncNever)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+
+    if v, ok := s.Get([]byte("a")); !ok || len(v.Value) != 100 {
+        t.Error("Value shall survive compaction", v)
+    }
+    if v, ok := s.Get([]byte("b")); !ok || string(v.Value) != "2" {
+        t.Error("Value shall survive compaction", v)
+    }
+    if _, ok := s.Get([]byte("c")); ok {
+        t.Error("Deleted key shall not come back after compaction")
+    }
+}
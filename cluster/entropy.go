@@ -0,0 +1,392 @@
+// Anti-entropy: background replica repair over hash ring ranges
+package cluster
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "log"
+    "math/rand"
+    "sort"
+    "sync"
+    "time"
+    "github.com/reusee/mmh3"
+)
+
+/*
+Every round each node walks the ring and for every range it replicates picks
+one other replica of that range and runs the exchange:
+
+    A -> B  SYNC_OP_ROOT      merkle root of the range
+    B -> A  SYNC_OP_LEAVES    leaf hashes, only if roots differ
+    A -> B  SYNC_OP_DIGESTS   key digests from differing leaves
+    B -> A  SYNC_OP_DATA      versions of keys A is missing or has different
+    B -> A  SYNC_OP_WANT      keys B is missing or has different
+    A -> B  SYNC_OP_DATA      versions of wanted keys
+
+Received versions are merged into local storage the same way writes are, so
+the newer version wins and concurrent ones are resolved
+ */
+
+const (
+    SYNC_OP_ROOT byte = iota
+    SYNC_OP_LEAVES
+    SYNC_OP_DIGESTS
+    SYNC_OP_WANT
+    SYNC_OP_DATA
+)
+
+const antiEntropyInterval = 10 * time.Second
+const syncSnapshotTTL = 2 * time.Second
+
+// approximate amount of digest bytes to put in one message
+const syncChunkSize = 4 * BlockSize
+
+type SyncEntry struct {
+    Key []byte
+    Digest []byte
+}
+
+type SyncDTO struct {
+    From []byte                 // range start, inclusive
+    To []byte                   // range end, exclusive
+    Hashes [][]byte             // root or leaves hashes
+    Leaves []int                // leaves covered by entries
+    Entries []SyncEntry
+    Keys [][]byte
+}
+
+type syncItem struct {
+    hash []byte
+    key []byte
+    digest []byte
+}
+
+type AntiEntropyActivity struct {
+    c *Cluster
+    mu sync.Mutex
+    items []syncItem            // local keys in ring order
+    itemsAt time.Time
+    quit chan int
+}
+
+func NewAntiEntropyActivity(c *Cluster) *AntiEntropyActivity {
+    return &AntiEntropyActivity{
+        c: c,
+        items: nil,
+        quit: nil,
+    }
+}
+
+func (a *AntiEntropyActivity) Route(r *Request) (h Handler, err error) {
+    if r.Message.Type == SYNC {
+        return a, nil
+    }
+
+    return nil, errors.New("Cannot handle this")
+}
+
+func (a *AntiEntropyActivity) Handle(r *Request) error {
+    peer := string(r.Message.ReplyTo)
+
+    if r.Message.Operation == SYNC_OP_DATA {
+        var dto StoreDTO
+        if err := DecodeLoad(r.Message.Load, &dto); err != nil {
+            return err
+        }
+
+        _, err := a.c.apply(dto.Key, dto.Version())
+        return err
+    }
+
+    var dto SyncDTO
+    if err := DecodeLoad(r.Message.Load, &dto); err != nil {
+        return err
+    }
+
+    switch r.Message.Operation {
+    case SYNC_OP_ROOT:
+        tree := a.tree(dto.From, dto.To, false)
+        if len(dto.Hashes) == 1 && bytes.Equal(tree.Root(), dto.Hashes[0]) {
+            return nil
+        }
+
+        return a.send(peer, SYNC_OP_LEAVES, &SyncDTO{
+            From: dto.From,
+            To: dto.To,
+            Hashes: tree.Leaves(),
+        })
+    case SYNC_OP_LEAVES:
+        return a.sendDigests(peer, dto.From, dto.To, DiffLeaves(a.tree(dto.From, dto.To, false).Leaves(), dto.Hashes))
+    case SYNC_OP_DIGESTS:
+        return a.reconcile(peer, &dto)
+    case SYNC_OP_WANT:
+        for _, key := range dto.Keys {
+            if version, ok := a.c.storage.Get(key); ok {
+                a.sendData(peer, key, version)
+            }
+        }
+        return nil
+    }
+
+    return fmt.Errorf("Unknown sync operation %d", r.Message.Operation)
+}
+
+// Send digests of local keys in given leaves of the range, split into messages of reasonable size
+func (a *AntiEntropyActivity) sendDigests(peer string, from, to []byte, leaves []int) error {
+    if len(leaves) == 0 {
+        return nil
+    }
+
+    byLeaf := make(map[int][]SyncEntry)
+    for _, item := range a.rangeItems(from, to, false) {
+        leaf := MerkleLeaf(item.hash)
+        byLeaf[leaf] = append(byLeaf[leaf], SyncEntry{
+            Key: item.key,
+            Digest: item.digest,
+        })
+    }
+
+    chunk := &SyncDTO{ From: from, To: to }
+    size := 0
+    for _, leaf := range leaves {
+        chunk.Leaves = append(chunk.Leaves, leaf)
+        for _, e := range byLeaf[leaf] {
+            chunk.Entries = append(chunk.Entries, e)
+            size += len(e.Key) + len(e.Digest)
+        }
+
+        if size >= syncChunkSize {
+            if err := a.send(peer, SYNC_OP_DIGESTS, chunk); err != nil {
+                return err
+            }
+            chunk, size = &SyncDTO{ From: from, To: to }, 0
+        }
+    }
+
+    if len(chunk.Leaves) > 0 {
+        return a.send(peer, SYNC_OP_DIGESTS, chunk)
+    }
+
+    return nil
+}
+
+// Compare remote digests with local keys and exchange the differences
+func (a *AntiEntropyActivity) reconcile(peer string, dto *SyncDTO) error {
+    leaves := make(map[int]bool, len(dto.Leaves))
+    for _, leaf := range dto.Leaves {
+        leaves[leaf] = true
+    }
+
+    remote := make(map[string][]byte, len(dto.Entries))
+    for _, e := range dto.Entries {
+        remote[string(e.Key)] = e.Digest
+    }
+
+    push := make([][]byte, 0)
+    want := make([][]byte, 0)
+    for _, item := range a.rangeItems(dto.From, dto.To, false) {
+        if !leaves[MerkleLeaf(item.hash)] {
+            continue
+        }
+
+        digest, ok := remote[string(item.key)]
+        delete(remote, string(item.key))
+
+        switch {
+        case !ok:
+            push = append(push, item.key)
+        case !bytes.Equal(digest, item.digest):
+            // versions differ, both sides merge the other one
+            push = append(push, item.key)
+            want = append(want, item.key)
+        }
+    }
+
+    // whatever is left is missing locally
+    for key := range remote {
+        want = append(want, []byte(key))
+    }
+
+    for _, key := range push {
+        if version, ok := a.c.storage.Get(key); ok {
+            a.sendData(peer, key, version)
+        }
+    }
+
+    for len(want) > 0 {
+        n, size := 0, 0
+        for ; n < len(want) && size < syncChunkSize; n++ {
+            size += len(want[n])
+        }
+
+        if err := a.send(peer, SYNC_OP_WANT, &SyncDTO{
+            From: dto.From,
+            To: dto.To,
+            Keys: want[:n],
+        }); err != nil {
+            return err
+        }
+        want = want[n:]
+    }
+
+    return nil
+}
+
+func (a *AntiEntropyActivity) send(peer string, op byte, dto *SyncDTO) error {
+    addr, err := a.c.GetPeerAddr(peer)
+    if err != nil {
+        return err
+    }
+
+    load := EncodeLoad(dto)
+    go a.c.Send(addr, &Message{
+        Version: ProtocolVersion,
+        Type: SYNC,
+        Operation: op,
+        ReplyTo: *a.c.proxy.Name,
+        Length: uint16(len(load)),
+        Load: load,
+    })
+
+    return nil
+}
+
+func (a *AntiEntropyActivity) sendData(peer string, key []byte, version *Version) {
+    addr, err := a.c.GetPeerAddr(peer)
+    if err != nil {
+        log.Println("Cannot repair peer", peer)
+        return
+    }
+
+    load := EncodeLoad(NewStoreDTO(key, version))
+    go a.c.Send(addr, &Message{
+        Version: ProtocolVersion,
+        Type: SYNC,
+        Operation: SYNC_OP_DATA,
+        ReplyTo: *a.c.proxy.Name,
+        Length: uint16(len(load)),
+        Load: load,
+    })
+}
+
+// Local keys sorted in ring order, rebuilt from storage if stale or when forced
+func (a *AntiEntropyActivity) snapshot(fresh bool) []syncItem {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    if !fresh && a.items != nil && time.Since(a.itemsAt) < syncSnapshotTTL {
+        return a.items
+    }
+
+    items := make([]syncItem, 0)
+    a.c.storage.ForEach(func(key []byte, version *Version) bool {
+        k := append([]byte{}, key...)
+        items = append(items, syncItem{
+            hash: mmh3.Sum128(k),
+            key: k,
+            digest: mmh3.Sum128(EncodeVersion(version)),
+        })
+        return true
+    })
+
+    sort.Slice(items, func(i, j int) bool {
+        return CompareHashes(items[i].hash, items[j].hash) < 0
+    })
+
+    a.items, a.itemsAt = items, time.Now()
+    return items
+}
+
+// Local keys with hashes in the ring range [from, to)
+func (a *AntiEntropyActivity) rangeItems(from, to []byte, fresh bool) []syncItem {
+    items := a.snapshot(fresh)
+    lower := sort.Search(len(items), func(i int) bool {
+        return CompareHashes(items[i].hash, from) >= 0
+    })
+    upper := sort.Search(len(items), func(i int) bool {
+        return CompareHashes(items[i].hash, to) >= 0
+    })
+
+    if CompareHashes(from, to) < 0 {
+        return items[lower:upper]
+    }
+
+    // range wraps around the top of the ring
+    return append(append([]syncItem{}, items[lower:]...), items[:upper]...)
+}
+
+func (a *AntiEntropyActivity) tree(from, to []byte, fresh bool) *MerkleTree {
+    tree := NewMerkleTree()
+    for _, item := range a.rangeItems(from, to, fresh) {
+        tree.Add(item.hash, item.key, item.digest)
+    }
+
+    return tree
+}
+
+// One pass over all ranges this node replicates
+func (a *AntiEntropyActivity) round() {
+    if a.c.Size() < 2 {
+        return
+    }
+
+    self := *a.c.proxy.Name
+    partitions := a.c.Partitions()
+    copies := a.c.Copies(a.c.ReplicationLevel)
+
+    a.snapshot(true)
+    for i, p := range partitions {
+        from, to := p.Hash(), partitions[(i + 1) % len(partitions)].Hash()
+
+        others := make([]*Peer, 0, copies)
+        replica := false
+        for _, owner := range a.c.hashNodes(partitions, from, copies) {
+            if *owner.Name == self {
+                replica = true
+            } else {
+                others = append(others, owner)
+            }
+        }
+
+        if !replica || len(others) == 0 {
+            continue
+        }
+
+        peer := others[rand.Intn(len(others))]
+        if err := a.send(*peer.Name, SYNC_OP_ROOT, &SyncDTO{
+            From: from,
+            To: to,
+            Hashes: [][]byte{ a.tree(from, to, false).Root() },
+        }); err != nil {
+            log.Println("Cannot sync with", *peer.Name, err)
+        }
+    }
+}
+
+// Launches background anti-entropy rounds
+func (a *AntiEntropyActivity) Start() {
+    if a.quit == nil {
+        a.quit = make(chan int, 1)
+        go func(quit chan int) {
+            ticker := time.NewTicker(antiEntropyInterval)
+            defer ticker.Stop()
+            for {
+                select {
+                case <- ticker.C:
+                    a.round()
+                case <- quit:
+                    return
+                }
+            }
+        }(a.quit)
+    }
+}
+
+// Stops background anti-entropy rounds
+func (a *AntiEntropyActivity) Stop() {
+    if a.quit != nil {
+        a.quit <- 1
+        a.quit = nil
+    }
+}
@@ -0,0 +1,49 @@
+package cluster
+
+import (
+    "fmt"
+    "testing"
+    "time"
+    "github.com/reusee/mmh3"
+)
+
+func TestAntiEntropy_RepairsMissingKey(t *testing.T) {
+    c := client1.Cluster
+
+    // find a key replicated by node1 and put it only to node1
+    var key []byte
+    var owners []*Peer
+    for i := 0; key == nil; i++ {
+        k := []byte(fmt.Sprintf("cold%d", i))
+        owners = c.HashNodes(mmh3.Sum128(k), c.ReplicationLevel)
+        for _, p := range owners {
+            if *p.Name == *c.proxy.Name {
+                key = k
+            }
+        }
+    }
+
+    c.storage.Put(key, c.newVersion([]byte("value"), nil))
+
+    // every round syncs with one random replica, so it may take a few
+    repaired := false
+    for i := 0; i < 20 && !repaired; i++ {
+        c.entropy.round()
+        time.Sleep(200 * time.Millisecond)
+
+        repaired = true
+        for _, client := range []*Client{ client2, client3, client4, client5 } {
+            if !containsPeer(owners, client.GetName()) {
+                continue
+            }
+
+            if v, ok := client.Cluster.storage.Get(key); !ok || string(v.Value) != "value" {
+                repaired = false
+            }
+        }
+    }
+
+    if !repaired {
+        t.Error("Replicas were not repaired")
+    }
+}
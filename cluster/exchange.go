@@ -0,0 +1,302 @@
+// Request/response exchange on top of cluster messages
+package cluster
+
+import (
+    "fmt"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+/*
+Requests carry an id unique for the sender, replies carry the same id and the
+reply flag. Until the reply comes the request is sent again with growing
+interval, so a lost datagram costs a retransmission rather than a timeout of
+the whole activity.
+
+Requests also carry the id of the activity that issued them, which replies
+echo back. Only the first reply to the request is routed, and only to that
+activity while it is running, duplicates and late replies are dropped. Retransmitted
+copies of the request that was already handled are not handled again, the
+remembered reply is sent instead.
+
+Version 1 peers know nothing of ids, see protocol.go. Requests to them are sent
+once, as they were in version 1, and their replies are given the ids of the
+oldest pending request of the same type to the same peer. Pongs carry no name,
+they are matched by address of the sender
+ */
+
+const FlagReply byte = 1
+
+const retransmitInterval = 100 * time.Millisecond
+const retransmitMaxInterval = 800 * time.Millisecond
+const requestLifetime = 3 * time.Second     // request is not retransmitted after
+const servedRequestTTL = 10 * time.Second   // retransmitted copies are recognized within
+
+// Function as a request handler
+type HandlerFunc func(*Request) error
+
+func (f HandlerFunc) Handle(r *Request) error {
+    return f(r)
+}
+
+// Handler for messages nobody waits for
+var discard = HandlerFunc(func(r *Request) error {
+    return nil
+})
+
+type pendingRequest struct {
+    activity uint64
+    done chan bool              // closed once request is replied or cancelled
+    to *net.UDPAddr             // only kept for version 1 peers
+    kind OperationType
+}
+
+type servedRequest struct {
+    reply *Message              // nil while request is handled or if handler did not reply
+    at time.Time
+}
+
+type Exchange struct {
+    c *Cluster
+    lastId uint64
+    mu sync.Mutex
+    pending map[uint64]*pendingRequest
+    served map[string]*servedRequest
+    purgedAt time.Time
+}
+
+func NewExchange(c *Cluster) *Exchange {
+    return &Exchange{
+        c: c,
+        // ids shall not repeat after restart, peers may still remember old ones
+        lastId: uint64(time.Now().UnixNano()),
+        pending: make(map[uint64]*pendingRequest),
+        served: make(map[string]*servedRequest),
+        purgedAt: time.Now(),
+    }
+}
+
+// Send request to the address until it is replied, reply is routed to the activity, returns request id
+func (x *Exchange) Request(addr *net.UDPAddr, m *Message, activity uint64) uint64 {
+    id := atomic.AddUint64(&x.lastId, 1)
+
+    // same message may be sent to several peers
+    req := *m
+    req.RequestId = id
+    req.ActivityId = activity
+    req.Flags &^= FlagReply
+
+    p := &pendingRequest{
+        activity: activity,
+        done: make(chan bool),
+    }
+    if version, err := x.c.versionAt(addr); err == nil && version < idVersion {
+        p.to, p.kind = addr, m.Type
+    }
+
+    x.mu.Lock()
+    x.pending[id] = p
+    x.mu.Unlock()
+
+    go x.retransmit(addr, &req, p)
+    return id
+}
+
+func (x *Exchange) retransmit(addr *net.UDPAddr, m *Message, p *pendingRequest) {
+    interval := retransmitInterval
+    expired := time.After(requestLifetime)
+    for {
+        err := x.c.Send(addr, m)
+        if err == ErrUnsupportedMessage {
+            x.Cancel(m.RequestId)
+            return
+        }
+        if err == nil && (!FitsDatagram(m) || p.to != nil) {
+            // stream is reliable and version 1 peers would answer every copy, only wait for reply
+            select {
+            case <- p.done:
+            case <- expired:
+                x.Cancel(m.RequestId)
+            }
+            return
+        }
+
+        select {
+        case <- p.done:
+            return
+        case <- expired:
+            x.Cancel(m.RequestId)
+            return
+        case <- time.After(interval):
+        }
+
+        if interval < retransmitMaxInterval {
+            interval *= 2
+        }
+    }
+}
+
+// Stop retransmitting requests, replies to them are dropped
+func (x *Exchange) Cancel(ids ...uint64) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+
+    for _, id := range ids {
+        x.finish(id)
+    }
+}
+
+// Stop retransmitting all requests of the activity
+func (x *Exchange) CancelActivity(activity uint64) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+
+    for id, p := range x.pending {
+        if p.activity == activity {
+            x.finish(id)
+        }
+    }
+}
+
+func (x *Exchange) finish(id uint64) *pendingRequest {
+    p, ok := x.pending[id]
+    if !ok {
+        return nil
+    }
+
+    delete(x.pending, id)
+    close(p.done)
+    return p
+}
+
+// Check if the reply is the first one to an awaited request
+func (x *Exchange) awaited(m *Message) bool {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+
+    p := x.finish(m.RequestId)
+    return p != nil && p.activity == m.ActivityId
+}
+
+// Give version 1 reply ids of the request it replies to, the reply is dropped if there is none
+func (x *Exchange) correlate(r *Request) {
+    r.Message.Flags |= FlagReply
+
+    var from *net.UDPAddr
+    if r.Message.ReplyTo != "" {
+        addr, err := x.c.GetPeerAddr(r.Message.ReplyTo)
+        if err != nil {
+            return
+        }
+        from = addr
+    }
+
+    x.mu.Lock()
+    defer x.mu.Unlock()
+
+    var oldest uint64
+    for id, p := range x.pending {
+        if p.to == nil || p.kind != r.Message.Type || (oldest != 0 && id > oldest) {
+            continue
+        }
+        if from != nil && !(p.to.IP.Equal(from.IP) && p.to.Port == from.Port) {
+            continue
+        }
+        if from == nil && !p.to.IP.Equal(r.From.IP) {
+            continue
+        }
+        oldest = id
+    }
+
+    if oldest != 0 {
+        r.Message.RequestId = oldest
+        r.Message.ActivityId = x.pending[oldest].activity
+    }
+}
+
+func servedId(r *Request) string {
+    return fmt.Sprintf("%s/%d", r.Message.ReplyTo, r.Message.RequestId)
+}
+
+// Check if request was already served, remembered reply is sent again if it was
+func (x *Exchange) seen(r *Request) bool {
+    if r.Message.RequestId == 0 {
+        // not a request
+        return false
+    }
+
+    id := servedId(r)
+
+    x.mu.Lock()
+    if time.Since(x.purgedAt) > time.Second {
+        x.purge()
+    }
+
+    var reply *Message
+    s, ok := x.served[id]
+    if ok {
+        reply = s.reply
+    } else {
+        x.served[id] = &servedRequest{
+            at: time.Now(),
+        }
+    }
+    x.mu.Unlock()
+
+    if !ok {
+        return false
+    }
+
+    if reply != nil {
+        if addr, err := x.c.GetPeerAddr(r.Message.ReplyTo); err == nil {
+            go x.c.Send(addr, reply)
+        }
+    }
+
+    return true
+}
+
+func (x *Exchange) remember(r *Request, reply *Message) {
+    if r.Message.RequestId == 0 {
+        return
+    }
+
+    x.mu.Lock()
+    defer x.mu.Unlock()
+
+    if s, ok := x.served[servedId(r)]; ok {
+        s.reply = reply
+    }
+}
+
+func (x *Exchange) purge() {
+    for id, s := range x.served {
+        if time.Since(s.at) > servedRequestTTL {
+            delete(x.served, id)
+        }
+    }
+    x.purgedAt = time.Now()
+}
+
+// Reply to the request, reply is remembered for retransmitted copies of the request
+func (c *Cluster) Reply(r *Request, m *Message) error {
+    addr, err := c.GetPeerAddr(r.Message.ReplyTo)
+    if err != nil {
+        return err
+    }
+
+    return c.reply(addr, r, m)
+}
+
+// Same as Reply, but to given address instead of the one of requesting peer
+func (c *Cluster) reply(addr *net.UDPAddr, r *Request, m *Message) error {
+    m.Flags |= FlagReply
+    m.RequestId = r.Message.RequestId
+    m.ActivityId = r.Message.ActivityId
+    c.exchange.remember(r, m)
+
+    go c.Send(addr, m)
+    return nil
+}
@@ -0,0 +1,87 @@
+package cluster
+
+import (
+    "net"
+    "testing"
+)
+
+func TestExchange_RoutesFirstReply(t *testing.T) {
+    c := client1.Cluster
+
+    replies := 0
+    handler := HandlerFunc(func(r *Request) error {
+        replies++
+        return nil
+    })
+
+    activity := c.begin(handler)
+    defer c.end(activity)
+
+    // nobody listens there, request is only retransmitted
+    addr := &net.UDPAddr{ IP: net.IPv4(127, 0, 0, 1), Port: 9 }
+    id := c.exchange.Request(addr, &Message{ Version: ProtocolVersion, Type: NOOP }, activity)
+
+    reply := &Request{
+        Message: &Message{ Version: ProtocolVersion, Type: NOOP, Flags: FlagReply, RequestId: id, ActivityId: activity },
+    }
+
+    for i := 0; i < 3; i++ {
+        h, err := c.Route(reply)
+        if err != nil {
+            t.Fatal(err)
+        }
+        h.Handle(reply)
+    }
+
+    if replies != 1 {
+        t.Fatal("Reply shall be routed to the issuer exactly once, routed", replies)
+    }
+}
+
+func TestExchange_DropsReplyToEndedActivity(t *testing.T) {
+    c := client1.Cluster
+
+    replies := 0
+    activity := c.begin(HandlerFunc(func(r *Request) error {
+        replies++
+        return nil
+    }))
+
+    addr := &net.UDPAddr{ IP: net.IPv4(127, 0, 0, 1), Port: 9 }
+    id := c.exchange.Request(addr, &Message{ Version: ProtocolVersion, Type: NOOP }, activity)
+    c.end(activity)
+
+    reply := &Request{
+        Message: &Message{ Version: ProtocolVersion, Type: NOOP, Flags: FlagReply, RequestId: id, ActivityId: activity },
+    }
+
+    if h, _ := c.Route(reply); h != nil {
+        h.Handle(reply)
+    }
+
+    if replies != 0 {
+        t.Fatal("Reply to ended activity shall be dropped")
+    }
+}
+
+func TestExchange_SuppressesDuplicateRequest(t *testing.T) {
+    c := client1.Cluster
+
+    r := &Request{
+        Message: &Message{ Version: ProtocolVersion, Type: NOOP, ReplyTo: client2.GetName(), RequestId: 42 },
+    }
+
+    if c.exchange.seen(r) {
+        t.Fatal("First copy of request shall be handled")
+    }
+
+    c.Reply(r, &Message{ Version: ProtocolVersion, Type: NOOP, ReplyTo: client1.GetName() })
+
+    if !c.exchange.seen(r) {
+        t.Fatal("Retransmitted copy of request shall not be handled again")
+    }
+
+    if s := c.exchange.served[servedId(r)]; s == nil || s.reply == nil || s.reply.Flags & FlagReply == 0 {
+        t.Fatal("Reply shall be remembered for retransmitted copies")
+    }
+}
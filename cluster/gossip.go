@@ -0,0 +1,448 @@
+// SWIM-style gossip membership and failure detection
+package cluster
+
+import (
+    "errors"
+    "log"
+    "math"
+    "math/rand"
+    "net"
+    "sort"
+    "sync"
+    "time"
+)
+
+/*
+Every protocol period the node probes one member of its group, members are
+taken in random order, each once per round:
+
+    A -> B  PING_OP_PING      direct probe, retransmitted by exchange
+    B -> A  PING_OP_PONG
+
+If pong does not come within probe timeout, A asks few other members to probe
+B on its behalf, and they forward pongs they get:
+
+    A -> C  PING_OP_PING_REQ  target B
+    C -> B  PING_OP_PING
+    B -> C  PING_OP_PONG
+    C -> A  PING_OP_PONG
+
+Member that did not answer either way by the end of the period becomes
+suspect, if it does not refute suspicion in time it is declared dead. Member
+refutes by gossiping itself alive with incarnation greater than the one it
+is suspected in. Members leaving the group gossip it themselves.
+
+News about members are piggybacked on every ping and pong, each is sent a few
+times, proportionally to logarithm of group size, which is enough for it to
+reach every member with high probability. Every message also carries its
+sender, so probed node can reply even if it did not discover prober yet.
+
+Besides, every protocol period the node sends PING_OP_GOSSIP to every peer,
+which feed phi accrual detectors of peers and carry news too.
+
+Discovery still finds new members, but only gossip removes them, so peer
+missed by one browse does not leave and join again
+ */
+
+const protocolPeriod = 1000 * time.Millisecond
+const probeTimeout = 500 * time.Millisecond
+const indirectProbes = 3                        // members asked to probe on node's behalf
+const suspicionTimeout = 5 * time.Second
+const deadMemberTTL = 30 * time.Second          // dead and left members are forgotten after
+const gossipTransmits = 4                       // times log10(size + 1) news are sent
+const gossipInboxSize = 256
+
+type MemberDTO struct {
+    Peer PeerDTO
+    Status MemberStatus
+    Incarnation uint64
+}
+
+type GossipDTO struct {
+    From MemberDTO              // sender
+    Target string               // member to probe, only in PING_OP_PING_REQ
+    Members []MemberDTO         // news
+}
+
+func NewMemberDTO(m Member) MemberDTO {
+    return MemberDTO{
+        Peer: NewPeerDTO(m.Peer),
+        Status: m.Status,
+        Incarnation: m.Incarnation,
+    }
+}
+
+func (dto MemberDTO) Member(domain *string) Member {
+    return Member{
+        Peer: dto.Peer.Peer(domain),
+        Status: dto.Status,
+        Incarnation: dto.Incarnation,
+    }
+}
+
+type rumor struct {
+    member Member
+    transmits int
+}
+
+type GossipActivity struct {
+    c *Cluster
+    mu sync.Mutex
+    rumors map[string]*rumor    // news to piggyback by member name
+    inbox chan Member           // news received, applied one by one
+    order []string              // members left to probe in this round
+    quit chan int
+}
+
+func NewGossipActivity(c *Cluster) *GossipActivity {
+    return &GossipActivity{
+        c: c,
+        rumors: make(map[string]*rumor),
+        inbox: make(chan Member, gossipInboxSize),
+        quit: nil,
+    }
+}
+
+func (a *GossipActivity) Route(r *Request) (h Handler, err error) {
+    if r.Message.Type == PING && (r.Message.Operation == PING_OP_PING_REQ || r.Message.Operation == PING_OP_GOSSIP) {
+        return a, nil
+    }
+
+    return nil, errors.New("Cannot handle this")
+}
+
+func (a *GossipActivity) Handle(r *Request) error {
+    dto, err := a.absorb(r)
+    if err != nil {
+        return err
+    }
+
+    if r.Message.Operation == PING_OP_PING_REQ {
+        go a.relay(r, dto.Target)
+    }
+
+    return nil
+}
+
+// Probe the target on behalf of requesting member, forward pong to it
+func (a *GossipActivity) relay(r *Request, target string) {
+    addr, err := a.c.GetPeerAddr(target)
+    if err != nil {
+        return
+    }
+
+    acked := make(chan bool, 1)
+    id := a.c.begin(HandlerFunc(func(pong *Request) error {
+        a.absorb(pong)
+        select {
+        case acked <- true:
+        default:
+        }
+        return nil
+    }))
+    defer a.c.end(id)
+
+    a.c.exchange.Request(addr, a.message(PING_OP_PING, target, ""), id)
+
+    select {
+    case <- acked:
+        a.c.Reply(r, a.message(PING_OP_PONG, r.Message.ReplyTo, ""))
+    case <- time.After(probeTimeout):
+    }
+}
+
+// Probe the member directly and then indirectly, suspect it if both fail
+func (a *GossipActivity) probe(target Member) {
+    name := *target.Peer.Name
+    acked := make(chan bool, 1)
+    id := a.c.begin(HandlerFunc(func(pong *Request) error {
+        a.absorb(pong)
+        select {
+        case acked <- true:
+        default:
+        }
+        return nil
+    }))
+    defer a.c.end(id)
+
+    a.c.exchange.Request(&net.UDPAddr{
+        IP: target.Peer.AddrIPv4,
+        Port: target.Peer.Port,
+    }, a.message(PING_OP_PING, name, ""), id)
+
+    select {
+    case <- acked:
+        return
+    case <- time.After(probeTimeout):
+    }
+
+    for _, helper := range a.helpers(name, indirectProbes) {
+        a.c.exchange.Request(&net.UDPAddr{
+            IP: helper.Peer.AddrIPv4,
+            Port: helper.Peer.Port,
+        }, a.message(PING_OP_PING_REQ, *helper.Peer.Name, name), id)
+    }
+
+    select {
+    case <- acked:
+        return
+    case <- time.After(protocolPeriod - probeTimeout):
+    }
+
+    log.Println("Suspecting", name)
+    target.Status = MemberSuspect
+    a.apply(target)
+}
+
+// Random alive members other than the node and excluded one, that can probe on its behalf
+func (a *GossipActivity) helpers(exclude string, k int) []Member {
+    others := make([]Member, 0)
+    for name, m := range a.c.proxy.Membership().Members {
+        if _, max := m.Peer.Protocol(); max < idVersion {
+            continue
+        }
+        if name != exclude && name != *a.c.proxy.Name && m.Status == MemberAlive {
+            others = append(others, m)
+        }
+    }
+
+    helpers := make([]Member, 0, k)
+    for _, i := range rand.Perm(len(others)) {
+        if len(helpers) == k {
+            break
+        }
+        helpers = append(helpers, others[i])
+    }
+
+    return helpers
+}
+
+// Next member to probe, new round starts in random order once everybody was probed
+func (a *GossipActivity) next() (Member, bool) {
+    members := a.c.proxy.Membership().Members
+    for round := 0; round < 2; round++ {
+        for len(a.order) > 0 {
+            name := a.order[0]
+            a.order = a.order[1:]
+            if m, ok := members[name]; ok && m.IsPeer() {
+                return m, true
+            }
+        }
+
+        for name, m := range members {
+            if name != *a.c.proxy.Name && m.IsPeer() {
+                a.order = append(a.order, name)
+            }
+        }
+
+        for i := range a.order {
+            j := rand.Intn(i + 1)
+            a.order[i], a.order[j] = a.order[j], a.order[i]
+        }
+    }
+
+    return Member{}, false
+}
+
+// Declare dead members suspected for too long, forget long dead ones
+func (a *GossipActivity) expire() {
+    for _, m := range a.c.proxy.Membership().Members {
+        if m.Status == MemberSuspect && time.Since(m.Since) > suspicionTimeout {
+            log.Println("Declaring dead", *m.Peer.Name)
+            m.Status = MemberDead
+            a.apply(m)
+        }
+    }
+
+    a.c.proxy.forget(deadMemberTTL)
+}
+
+// Apply news and spread them further if they are news indeed,
+// suspicions about the node itself are refuted
+func (a *GossipActivity) apply(m Member) {
+    if *m.Peer.Name == *a.c.proxy.Name {
+        if m.Status != MemberAlive {
+            a.spread(a.c.proxy.refute(m.Incarnation))
+        }
+        return
+    }
+
+    known, ok := a.c.proxy.Membership().Members[*m.Peer.Name]
+    if a.c.proxy.merge(m) {
+        if !m.IsPeer() {
+            a.c.detector.Remove(*m.Peer.Name)
+        }
+        if ok && known.Status != MemberAlive && m.Status == MemberAlive {
+            // member is back, catch it up with writes it missed meanwhile
+            a.c.DeliverHints(*m.Peer.Name)
+        }
+        a.spread(m)
+    }
+}
+
+func (a *GossipActivity) spread(m Member) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    a.rumors[*m.Peer.Name] = &rumor{
+        member: m,
+        transmits: 0,
+    }
+}
+
+// Queue news carried by the request, returns them decoded
+func (a *GossipActivity) absorb(r *Request) (*GossipDTO, error) {
+    var dto GossipDTO
+    if err := DecodeLoad(r.Message.Load, &dto); err != nil {
+        return nil, err
+    }
+
+    // sender is reachable where it sent from
+    from := dto.From.Member(a.c.proxy.Domain)
+    from.Peer.AddrIPv4 = r.From.IP
+    a.c.detector.Heartbeat(*from.Peer.Name)
+
+    for _, m := range append([]Member{ from }, dtoMembers(dto.Members, a.c.proxy.Domain)...) {
+        select {
+        case a.inbox <- m:
+        default:
+            // news are repeated by others, losing some is fine
+        }
+    }
+
+    return &dto, nil
+}
+
+func dtoMembers(dtos []MemberDTO, domain *string) []Member {
+    members := make([]Member, 0, len(dtos))
+    for _, dto := range dtos {
+        members = append(members, dto.Member(domain))
+    }
+
+    return members
+}
+
+// Gossip message to the member, with news piggybacked as long as it fits into datagram.
+// If the member is suspected or dead, it is told so first, so it can refute
+func (a *GossipActivity) message(op byte, to string, target string) *Message {
+    view := a.c.proxy.Membership()
+    dto := GossipDTO{
+        From: NewMemberDTO(a.c.proxy.selfMember()),
+        Target: target,
+        Members: make([]MemberDTO, 0),
+    }
+
+    if m, ok := view.Members[to]; ok && m.Status != MemberAlive {
+        dto.Members = append(dto.Members, NewMemberDTO(m))
+    }
+
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    rumors := make([]*rumor, 0, len(a.rumors))
+    for _, r := range a.rumors {
+        rumors = append(rumors, r)
+    }
+
+    // least sent first
+    sort.Slice(rumors, func(i, j int) bool {
+        return rumors[i].transmits < rumors[j].transmits
+    })
+
+    m := &Message{
+        Version: ProtocolVersion,
+        Type: PING,
+        Operation: op,
+        ReplyTo: *a.c.proxy.Name,
+    }
+
+    for _, r := range rumors {
+        dto.Members = append(dto.Members, NewMemberDTO(r.member))
+        m.Load = EncodeLoad(dto)
+        if !FitsDatagram(m) {
+            dto.Members = dto.Members[:len(dto.Members) - 1]
+            break
+        }
+
+        r.transmits++
+        if r.transmits >= a.transmits(len(view.Members)) {
+            delete(a.rumors, *r.member.Peer.Name)
+        }
+    }
+
+    m.Load = EncodeLoad(dto)
+    m.Length = uint16(len(m.Load))
+    return m
+}
+
+// How many times news are sent in group of given size
+func (a *GossipActivity) transmits(size int) int {
+    return gossipTransmits * int(math.Ceil(math.Log10(float64(size + 1))))
+}
+
+// Send heartbeat to every peer, carrying news as well
+func (a *GossipActivity) heartbeat() {
+    for name, m := range a.c.proxy.Membership().Members {
+        if name == *a.c.proxy.Name || !m.IsPeer() {
+            continue
+        }
+
+        go a.c.Send(&net.UDPAddr{
+            IP: m.Peer.AddrIPv4,
+            Port: m.Peer.Port,
+        }, a.message(PING_OP_GOSSIP, name, ""))
+    }
+}
+
+// Tell some members the node leaves, so they do not have to detect it
+func (a *GossipActivity) leave() {
+    self := a.c.proxy.selfMember()
+    self.Status = MemberLeft
+    a.spread(self)
+
+    for _, helper := range a.helpers("", indirectProbes) {
+        m := a.message(PING_OP_GOSSIP, *helper.Peer.Name, "")
+        a.c.Send(&net.UDPAddr{
+            IP: helper.Peer.AddrIPv4,
+            Port: helper.Peer.Port,
+        }, m)
+    }
+}
+
+// Launches background probing and applying of news
+func (a *GossipActivity) Start() {
+    if a.quit == nil {
+        a.quit = make(chan int, 1)
+        go func(quit chan int) {
+            ticker := time.NewTicker(protocolPeriod)
+            defer ticker.Stop()
+            hints := time.NewTicker(hintRetryInterval)
+            defer hints.Stop()
+            for {
+                select {
+                case m := <- a.inbox:
+                    a.apply(m)
+                case <- ticker.C:
+                    a.expire()
+                    a.heartbeat()
+                    if target, ok := a.next(); ok {
+                        go a.probe(target)
+                    }
+                case <- hints.C:
+                    a.c.retryHints()
+                case <- quit:
+                    return
+                }
+            }
+        }(a.quit)
+    }
+}
+
+// Stops background probing, members are told the node leaves
+func (a *GossipActivity) Stop() {
+    if a.quit != nil {
+        a.quit <- 1
+        a.quit = nil
+        a.leave()
+    }
+}
@@ -0,0 +1,136 @@
+package cluster
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestGossip_Supersedes(t *testing.T) {
+    cases := []struct {
+        news, known MemberStatus
+        newsInc, knownInc uint64
+        supersedes bool
+    }{
+        { MemberAlive, MemberAlive, 2, 1, true },
+        { MemberAlive, MemberSuspect, 1, 1, false },
+        { MemberAlive, MemberSuspect, 2, 1, true },
+        { MemberAlive, MemberDead, 1, 1, false },
+        { MemberSuspect, MemberAlive, 1, 1, true },
+        { MemberSuspect, MemberSuspect, 1, 1, false },
+        { MemberSuspect, MemberAlive, 1, 2, false },
+        { MemberDead, MemberSuspect, 1, 1, true },
+        { MemberDead, MemberAlive, 1, 2, false },
+        { MemberLeft, MemberAlive, 1, 1, true },
+        { MemberDead, MemberLeft, 1, 1, false },
+    }
+
+    for _, c := range cases {
+        news := Member{ Status: c.news, Incarnation: c.newsInc }
+        known := Member{ Status: c.known, Incarnation: c.knownInc }
+        if news.supersedes(known) != c.supersedes {
+            t.Error("Unexpected precedence", c)
+        }
+    }
+}
+
+func TestGossip_Refute(t *testing.T) {
+    node := client1.Node
+    self := node.Membership().Members[*node.Name]
+
+    suspect := self
+    suspect.Status = MemberSuspect
+    client1.Cluster.gossip.apply(suspect)
+
+    refuted := node.Membership().Members[*node.Name]
+    if refuted.Status != MemberAlive || refuted.Incarnation <= self.Incarnation {
+        t.Fatal("Suspicion was not refuted", refuted.Status, refuted.Incarnation)
+    }
+
+    client1.Cluster.gossip.mu.Lock()
+    r, ok := client1.Cluster.gossip.rumors[*node.Name]
+    client1.Cluster.gossip.mu.Unlock()
+    if !ok || r.member.Incarnation != refuted.Incarnation {
+        t.Fatal("Refutation is not gossiped")
+    }
+}
+
+func TestGossip_Failure(t *testing.T) {
+    if testing.Short() {
+        t.Skip("Starts own cluster")
+    }
+
+    clients := make([]*Client, 0, 3)
+    for i := 1; i <= 3; i++ {
+        client, err := NewClient(
+            "local.", fmt.Sprintf("swim%d", i), "swim", 7, "127.0.0.1", 9970 + i, NewInMemoryStorage())
+        if err != nil {
+            t.Fatal("Error creating client", err)
+        }
+        clients = append(clients, client)
+    }
+    defer clients[0].Close()
+
+    waitStatus := func(c *Client, name string, status MemberStatus, timeout time.Duration) bool {
+        deadline := time.Now().Add(timeout)
+        for time.Now().Before(deadline) {
+            if m, ok := c.Node.Membership().Members[name]; ok && m.Status == status {
+                return true
+            }
+            time.Sleep(100 * time.Millisecond)
+        }
+        return false
+    }
+
+    for _, c := range clients {
+        for i := 1; i <= 3; i++ {
+            if !waitStatus(c, fmt.Sprintf("swim%d", i), MemberAlive, 10 * time.Second) {
+                t.Fatal(c.GetName(), "does not see swim", i)
+            }
+        }
+    }
+
+    // crash, nobody is told
+    crashed := clients[2]
+    crashed.Node.StopDiscovery()
+    crashed.Cluster.gossip.quit <- 1
+    crashed.Cluster.gossip.quit = nil
+    crashed.Cluster.Server.Shutdown()
+    crashed.Cluster.Server = nil
+
+    for _, c := range clients[:2] {
+        if !waitStatus(c, "swim3", MemberDead, 15 * time.Second) {
+            t.Fatal(c.GetName(), "did not detect failure")
+        }
+
+        if _, ok := c.Node.Membership().Peers["swim3"]; ok {
+            t.Error("Dead member is still a peer")
+        }
+    }
+
+    // leaving member tells it
+    clients[1].Close()
+    if !waitStatus(clients[0], "swim2", MemberLeft, 2 * time.Second) {
+        t.Fatal("Leave was not noticed")
+    }
+}
+
+func TestGossip_HintsDeliveredWhenBack(t *testing.T) {
+    key := []byte("gossip/hinted")
+    peer := *client2.Node.Name
+    client1.Cluster.Hints.Add(peer, key, client1.Cluster.newVersion([]byte("missed"), nil))
+
+    // peer refutes suspicion, which brings it back without joining again
+    suspect := client1.Node.Membership().Members[peer]
+    suspect.Status = MemberSuspect
+    client1.Cluster.gossip.apply(suspect)
+
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        if v, ok := client2.Cluster.storage.Get(key); ok && string(v.Value) == "missed" {
+            return
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    t.Fatal("Hint was not delivered once peer is alive again")
+}
@@ -0,0 +1,91 @@
+// Direct transfer of keys to a given peer with acknowledgement
+package cluster
+
+import (
+    "errors"
+    "fmt"
+    "time"
+)
+
+const (
+    HANDOFF_OP_PUT byte = iota
+    HANDOFF_OP_ACK
+)
+
+const handoffTimeout = 3000 * time.Millisecond
+
+type HandoffActivity struct {
+    c *Cluster
+}
+
+func NewHandoffActivity(c *Cluster) *HandoffActivity {
+    return &HandoffActivity{
+        c: c,
+    }
+}
+
+func (a *HandoffActivity) Route(r *Request) (h Handler, err error) {
+    if r.Message.Type == HANDOFF && r.Message.Operation == HANDOFF_OP_PUT {
+        return a, nil
+    }
+
+    return nil, errors.New("Cannot handle this")
+}
+
+func (a *HandoffActivity) Handle(r *Request) error {
+    peer := string(r.Message.ReplyTo)
+    if _, err := a.c.GetPeerAddr(peer); err != nil {
+        return fmt.Errorf("Cannot ack handoff from %s", peer)
+    }
+
+    var dto StoreDTO
+    if err := DecodeLoad(r.Message.Load, &dto); err != nil {
+        return err
+    }
+
+    if _, err := a.c.apply(dto.Key, dto.Version()); err != nil {
+        // not acked, so the sender keeps the key
+        return err
+    }
+
+    return a.c.Reply(r, &Message{
+        Version: ProtocolVersion,
+        Type: HANDOFF,
+        Operation: HANDOFF_OP_ACK,
+        ReplyTo: *a.c.proxy.Name,
+        Length: 0,
+    })
+}
+
+// Send key and version to the peer, blocks until peer acknowledges or transfer times out
+func (a *HandoffActivity) Transfer(peer string, key []byte, version *Version) bool {
+    addr, err := a.c.GetPeerAddr(peer)
+    if err != nil {
+        return false
+    }
+
+    load := EncodeLoad(NewStoreDTO(key, version))
+
+    done := make(chan bool, 1)
+    activity := a.c.begin(HandlerFunc(func(r *Request) error {
+        done <- true
+        return nil
+    }))
+    defer a.c.end(activity)
+
+    a.c.exchange.Request(addr, &Message{
+        Version: ProtocolVersion,
+        Type: HANDOFF,
+        Operation: HANDOFF_OP_PUT,
+        ReplyTo: *a.c.proxy.Name,
+        Length: uint16(len(load)),
+        Load: load,
+    }, activity)
+
+    select {
+    case <- done:
+        return true
+    case <- time.After(handoffTimeout):
+        return false
+    }
+}
@@ -0,0 +1,199 @@
+// Hinted handoff: writes kept for replicas that could not be reached
+package cluster
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+const DefaultHintTTL = 1 * time.Hour
+const DefaultHintStoreSize = 16 * 1024 * 1024
+const hintRetryInterval = 10 * time.Second        // alive peers are caught up at least this often
+
+type Hint struct {
+    Peer string
+    Key []byte
+    Version *Version
+    Timestamp time.Time
+}
+
+func (h *Hint) size() int {
+    return len(h.Key) + len(h.Version.Value)
+}
+
+// Hints are kept in memory, oldest are dropped once the store is full
+type HintStore struct {
+    mu sync.Mutex
+    hints map[string]map[string]*Hint   // by peer and key
+    size int
+    TTL time.Duration
+    MaxSize int
+}
+
+func NewHintStore(ttl time.Duration, maxSize int) *HintStore {
+    return &HintStore{
+        hints: make(map[string]map[string]*Hint),
+        TTL: ttl,
+        MaxSize: maxSize,
+    }
+}
+
+// Remember the write for the peer, replacing older hint for the same key
+func (s *HintStore) Add(peer string, key []byte, version *Version) {
+    h := &Hint{
+        Peer: peer,
+        Key: key,
+        Version: version,
+        Timestamp: time.Now(),
+    }
+
+    if h.size() > s.MaxSize {
+        log.Println("Write is too big to keep a hint for", peer)
+        return
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.remove(peer, key)
+    for s.size + h.size() > s.MaxSize {
+        s.evictOldest()
+    }
+
+    byKey, ok := s.hints[peer]
+    if !ok {
+        byKey = make(map[string]*Hint)
+        s.hints[peer] = byKey
+    }
+    byKey[string(key)] = h
+    s.size += h.size()
+}
+
+// Unexpired hints for the peer, expired ones are dropped
+func (s *HintStore) For(peer string) []*Hint {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    hints := make([]*Hint, 0, len(s.hints[peer]))
+    for _, h := range s.hints[peer] {
+        if time.Since(h.Timestamp) > s.TTL {
+            s.remove(peer, h.Key)
+            continue
+        }
+        hints = append(hints, h)
+    }
+
+    return hints
+}
+
+// Drop the hint if it was not replaced with a newer one
+func (s *HintStore) Delivered(h *Hint) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if current, ok := s.hints[h.Peer][string(h.Key)]; ok && current == h {
+        s.remove(h.Peer, h.Key)
+    }
+}
+
+// Peers that have hints kept for them
+func (s *HintStore) Peers() []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    peers := make([]string, 0, len(s.hints))
+    for peer := range s.hints {
+        peers = append(peers, peer)
+    }
+
+    return peers
+}
+
+// Total number of hints kept
+func (s *HintStore) Len() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    n := 0
+    for _, byKey := range s.hints {
+        n += len(byKey)
+    }
+
+    return n
+}
+
+func (s *HintStore) remove(peer string, key []byte) {
+    byKey, ok := s.hints[peer]
+    if !ok {
+        return
+    }
+
+    if h, ok := byKey[string(key)]; ok {
+        s.size -= h.size()
+        delete(byKey, string(key))
+    }
+
+    if len(byKey) == 0 {
+        delete(s.hints, peer)
+    }
+}
+
+func (s *HintStore) evictOldest() {
+    var oldest *Hint
+    for _, byKey := range s.hints {
+        for _, h := range byKey {
+            if oldest == nil || h.Timestamp.Before(oldest.Timestamp) {
+                oldest = h
+            }
+        }
+    }
+
+    if oldest != nil {
+        s.remove(oldest.Peer, oldest.Key)
+    }
+}
+
+// Replay hints for the peer in background, one replay per peer at a time
+func (c *Cluster) DeliverHints(peer string) {
+    c.hintsMu.Lock()
+    if c.replaying[peer] {
+        c.hintsMu.Unlock()
+        return
+    }
+    c.replaying[peer] = true
+    c.hintsMu.Unlock()
+
+    go func() {
+        defer func() {
+            c.hintsMu.Lock()
+            delete(c.replaying, peer)
+            c.hintsMu.Unlock()
+        }()
+
+        hints := c.Hints.For(peer)
+        delivered := 0
+        for _, h := range hints {
+            if !c.handoff.Transfer(peer, h.Key, h.Version) {
+                // peer is still not reachable, try next time
+                break
+            }
+            c.Hints.Delivered(h)
+            delivered++
+        }
+
+        if delivered > 0 {
+            log.Printf("Delivered %d of %d hints to %s", delivered, len(hints), peer)
+        }
+    }()
+}
+
+// Replay hints for alive peers, they may have missed writes without ever being suspected
+func (c *Cluster) retryHints() {
+    view := c.proxy.Membership()
+    for _, peer := range c.Hints.Peers() {
+        if m, ok := view.Members[peer]; ok && m.Status == MemberAlive {
+            c.DeliverHints(peer)
+        }
+    }
+}
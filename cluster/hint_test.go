@@ -0,0 +1,41 @@
+package cluster
+
+import (
+    "testing"
+    "time"
+)
+
+func TestHintStore_Replace(t *testing.T) {
+    s := NewHintStore(DefaultHintTTL, DefaultHintStoreSize)
+    s.Add("node1", []byte("key"), &Version{ Value: []byte("old") })
+    s.Add("node1", []byte("key"), &Version{ Value: []byte("new") })
+
+    hints := s.For("node1")
+    if len(hints) != 1 || string(hints[0].Version.Value) != "new" {
+        t.Fatal("Newer hint for the same key shall replace older one")
+    }
+
+    s.Delivered(hints[0])
+    if s.Len() != 0 {
+        t.Fatal("Delivered hint shall be dropped")
+    }
+}
+
+func TestHintStore_Limits(t *testing.T) {
+    s := NewHintStore(DefaultHintTTL, 10)
+    s.Add("node1", []byte("a"), &Version{ Value: []byte("1234") })
+    s.Add("node2", []byte("b"), &Version{ Value: []byte("1234") })
+    s.Add("node1", []byte("c"), &Version{ Value: []byte("1234") })
+
+    if s.Len() != 2 || len(s.For("node2")) != 1 {
+        t.Fatal("Oldest hint shall be evicted when store is full", s.Len())
+    }
+
+    s = NewHintStore(10 * time.Millisecond, DefaultHintStoreSize)
+    s.Add("node1", []byte("a"), &Version{ Value: []byte("1") })
+    time.Sleep(20 * time.Millisecond)
+
+    if len(s.For("node1")) != 0 || s.Len() != 0 {
+        t.Fatal("Expired hint shall be dropped")
+    }
+}
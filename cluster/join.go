@@ -0,0 +1,112 @@
+// Replying to seed probes of nodes joining the group
+package cluster
+
+import (
+    "errors"
+    "log"
+    "net"
+)
+
+const (
+    JOIN_OP_HELLO byte = iota
+    JOIN_OP_WELCOME
+)
+
+type PeerDTO struct {
+    Name string
+    Addr net.IP
+    Port int
+    Text []string
+}
+
+// Hello carries the probing node, welcome the probed node followed by peers it knows
+type JoinDTO struct {
+    Peers []PeerDTO
+}
+
+func NewPeerDTO(p Peer) PeerDTO {
+    return PeerDTO{
+        Name: *p.Name,
+        Addr: p.AddrIPv4,
+        Port: p.Port,
+        Text: p.Text,
+    }
+}
+
+func (dto PeerDTO) Peer(domain *string) Peer {
+    name := dto.Name
+    return Peer{
+        Domain:       domain,
+        Name:         &name,
+        Group:        getPeerGroup(dto.Text),
+        Partitions:   getPeerPartitions(dto.Text),
+        Port:         dto.Port,
+        AddrIPv4:     dto.Addr,
+        Text:         dto.Text,
+    }
+}
+
+type JoinActivity struct {
+    c *Cluster
+}
+
+func NewJoinActivity(c *Cluster) *JoinActivity {
+    return &JoinActivity{
+        c: c,
+    }
+}
+
+func (a *JoinActivity) Route(r *Request) (h Handler, err error) {
+    if r.Message.Type == JOIN && r.Message.Operation == JOIN_OP_HELLO {
+        return a, nil
+    }
+
+    return nil, errors.New("Cannot handle this")
+}
+
+func (a *JoinActivity) Handle(r *Request) error {
+    var hello JoinDTO
+    if err := DecodeLoad(r.Message.Load, &hello); err != nil {
+        return err
+    }
+
+    if len(hello.Peers) > 0 {
+        // reachable where it probed from
+        p := hello.Peers[0].Peer(a.c.proxy.Domain)
+        p.AddrIPv4 = r.From.IP
+        a.c.proxy.introduce(p)
+    }
+
+    welcome := JoinDTO{
+        Peers: []PeerDTO{ NewPeerDTO(a.c.proxy.self()) },
+    }
+    for _, p := range a.c.proxy.Membership().Peers {
+        if *p.Name != *a.c.proxy.Name {
+            welcome.Peers = append(welcome.Peers, NewPeerDTO(p))
+        }
+    }
+
+    // reply goes straight back to probing socket, so it has to fit into datagram,
+    // and speaks the version of hello as the seed is not known to it yet
+    load := encodeLoad(welcome, r.Message.Version)
+    for len(load) > MaxLoadLength {
+        welcome.Peers = welcome.Peers[:len(welcome.Peers) / 2]
+        load = encodeLoad(welcome, r.Message.Version)
+    }
+
+    udpCl, err := NewUdpClient(r.From)
+    if err != nil {
+        log.Println("Cannot welcome", r.Message.ReplyTo)
+        return err
+    }
+    defer udpCl.Close()
+
+    return udpCl.Send(&Message{
+        Version: r.Message.Version,
+        Type: JOIN,
+        Operation: JOIN_OP_WELCOME,
+        ReplyTo: *a.c.proxy.Name,
+        Length: uint16(len(load)),
+        Load: load,
+    })
+}
@@ -0,0 +1,176 @@
+// Leader election among group members
+package cluster
+
+import (
+    "encoding/binary"
+    "errors"
+    "time"
+)
+
+/*
+Leader is elected the same way primary site is arbitrated, only every node
+campaigns for itself and election goes with LEADER messages, so a node may be
+leader of the group and voter for the primary site at the same time.
+
+Term of the leader lease is the fencing token. Leader passes it along with
+requests, and peers reject requests with tokens lower than the highest term
+they have seen. Deposed leader may still believe it leads, for example after a
+long pause, but majority of voters promised the lease to the new leader with a
+higher term. Replicas of a key need not be among them, so before applying a
+fenced write they ask voters for the highest term they know of, and majority
+of voters shares a voter with the one of the new leader. Writes of deposed
+leader are thus rejected by every replica, replicas that cannot reach majority
+of voters neither apply nor ack them.
+
+Changes of leadership are looked for every watchInterval and sent to
+LeaderChanges channel, changes nobody picked up are dropped
+ */
+
+const watchInterval = 100 * time.Millisecond
+
+// Store requests carry fencing token in message args
+const FlagFenced byte = 2
+
+var ErrNotLeader = errors.New("Not a leader")
+var ErrFenced = errors.New("Fencing token is stale")
+var ErrNoVoters = errors.New("Majority of voters cannot be reached")
+
+type LeaderChange struct {
+    Leader string                 // empty if no leader is known
+    Term uint64
+    IsSelf bool
+}
+
+type LeaderElection struct {
+    c *Cluster
+    arbiter *ArbiterActivity
+    changes chan LeaderChange
+    quit chan int
+}
+
+func NewLeaderElection(c *Cluster) *LeaderElection {
+    return &LeaderElection{
+        c: c,
+        arbiter: newArbiterActivity(c, LEADER, "leader"),
+        changes: make(chan LeaderChange, 16),
+        quit: nil,
+    }
+}
+
+// Campaign for leadership, voters is the number of all voters, zero to take current group size
+func (e *LeaderElection) Start(voters int) {
+    if e.quit != nil {
+        return
+    }
+
+    e.arbiter.Campaign(*e.c.proxy.Name, voters)
+
+    e.quit = make(chan int, 1)
+    go func(quit chan int) {
+        var last LeaderChange
+        for {
+            select {
+            case <- time.After(watchInterval):
+            case <- quit:
+                return
+            }
+
+            change := e.current()
+            if change != last {
+                last = change
+                select {
+                case e.changes <- change:
+                default:
+                }
+            }
+        }
+    }(e.quit)
+}
+
+func (e *LeaderElection) Stop() {
+    e.arbiter.Stop()
+    if e.quit != nil {
+        e.quit <- 1
+        e.quit = nil
+    }
+}
+
+func (e *LeaderElection) current() LeaderChange {
+    lease, ok := e.Leader()
+    if !ok {
+        return LeaderChange{}
+    }
+
+    return LeaderChange{
+        Leader: lease.Site,
+        Term: lease.Term,
+        IsSelf: lease.Site == *e.c.proxy.Name,
+    }
+}
+
+// Leader lease as known to the node, held by the node itself or promised by it to other node
+func (e *LeaderElection) Leader() (Lease, bool) {
+    return e.arbiter.Primary()
+}
+
+func (e *LeaderElection) IsLeader() bool {
+    _, ok := e.arbiter.Held()
+    return ok
+}
+
+// Token to pass along with requests made as leader
+func (e *LeaderElection) FencingToken() (uint64, error) {
+    lease, ok := e.arbiter.Held()
+    if !ok {
+        return 0, ErrNotLeader
+    }
+
+    return lease.Term, nil
+}
+
+// Reject tokens of leaders deposed as far as the node knows
+func (e *LeaderElection) CheckFencingToken(token uint64) error {
+    if !e.arbiter.admit(token) {
+        return ErrFenced
+    }
+
+    return nil
+}
+
+// Reject tokens of leaders deposed as far as majority of voters knows, waits for voters
+func (e *LeaderElection) ConfirmFencingToken(token uint64) error {
+    if err := e.CheckFencingToken(token); err != nil {
+        return err
+    }
+
+    highest, ok := e.arbiter.highestTerm()
+    if !ok {
+        return ErrNoVoters
+    }
+    if token < highest {
+        return ErrFenced
+    }
+
+    return nil
+}
+
+func (e *LeaderElection) Changes() <-chan LeaderChange {
+    return e.changes
+}
+
+// Put fencing token into message args
+func fence(m *Message, token uint64) {
+    args := make([]byte, 16)
+    binary.BigEndian.PutUint64(args, token)
+    m.Args = args
+    m.Flags |= FlagFenced
+}
+
+// Fencing token of the message, if it has one
+func fencingToken(m *Message) (uint64, bool) {
+    if m.Flags & FlagFenced == 0 || len(m.Args) < 8 {
+        return 0, false
+    }
+
+    return binary.BigEndian.Uint64(m.Args), true
+}
@@ -0,0 +1,111 @@
+package cluster
+
+import (
+    "testing"
+    "time"
+    "github.com/reusee/mmh3"
+)
+
+func TestLeader_Token(t *testing.T) {
+    m := &Message{ Version: 1, Type: STORE }
+    if _, ok := fencingToken(m); ok {
+        t.Fatal("Message without token shall not be fenced")
+    }
+
+    fence(m, 42)
+    if token, ok := fencingToken(m); !ok || token != 42 {
+        t.Fatal("Unexpected fencing token", token)
+    }
+
+    e := NewLeaderElection(nil)
+    if e.CheckFencingToken(5) != nil {
+        t.Fatal("Token shall be admitted")
+    }
+    if e.CheckFencingToken(3) != ErrFenced {
+        t.Fatal("Stale token shall be rejected")
+    }
+    if e.CheckFencingToken(5) != nil {
+        t.Fatal("Current token shall be admitted")
+    }
+}
+
+func TestLeader_Election(t *testing.T) {
+    if testing.Short() {
+        t.Skip("Waits for election")
+    }
+
+    clients := []*Client{ client1, client2, client3, client4, client5 }
+    for _, c := range clients {
+        c.Cluster.leader.arbiter.duration = 2 * time.Second
+        c.Elect(5)
+        defer c.Cluster.leader.Stop()
+    }
+
+    var leader *Client
+    for deadline := time.Now().Add(15 * time.Second); leader == nil && time.Now().Before(deadline); {
+        for _, c := range clients {
+            if c.IsLeader() {
+                if leader != nil {
+                    t.Fatal("Two leaders", leader.GetName(), c.GetName())
+                }
+                leader = c
+            }
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+
+    if leader == nil {
+        t.Fatal("No leader elected")
+    }
+
+    // leader may have voted for someone else first
+    timeout := time.After(time.Second)
+notified:
+    for {
+        select {
+        case change := <- leader.LeaderChanges():
+            if change.IsSelf && change.Leader == leader.GetName() {
+                break notified
+            }
+        case <- timeout:
+            t.Error("Leader change was not notified")
+            break notified
+        }
+    }
+
+    token, err := leader.FencingToken()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if result := leader.StoreFenced([]byte("fenced"), []byte("1"), token, ConsistencyLevelTwo); result != STORE_SUCCESS {
+        t.Fatal("Leader cannot store", result)
+    }
+
+    // newer leader is known to majority of voters, but to one replica only
+    key := []byte("fenced")
+    owners := leader.KeyNodes(mmh3.Sum128(key), ConsistencyLevelTwo)
+    knowing := 0
+    for _, c := range clients {
+        if !containsPeer(owners, c.GetName()) {
+            c.Cluster.leader.arbiter.admit(token + 1)
+            knowing++
+        }
+    }
+    for _, c := range clients {
+        if knowing < quorum(len(clients)) && containsPeer(owners, c.GetName()) {
+            c.Cluster.leader.arbiter.admit(token + 1)
+            knowing++
+        }
+    }
+
+    if result := leader.StoreFenced(key, []byte("2"), token, ConsistencyLevelTwo); result != STORE_FENCED {
+        t.Fatal("Deposed leader shall be fenced off", result)
+    }
+
+    for _, c := range clients {
+        if v, ok := c.Cluster.storage.Get(key); ok && string(v.Value) == "2" {
+            t.Error("Replica shall not apply write of deposed leader", c.GetName())
+        }
+    }
+}
@@ -6,8 +6,7 @@ import (
     "log"
     "fmt"
     "github.com/reusee/mmh3"
-    "bytes"
-    "encoding/gob"
+    "sync"
     "time"
 )
 
@@ -52,60 +51,40 @@ func (a *BucketLoadActivity) Route(r *Request) (h Handler, err error) {
 
 func (a *BucketLoadActivity) Handle(r *Request) error {
     peer := string(r.Message.ReplyTo)
-    ackAddr, err := a.c.GetPeerAddr(peer)
-    if err != nil {
+    if _, err := a.c.GetPeerAddr(peer); err != nil {
         return errors.New(fmt.Sprintf("Cannot ack request from %s", peer))
     }
 
-    raw := bytes.NewBuffer(r.Message.Load)
-    dec := gob.NewDecoder(raw)
     var dto StoreDTO
-    err = dec.Decode(&dto)
-    if err != nil {
-        log.Fatal("Decode error: ", err)
+    if err := DecodeLoad(r.Message.Load, &dto); err != nil {
+        return err
     }
 
-    data, ok := a.c.storage.Get(dto.Key)
+    version, ok := a.c.storage.Get(dto.Key)
     if ok {
         // send ack
         //log.Printf("Got request for key %s, sending ACK to %s", dto.Key, peer)
 
-        raw := new(bytes.Buffer)
-        enc := gob.NewEncoder(raw)
-        err := enc.Encode(StoreDTO {
-            Key: dto.Key,
-            Value: data,
-        })
-
-        if err != nil {
-            panic(fmt.Sprintf("Can't encode data for transfer: %v", err))
-        }
-
-        if raw.Len() > MaxLoadLength {
-            panic("Load is too big")
-        }
-
-        go a.c.Send(ackAddr, &Message{
-            Version: 1,
+        load := EncodeLoad(NewStoreDTO(dto.Key, version))
+        return a.c.Reply(r, &Message{
+            Version: ProtocolVersion,
             Type: LOAD,
             Operation: LOAD_OP_ACK,
             ReplyTo: *a.c.proxy.Name,
-            Length: uint16(raw.Len()),
-            Load: raw.Bytes(),
-        })
-    } else {
-        // send NACK
-        //log.Printf("Got request for key %s, sending NACK to %s", dto.Key, peer)
-        go a.c.Send(ackAddr, &Message{
-            Version: 1,
-            Type: LOAD,
-            Operation: LOAD_OP_NACK,
-            ReplyTo: *a.c.proxy.Name,
-            Length: 0,
+            Length: uint16(len(load)),
+            Load: load,
         })
     }
 
-    return nil
+    // send NACK
+    //log.Printf("Got request for key %s, sending NACK to %s", dto.Key, peer)
+    return a.c.Reply(r, &Message{
+        Version: ProtocolVersion,
+        Type: LOAD,
+        Operation: LOAD_OP_NACK,
+        ReplyTo: *a.c.proxy.Name,
+        Length: 0,
+    })
 }
 
 type LoadActivity struct {
@@ -115,49 +94,49 @@ type LoadActivity struct {
     acks int
     nacks int
     copies int
+    answered map[string]bool    // replicas that replied, timeouts count as nacks too
+    mu sync.Mutex
+    id uint64                   // activity id, set once registered
     Result chan int
-    Data []byte
+    Versions []*Version         // versions replicas returned
 }
 
 func NewLoadActivity(c *Cluster, level ConsistencyLevel) *LoadActivity {
     return &LoadActivity{
         Result: make(chan int, 1),
-        Data: []byte {},
+        Versions: make([]*Version, 0),
         level: level,
         acks: 0,
         nacks: 0,
         copies: 0,
+        answered: make(map[string]bool),
         c: c,
         fsa: nil,
     }
 }
 
-func (a *LoadActivity) Route(r *Request) (h Handler, err error)  {
-    if r.Message.Type == LOAD {
-        return a, nil
-    }
-
-    return nil, errors.New("Cannot handle this")
-}
-
 func (a *LoadActivity) Handle(r *Request) error {
     switch r.Message.Operation {
     case LOAD_OP_ACK:
         //log.Println("Received ACK from ", r.Message.ReplyTo)
 
-        raw := bytes.NewBuffer(r.Message.Load)
-        dec := gob.NewDecoder(raw)
         var dto StoreDTO
-        err := dec.Decode(&dto)
-        if err != nil {
-            log.Fatal("Decode error: ", err)
+        if err := DecodeLoad(r.Message.Load, &dto); err != nil {
+            return err
         }
 
-        a.Data = dto.Value
+        a.mu.Lock()
+        a.Versions = append(a.Versions, dto.Version())
+        a.answered[r.Message.ReplyTo] = true
+        a.mu.Unlock()
 
         go a.fsa.Send(LOAD_RCVD_ACK)
     case LOAD_OP_NACK:
         //log.Println("Received NACK from ", r.Message.ReplyTo)
+        a.mu.Lock()
+        a.answered[r.Message.ReplyTo] = true
+        a.mu.Unlock()
+
         go a.fsa.Send(LOAD_RCVD_NACK)
     }
     return nil
@@ -181,31 +160,21 @@ func (a *LoadActivity) Run(key []byte) {
             go a.fsa.Send(LOAD_SEND)
             return LOAD_SEND
         case state == LOAD_SEND && input == LOAD_SEND:
-            raw := new(bytes.Buffer)
-            enc := gob.NewEncoder(raw)
-            err := enc.Encode(StoreDTO {
+            load := EncodeLoad(StoreDTO {
                 Key: key,
             })
 
-            if err != nil {
-                panic(fmt.Sprintf("Can't encode data for transfer: %v", err))
-            }
-
-            if raw.Len() > MaxLoadLength {
-                panic("Load is too big")
-            }
-
             nodes := a.c.HashNodes(mmh3.Sum128(key), a.level)
             a.copies = len(nodes)
 
             // send load command to all peers that should have a copy
             m := &Message{
-                Version: 1,
+                Version: ProtocolVersion,
                 Type: LOAD,
                 Operation: LOAD_OP_GET,   // load
                 ReplyTo: *a.c.proxy.Name,
-                Length: uint16(raw.Len()),
-                Load: raw.Bytes(),
+                Length: uint16(len(load)),
+                Load: load,
             }
 
             for _, node := range nodes {
@@ -216,7 +185,7 @@ func (a *LoadActivity) Run(key []byte) {
                     return LOAD_ERROR
                 }
 
-                go a.c.Send(addr, m)
+                a.c.exchange.Request(addr, m, a.id)
             }
 
             return LOAD_WAIT_ACK
@@ -0,0 +1,383 @@
+// Distributed locks held by nodes for limited time
+package cluster
+
+import (
+    "errors"
+    "log"
+    "sync"
+    "time"
+    "github.com/reusee/mmh3"
+)
+
+/*
+Lock is kept by the nodes owning its name on the ring, the same ones that
+would keep the value of the key with lock name at lockLevel. Node holds the
+lock once majority of owners granted it:
+
+    N -> owners  LOCK_OP_ACQUIRE   name, holder and ttl
+    O -> N       LOCK_OP_GRANT     with fencing token, or LOCK_OP_DENY with current holder
+    N -> owners  LOCK_OP_RENEW     with the token taken
+    O -> N       LOCK_OP_GRANT
+
+Every owner gives out fencing tokens from its own counter, which starts from
+clock at the owner start and only grows, and holder takes the highest one it
+got. Counters of owners differ, so before the lock is taken the token is sent
+back to owners, which raise their counters to it, and majority of them has to
+confirm. Two majorities of owners share an owner, so the next holder gets a
+grant from an owner whose counter is past the token of the previous holder,
+and the token it takes is higher. Whatever is guarded by the lock shall reject
+tokens lower than the highest it has seen.
+
+Lock expires after ttl unless renewed, at the holder it expires before it does
+at any owner since ttl is counted from the moment the request was sent. Owners
+only keep locks in memory, owner that restarts or takes over the name after
+ring change does not know about the lock, which is fine as long as majority of
+owners still does. Suspected owners are not replaced with next peers on the
+ring, so that all nodes ask the same owners
+ */
+
+const (
+    LOCK_OP_ACQUIRE byte = iota
+    LOCK_OP_RENEW
+    LOCK_OP_RELEASE
+    LOCK_OP_GRANT
+    LOCK_OP_DENY
+)
+
+const lockLevel = ConsistencyLevelTwo
+const lockRequestTimeout = 1000 * time.Millisecond
+
+var ErrLocked = errors.New("Lock is held by other node")
+var ErrNotLocked = errors.New("Lock is not held")
+var ErrNoQuorum = errors.New("Majority of owners cannot be reached")
+
+type LockDTO struct {
+    Name string
+    Holder string
+    Token uint64
+    TTL time.Duration
+}
+
+// Lock held by the node
+type HeldLock struct {
+    Name string
+    Token uint64
+    Expires time.Time           // by local clock
+}
+
+type lockEntry struct {
+    holder string
+    token uint64
+    expires time.Time
+}
+
+type LockActivity struct {
+    c *Cluster
+    mu sync.Mutex
+    locks map[string]*lockEntry // kept as owner
+    lastToken uint64
+    held map[string]*HeldLock   // held by the node
+}
+
+func NewLockActivity(c *Cluster) *LockActivity {
+    return &LockActivity{
+        c: c,
+        locks: make(map[string]*lockEntry),
+        // tokens shall not repeat after restart
+        lastToken: uint64(time.Now().UnixNano()),
+        held: make(map[string]*HeldLock),
+    }
+}
+
+func (a *LockActivity) Route(r *Request) (h Handler, err error) {
+    if r.Message.Type == LOCK && r.Message.Operation <= LOCK_OP_RELEASE {
+        return a, nil
+    }
+
+    return nil, errors.New("Cannot handle this")
+}
+
+// Serve lock requests as owner
+func (a *LockActivity) Handle(r *Request) error {
+    var dto LockDTO
+    if err := DecodeLoad(r.Message.Load, &dto); err != nil {
+        return err
+    }
+
+    granted, entry := a.serve(r.Message.Operation, dto, time.Now())
+
+    op := LOCK_OP_DENY
+    if granted {
+        op = LOCK_OP_GRANT
+    }
+
+    load := EncodeLoad(entry)
+    return a.c.Reply(r, &Message{
+        Version: ProtocolVersion,
+        Type: LOCK,
+        Operation: op,
+        ReplyTo: *a.c.proxy.Name,
+        Length: uint16(len(load)),
+        Load: load,
+    })
+}
+
+// Apply request to the lock table, returns whether request succeeded and the lock as it is after
+func (a *LockActivity) serve(op byte, dto LockDTO, now time.Time) (bool, LockDTO) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    e, ok := a.locks[dto.Name]
+    if ok && !now.Before(e.expires) {
+        delete(a.locks, dto.Name)
+        e, ok = nil, false
+    }
+
+    granted := false
+    switch op {
+    case LOCK_OP_ACQUIRE:
+        switch {
+        case !ok:
+            e = &lockEntry{
+                holder: dto.Holder,
+                token: a.lastToken + 1,
+            }
+            a.locks[dto.Name] = e
+            a.lastToken = e.token
+            fallthrough
+        case e.holder == dto.Holder:
+            e.expires = now.Add(dto.TTL)
+            granted = true
+        }
+    case LOCK_OP_RENEW:
+        switch {
+        case !ok:
+            // owner forgot about the lock, it is still held by majority of others
+            e = &lockEntry{
+                holder: dto.Holder,
+            }
+            a.locks[dto.Name] = e
+            fallthrough
+        case e.holder == dto.Holder && e.token <= dto.Token:
+            // token taken by the holder, tokens given out later are higher
+            e.token = dto.Token
+            if dto.Token > a.lastToken {
+                a.lastToken = dto.Token
+            }
+            e.expires = now.Add(dto.TTL)
+            granted = true
+        }
+    case LOCK_OP_RELEASE:
+        if ok && e.holder == dto.Holder && e.token <= dto.Token {
+            delete(a.locks, dto.Name)
+            e, ok = nil, false
+        }
+        granted = true
+    }
+
+    result := LockDTO{
+        Name: dto.Name,
+    }
+    if e != nil {
+        result.Holder, result.Token = e.holder, e.token
+    }
+
+    return granted, result
+}
+
+// Ring owners of the lock
+func (a *LockActivity) owners(name string) []*Peer {
+    return a.c.hashNodes(a.c.Partitions(), mmh3.Sum128([]byte(name)), a.c.Copies(lockLevel))
+}
+
+// Send request to all owners, returns replies of those who granted it and the holder named by others
+func (a *LockActivity) request(owners []*Peer, op byte, dto LockDTO) (grants []LockDTO, holder string) {
+    replies := make(chan *Request, len(owners))
+    id := a.c.begin(HandlerFunc(func(r *Request) error {
+        replies <- r
+        return nil
+    }))
+    defer a.c.end(id)
+
+    load := EncodeLoad(dto)
+    m := &Message{
+        Version: ProtocolVersion,
+        Type: LOCK,
+        Operation: op,
+        ReplyTo: *a.c.proxy.Name,
+        Length: uint16(len(load)),
+        Load: load,
+    }
+
+    sent := 0
+    for _, p := range owners {
+        addr, err := a.c.GetPeerAddr(*p.Name)
+        if err != nil {
+            log.Println("Cannot contact peer", *p.Name)
+            continue
+        }
+        a.c.exchange.Request(addr, m, id)
+        sent++
+    }
+
+    timeout := time.After(lockRequestTimeout)
+    for answered := 0; answered < sent; answered++ {
+        select {
+        case r := <- replies:
+            var reply LockDTO
+            if err := DecodeLoad(r.Message.Load, &reply); err != nil {
+                continue
+            }
+            if r.Message.Operation == LOCK_OP_GRANT {
+                grants = append(grants, reply)
+            } else {
+                holder = reply.Holder
+            }
+        case <- timeout:
+            return
+        }
+    }
+
+    return
+}
+
+// Acquire the lock for ttl, returns fencing token
+func (a *LockActivity) Lock(name string, ttl time.Duration) (uint64, error) {
+    a.mu.Lock()
+    l, ok := a.held[name]
+    ok = ok && time.Now().Before(l.Expires)
+    a.mu.Unlock()
+
+    if ok {
+        // already held, only extended
+        return l.Token, a.Renew(name, ttl)
+    }
+
+    owners := a.owners(name)
+    if len(owners) == 0 {
+        return 0, ErrNoQuorum
+    }
+
+    start := time.Now()
+    grants, holder := a.request(owners, LOCK_OP_ACQUIRE, LockDTO{
+        Name: name,
+        Holder: *a.c.proxy.Name,
+        TTL: ttl,
+    })
+
+    token := uint64(0)
+    for _, g := range grants {
+        if g.Token > token {
+            token = g.Token
+        }
+    }
+
+    if len(grants) >= quorum(len(owners)) {
+        // owners learn the token before anybody relies on it
+        grants, _ = a.request(owners, LOCK_OP_RENEW, LockDTO{
+            Name: name,
+            Holder: *a.c.proxy.Name,
+            Token: token,
+            TTL: ttl,
+        })
+    }
+
+    if len(grants) < quorum(len(owners)) {
+        // let owners that granted it go
+        if len(grants) > 0 {
+            a.request(owners, LOCK_OP_RELEASE, LockDTO{
+                Name: name,
+                Holder: *a.c.proxy.Name,
+                Token: token,
+            })
+        }
+
+        if len(holder) > 0 && holder != *a.c.proxy.Name {
+            return 0, ErrLocked
+        }
+        return 0, ErrNoQuorum
+    }
+
+    a.mu.Lock()
+    a.held[name] = &HeldLock{
+        Name: name,
+        Token: token,
+        Expires: start.Add(ttl),
+    }
+    a.mu.Unlock()
+
+    return token, nil
+}
+
+// Extend the lock held by the node for ttl from now
+func (a *LockActivity) Renew(name string, ttl time.Duration) error {
+    a.mu.Lock()
+    l, ok := a.held[name]
+    if ok && !time.Now().Before(l.Expires) {
+        delete(a.held, name)
+        ok = false
+    }
+    a.mu.Unlock()
+
+    if !ok {
+        return ErrNotLocked
+    }
+
+    owners := a.owners(name)
+    start := time.Now()
+    grants, _ := a.request(owners, LOCK_OP_RENEW, LockDTO{
+        Name: name,
+        Holder: *a.c.proxy.Name,
+        Token: l.Token,
+        TTL: ttl,
+    })
+
+    if len(grants) < quorum(len(owners)) {
+        // lock stays held until it expires, but cannot be extended
+        return ErrNoQuorum
+    }
+
+    a.mu.Lock()
+    l.Expires = start.Add(ttl)
+    a.mu.Unlock()
+
+    return nil
+}
+
+// Release the lock held by the node
+func (a *LockActivity) Unlock(name string) error {
+    a.mu.Lock()
+    l, ok := a.held[name]
+    delete(a.held, name)
+    a.mu.Unlock()
+
+    if !ok || !time.Now().Before(l.Expires) {
+        return ErrNotLocked
+    }
+
+    a.request(a.owners(name), LOCK_OP_RELEASE, LockDTO{
+        Name: name,
+        Holder: *a.c.proxy.Name,
+        Token: l.Token,
+    })
+
+    return nil
+}
+
+// Locks held by the node at the moment
+func (a *LockActivity) Held() []HeldLock {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    now := time.Now()
+    locks := make([]HeldLock, 0, len(a.held))
+    for name, l := range a.held {
+        if !now.Before(l.Expires) {
+            delete(a.held, name)
+            continue
+        }
+        locks = append(locks, *l)
+    }
+
+    return locks
+}
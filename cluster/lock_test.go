@@ -0,0 +1,147 @@
+package cluster
+
+import (
+    "testing"
+    "time"
+)
+
+func TestLock_Serve(t *testing.T) {
+    a := NewLockActivity(nil)
+    now := time.Now()
+    jack := LockDTO{ Name: "lock", Holder: "Jack", TTL: time.Second }
+    jill := LockDTO{ Name: "lock", Holder: "Jill", TTL: time.Second }
+
+    granted, first := a.serve(LOCK_OP_ACQUIRE, jack, now)
+    if !granted || first.Token == 0 {
+        t.Fatal("Free lock shall be granted")
+    }
+
+    if granted, held := a.serve(LOCK_OP_ACQUIRE, jill, now); granted || held.Holder != "Jack" {
+        t.Fatal("Held lock shall be denied", held)
+    }
+
+    jack.Token = first.Token
+    if granted, _ := a.serve(LOCK_OP_RENEW, jack, now.Add(900 * time.Millisecond)); !granted {
+        t.Fatal("Holder shall renew")
+    }
+
+    if granted, _ := a.serve(LOCK_OP_ACQUIRE, jill, now.Add(1500 * time.Millisecond)); granted {
+        t.Fatal("Renewed lock shall be denied")
+    }
+
+    granted, next := a.serve(LOCK_OP_ACQUIRE, jill, now.Add(2 * time.Second))
+    if !granted || next.Token <= first.Token {
+        t.Fatal("Expired lock shall be granted with higher token", first.Token, next.Token)
+    }
+
+    if granted, _ := a.serve(LOCK_OP_RENEW, jack, now.Add(2 * time.Second)); granted {
+        t.Fatal("Previous holder shall not renew")
+    }
+
+    jill.Token = next.Token
+    a.serve(LOCK_OP_RELEASE, jill, now.Add(2 * time.Second))
+    if granted, _ := a.serve(LOCK_OP_ACQUIRE, jack, now.Add(2 * time.Second)); !granted {
+        t.Fatal("Released lock shall be granted")
+    }
+}
+
+// Owners with counters at 1000, 5000 and 2000, each holder granted by a different majority
+func TestLock_SkewedOwners(t *testing.T) {
+    owners := []*LockActivity{ NewLockActivity(nil), NewLockActivity(nil), NewLockActivity(nil) }
+    for i, last := range []uint64{ 1000, 5000, 2000 } {
+        owners[i].lastToken = last
+    }
+    now := time.Now()
+
+    // as the holder does in Lock
+    take := func(holder string, majority ...int) uint64 {
+        dto := LockDTO{ Name: "lock", Holder: holder, TTL: time.Second }
+        for _, i := range majority {
+            if granted, g := owners[i].serve(LOCK_OP_ACQUIRE, dto, now); !granted {
+                t.Fatal("Lock shall be granted", holder, i)
+            } else if g.Token > dto.Token {
+                dto.Token = g.Token
+            }
+        }
+        for _, i := range majority {
+            if granted, _ := owners[i].serve(LOCK_OP_RENEW, dto, now); !granted {
+                t.Fatal("Token shall be confirmed", holder, i)
+            }
+        }
+        return dto.Token
+    }
+
+    first := take("Jack", 0, 1)
+    now = now.Add(2 * time.Second)
+    if next := take("Jill", 0, 2); next <= first {
+        t.Error("Token shall grow whichever majority grants it", first, next)
+    }
+
+    // owners of a lock in the cluster learn its token
+    name := "skewed-lock"
+    clients := map[string]*Client{}
+    for _, c := range []*Client{ client1, client2, client3, client4, client5 } {
+        clients[c.GetName()] = c
+    }
+    for i, p := range client1.Cluster.locks.owners(name) {
+        a := clients[*p.Name].Cluster.locks
+        a.mu.Lock()
+        a.lastToken += uint64(i) * 1000000
+        a.mu.Unlock()
+    }
+
+    token, err := client1.Lock(name, 5 * time.Second)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client1.Unlock(name)
+
+    for _, p := range client1.Cluster.locks.owners(name) {
+        a := clients[*p.Name].Cluster.locks
+        a.mu.Lock()
+        last := a.lastToken
+        a.mu.Unlock()
+        if last < token {
+            t.Error("Owner shall not give out tokens lower than taken one", *p.Name, last, token)
+        }
+    }
+}
+
+func TestLock_Exclusive(t *testing.T) {
+    token, err := client1.Lock("test-lock", 5 * time.Second)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if _, err := client2.Lock("test-lock", 5 * time.Second); err != ErrLocked {
+        t.Fatal("Lock shall be exclusive", err)
+    }
+
+    if locks := client1.Locks(); len(locks) != 1 || locks[0].Token != token {
+        t.Fatal("Unexpected locks held", locks)
+    }
+
+    if err := client1.Unlock("test-lock"); err != nil {
+        t.Fatal(err)
+    }
+
+    next, err := client2.Lock("test-lock", 5 * time.Second)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if next <= token {
+        t.Error("Token shall grow", token, next)
+    }
+
+    if err := client2.Renew("test-lock", 5 * time.Second); err != nil {
+        t.Error(err)
+    }
+
+    if err := client2.Unlock("test-lock"); err != nil {
+        t.Error(err)
+    }
+
+    if err := client2.Renew("test-lock", time.Second); err != ErrNotLocked {
+        t.Error("Released lock shall not renew", err)
+    }
+}
@@ -0,0 +1,92 @@
+// Snapshots of group membership as seen by discovery and gossip
+package cluster
+
+import (
+    "time"
+)
+
+/*
+Discovery never modifies published snapshot, it builds a new one and swaps it
+in, so readers get a consistent view without locking for as long as they hold
+on to it. Version grows every time the set of peers changes, which lets
+readers cache whatever they derive from membership, like the ring
+
+Members are everything the node knows about its group, including members that
+are suspected, dead or left. Only alive and suspected members are peers
+ */
+
+type MemberStatus byte
+
+const (
+    MemberAlive MemberStatus = iota
+    MemberSuspect
+    MemberDead
+    MemberLeft
+)
+
+type Member struct {
+    Peer Peer
+    Status MemberStatus
+    Incarnation uint64          // grows when member refutes suspicion about itself
+    Since time.Time             // when status was changed locally
+}
+
+type Membership struct {
+    Version uint64
+    Peers map[string]Peer
+    Groups map[string]Data
+    Members map[string]Member
+}
+
+// Member takes part in the ring
+func (m Member) IsPeer() bool {
+    return m.Status == MemberAlive || m.Status == MemberSuspect
+}
+
+// Check if news about the member override what is known, following SWIM rules:
+// alive needs greater incarnation, suspect overrides alive of the same incarnation,
+// dead and left override both of the same incarnation
+func (m Member) supersedes(known Member) bool {
+    switch m.Status {
+    case MemberAlive:
+        return m.Incarnation > known.Incarnation
+    case MemberSuspect:
+        if known.Status == MemberAlive {
+            return m.Incarnation >= known.Incarnation
+        }
+        return m.Incarnation > known.Incarnation
+    default:
+        if known.IsPeer() {
+            return m.Incarnation >= known.Incarnation
+        }
+        return m.Incarnation > known.Incarnation
+    }
+}
+
+// Peers out of members
+func memberPeers(members map[string]Member) map[string]Peer {
+    peers := make(map[string]Peer, len(members))
+    for name, m := range members {
+        if m.IsPeer() {
+            peers[name] = m.Peer
+        }
+    }
+
+    return peers
+}
+
+// Same peers with same addresses and partitions
+func samePeers(a, b map[string]Peer) bool {
+    if len(a) != len(b) {
+        return false
+    }
+
+    for name, p := range a {
+        o, ok := b[name]
+        if !ok || o.Port != p.Port || o.Partitions != p.Partitions || !o.AddrIPv4.Equal(p.AddrIPv4) {
+            return false
+        }
+    }
+
+    return true
+}
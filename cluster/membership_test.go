@@ -0,0 +1,94 @@
+package cluster
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestMembership_Version(t *testing.T) {
+    node := NewNode("local.", "member")
+    name := "peer"
+    peer := Member{
+        Peer: Peer{ Name: &name, Port: 1, AddrIPv4: net.IPv4(127, 0, 0, 1) },
+        Status: MemberAlive,
+    }
+
+    node.publish(map[string]Member{ "peer": peer }, map[string]Data{})
+    v := node.Membership()
+    if v.Version != 1 {
+        t.Fatal("Version shall grow when peers change", v.Version)
+    }
+
+    peer.Status = MemberSuspect
+    node.publish(map[string]Member{ "peer": peer }, map[string]Data{})
+    if node.Membership().Version != 1 {
+        t.Fatal("Version shall stay when peers are the same")
+    }
+
+    peer.Status = MemberDead
+    node.publish(map[string]Member{ "peer": peer }, map[string]Data{})
+    if node.Membership().Version != 2 || len(v.Peers) != 1 {
+        t.Fatal("Published snapshot shall not be modified")
+    }
+}
+
+type refusingRouter struct{}
+
+func (r refusingRouter) Route(*Request) (Handler, error) {
+    return nil, errors.New("Cannot handle this")
+}
+
+// Meant for go test -race
+func TestMembership_ConcurrentDiscoveryAndTraffic(t *testing.T) {
+    c := client1.Cluster
+    stop := make(chan bool)
+    var wg sync.WaitGroup
+
+    wg.Add(2)
+    go func() {
+        defer wg.Done()
+        for {
+            select {
+            case <- stop:
+                return
+            default:
+                client1.Node.DiscoverPeers()
+            }
+        }
+    }()
+
+    go func() {
+        defer wg.Done()
+        for {
+            select {
+            case <- stop:
+                return
+            default:
+                e := c.handlers.Add(refusingRouter{})
+                c.handlers.Remove(e)
+            }
+        }
+    }()
+
+    deadline := time.Now().Add(3 * time.Second)
+    for i := 0; time.Now().Before(deadline); i++ {
+        key := []byte(fmt.Sprintf("member%d", i))
+        if client1.Store(key, []byte("value"), ConsistencyLevelTwo) != STORE_SUCCESS {
+            t.Error("Cannot store during discovery", string(key))
+        }
+
+        if data, result := client2.Load(key, ConsistencyLevelTwo); result != LOAD_SUCCESS || string(data) != "value" {
+            t.Error("Cannot load during discovery", string(key))
+        }
+
+        client1.Partitions()
+        client1.DiscoverPeers()
+    }
+
+    close(stop)
+    wg.Wait()
+}
@@ -0,0 +1,87 @@
+// Merkle tree over the keys of one hash ring range
+package cluster
+
+import (
+    "bytes"
+    "github.com/reusee/mmh3"
+)
+
+/*
+The tree has fixed shape: merkleLeaves leaves, key goes to the leaf selected
+by the least significant bits of its hash. Leaf hash is XOR of digests of all
+keys in it, so the order keys are added in does not matter. Inner nodes are
+hashes of concatenated children.
+
+Two replicas of the same range compare roots first, and only if they differ
+compare leaves to narrow down the set of keys to exchange
+ */
+
+const merkleDepth = 6
+const merkleLeaves = 1 << merkleDepth
+
+type MerkleTree struct {
+    nodes [][]byte      // nodes[1] is the root, children of i are 2i and 2i+1
+    built bool
+}
+
+func NewMerkleTree() *MerkleTree {
+    nodes := make([][]byte, 2 * merkleLeaves)
+    for i := range nodes {
+        nodes[i] = make([]byte, hash_byte_len)
+    }
+
+    return &MerkleTree{
+        nodes: nodes,
+        built: false,
+    }
+}
+
+// Leaf of the tree the key with given hash belongs to
+func MerkleLeaf(keyHash []byte) int {
+    return int(keyHash[0]) & (merkleLeaves - 1)
+}
+
+// Digest of key and value pair as it is accounted in the tree
+func MerkleDigest(key, valueDigest []byte) []byte {
+    return mmh3.Sum128(append(append([]byte{}, key...), valueDigest...))
+}
+
+func (t *MerkleTree) Add(keyHash, key, valueDigest []byte) {
+    leaf := t.nodes[merkleLeaves + MerkleLeaf(keyHash)]
+    for i, b := range MerkleDigest(key, valueDigest) {
+        leaf[i] ^= b
+    }
+    t.built = false
+}
+
+func (t *MerkleTree) build() {
+    if t.built {
+        return
+    }
+
+    for i := merkleLeaves - 1; i > 0; i-- {
+        t.nodes[i] = mmh3.Sum128(append(append([]byte{}, t.nodes[2 * i]...), t.nodes[2 * i + 1]...))
+    }
+    t.built = true
+}
+
+func (t *MerkleTree) Root() []byte {
+    t.build()
+    return t.nodes[1]
+}
+
+func (t *MerkleTree) Leaves() [][]byte {
+    return t.nodes[merkleLeaves:]
+}
+
+// Indexes of leaves that differ between two sets of leaf hashes
+func DiffLeaves(a, b [][]byte) []int {
+    diff := make([]int, 0)
+    for i := 0; i < merkleLeaves; i++ {
+        if i >= len(a) || i >= len(b) || !bytes.Equal(a[i], b[i]) {
+            diff = append(diff, i)
+        }
+    }
+
+    return diff
+}
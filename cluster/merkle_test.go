@@ -0,0 +1,49 @@
+package cluster
+
+import (
+    "bytes"
+    "fmt"
+    "testing"
+    "github.com/reusee/mmh3"
+)
+
+func TestMerkleTree_OrderIndependent(t *testing.T) {
+    t1, t2 := NewMerkleTree(), NewMerkleTree()
+
+    keys := make([][]byte, 100)
+    for i := range keys {
+        keys[i] = []byte(fmt.Sprintf("key%d", i))
+    }
+
+    for i := range keys {
+        k := keys[i]
+        t1.Add(mmh3.Sum128(k), k, mmh3.Sum128(k))
+        k = keys[len(keys) - 1 - i]
+        t2.Add(mmh3.Sum128(k), k, mmh3.Sum128(k))
+    }
+
+    if !bytes.Equal(t1.Root(), t2.Root()) {
+        t.Fatal("Trees with same content shall have same root")
+    }
+
+    if len(DiffLeaves(t1.Leaves(), t2.Leaves())) != 0 {
+        t.Fatal("Trees with same content shall have same leaves")
+    }
+}
+
+func TestMerkleTree_Diff(t *testing.T) {
+    t1, t2 := NewMerkleTree(), NewMerkleTree()
+
+    key := []byte("key")
+    t1.Add(mmh3.Sum128(key), key, []byte("value1"))
+    t2.Add(mmh3.Sum128(key), key, []byte("value2"))
+
+    if bytes.Equal(t1.Root(), t2.Root()) {
+        t.Fatal("Trees with different values shall have different roots")
+    }
+
+    diff := DiffLeaves(t1.Leaves(), t2.Leaves())
+    if len(diff) != 1 || diff[0] != MerkleLeaf(mmh3.Sum128(key)) {
+        t.Fatal("Only leaf of the key shall differ", diff)
+    }
+}
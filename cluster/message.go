@@ -2,7 +2,11 @@
 package cluster
 
 import (
+    "bytes"
+    "encoding/binary"
+    "encoding/gob"
     "errors"
+    "fmt"
 )
 
 type OperationType byte
@@ -13,22 +17,45 @@ const (
     JOIN                          // join operations
     STORE                         // store operations
     LOAD                          // load operations
+    SYNC                          // anti-entropy operations
+    HANDOFF                       // data transfer between peers
+    DELETE                        // delete operations
+    LEASE                         // primary site arbitration
+    LEADER                        // leader election
+    LOCK                          // distributed locks
+    WATCH                         // change notifications
+    SCAN                          // listing keys
+    BATCH                         // loads and stores of many keys
+    TXN                           // transactions
 )
 
 type Message struct {
     Version     byte               //   1 byte
     Type        OperationType      // + 1 bytes    = 2
     Operation   byte               // + 1 bytes    = 3
-//  reserved1   byte               // + 1 byte     = 4
+    Flags       byte               // + 1 byte     = 4, since version 2
     Args        []byte             // + 16 bytes   = 20
-//  reserved2   []byte             // + 16 bytes   = 36
+    RequestId   uint64             // + 8 bytes    = 28, since version 2
+    ActivityId  uint64             // + 8 bytes    = 36, since version 2
     ReplyTo     string             // + 256 bytes  = 292
-    Length      uint16             // + 2 bytes    = 294
+    Length      uint16             // + 2 bytes    = 294, only meaningful in datagrams
     Load        []byte
 }
 
 const HeaderSize = 294
-const MaxLoadLength = 0xFFFF - HeaderSize
+const MaxLoadLength = 0xFFFF - HeaderSize           // in datagram
+const MaxStreamLoadLength = 64 * 1024 * 1024        // in stream frame
+
+/*
+Bigger datagrams get fragmented and are lost as a whole when any fragment is,
+so messages that do not fit into single Ethernet frame go over stream transport
+ */
+const MaxDatagramSize = 1472
+
+// Message is small enough to be sent as datagram
+func FitsDatagram(m *Message) bool {
+    return HeaderSize + len(m.Load) <= MaxDatagramSize
+}
 
 func Unmarshall(packet []byte) (m *Message, err error) {
     if len(packet) < HeaderSize {
@@ -36,6 +63,12 @@ func Unmarshall(packet []byte) (m *Message, err error) {
         return
     }
 
+    // layout of other versions is unknown, see protocol.go
+    if packet[0] < MinProtocolVersion || packet[0] > ProtocolVersion {
+        err = ErrUnsupportedVersion
+        return
+    }
+
     replyTo := make([]byte, 0, 255)
     // last byte shall be only \0 always, so we ignore it
     for _, b := range packet[36:291] {
@@ -46,7 +79,7 @@ func Unmarshall(packet []byte) (m *Message, err error) {
         replyTo = append(replyTo, b)
     }
 
-    return &Message{
+    m = &Message{
         Version:    packet[0],
         Type:       OperationType(packet[1]),
         Operation:  packet[2],
@@ -54,17 +87,37 @@ func Unmarshall(packet []byte) (m *Message, err error) {
         ReplyTo:    string(replyTo),
         Length:     uint16(packet[292]) << 8 | uint16(packet[293]),
         Load:       packet[294:],
-    }, nil
+    }
+
+    // reserved in version 1
+    if m.Version >= idVersion {
+        m.Flags = packet[3]
+        m.RequestId = binary.BigEndian.Uint64(packet[20:28])
+        m.ActivityId = binary.BigEndian.Uint64(packet[28:36])
+    }
+
+    return m, nil
 }
 
 func Marshall(m *Message) []byte {
+    return marshall(m, MaxLoadLength)
+}
+
+// Marshall message for stream transport, load is not limited by datagram size
+func MarshallStream(m *Message) []byte {
+    return marshall(m, MaxStreamLoadLength)
+}
+
+func marshall(m *Message, maxLoadLength int) []byte {
     l := HeaderSize + len(m.Load)
     buf := make([]byte, l, l)
     buf[0] = m.Version
     buf[1] = byte(m.Type)
 
     buf[2] = byte(m.Operation)
-    // byte 3 is reserved
+    if m.Version >= idVersion {
+        buf[3] = m.Flags
+    }
 
     if len(m.Args) > 16 {
         panic("Too many message arguments, max 16 allowed")
@@ -77,7 +130,10 @@ func Marshall(m *Message) []byte {
         buf[4 + i] = 0
     }
 
-    // bytes 20 to 35 are reserved
+    if m.Version >= idVersion {
+        binary.BigEndian.PutUint64(buf[20:28], m.RequestId)
+        binary.BigEndian.PutUint64(buf[28:36], m.ActivityId)
+    }
 
     if len(m.ReplyTo) > 255 {
         panic("ReplyTo shall be max 255 bytes")
@@ -94,13 +150,54 @@ func Marshall(m *Message) []byte {
     buf[292] = byte(m.Length >> 8)
     buf[293] = byte(m.Length)
 
-    if len(m.Load) > MaxLoadLength {
+    if len(m.Load) > maxLoadLength {
         panic("Message data is too big")
     }
 
-    for i, p := range m.Load {
-        buf[294 + i] = p
-    }
+    copy(buf[294:], m.Load)
 
     return buf
-}
\ No newline at end of file
+}
+
+// Encode message load, panics if it does not fit into message
+func EncodeLoad(v interface{}) []byte {
+    return encodeLoad(v, ProtocolVersion)
+}
+
+// Encode message load for peers speaking given protocol version, see codec.go
+func encodeLoad(v interface{}, version byte) []byte {
+    if version >= compactVersion {
+        load := encodeCompact(v)
+        if len(load) > MaxStreamLoadLength {
+            panic("Load is too big")
+        }
+        return load
+    }
+
+    load, err := encodeGob(v)
+    if err != nil {
+        panic(fmt.Sprintf("Can't encode data for transfer: %v", err))
+    }
+    return load
+}
+
+func encodeGob(v interface{}) ([]byte, error) {
+    raw := new(bytes.Buffer)
+    if err := gob.NewEncoder(raw).Encode(v); err != nil {
+        return nil, err
+    }
+
+    if raw.Len() > MaxStreamLoadLength {
+        return nil, errors.New("Load is too big")
+    }
+
+    return raw.Bytes(), nil
+}
+
+// Decode message load of any protocol version into v
+func DecodeLoad(load []byte, v interface{}) error {
+    if len(load) > 0 && load[0] == loadMarker {
+        return decodeCompact(load, v)
+    }
+    return gob.NewDecoder(bytes.NewBuffer(load)).Decode(v)
+}
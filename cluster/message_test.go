@@ -1,15 +1,19 @@
 package cluster
 
 import (
+    "bytes"
     "testing"
 )
 
 func TestMarshalling(t *testing.T) {
     m := Message{
-        Version:    1,
+        Version:    ProtocolVersion,
         Type:       PING,
         Operation:  0,
+        Flags:      FlagReply,
         Args:       make([]byte, 8, 8),
+        RequestId:  0x0102030405060708,
+        ActivityId: 0x1112131415161718,
         Length:     1,
         Load:       []byte { 1 },
     }
@@ -36,6 +40,17 @@ func TestMarshalling(t *testing.T) {
         t.Fail()
     }
 
+    if m1.Flags != m.Flags || m1.RequestId != m.RequestId || m1.ActivityId != m.ActivityId {
+        t.Error("Flags, request or activity id were not marshalled")
+    }
+
+    // reserved in version 1
+    v1 := m
+    v1.Version = 1
+    if raw := Marshall(&v1); raw[3] != 0 || !bytes.Equal(raw[20:36], make([]byte, 16)) {
+        t.Error("Flags and ids shall not be marshalled in version 1")
+    }
+
     if m1.Length != m.Length {
         t.Fail()
     }
@@ -85,3 +100,28 @@ func TestReplyTo(t *testing.T) {
     }
 
 }
+
+func FuzzUnmarshall(f *testing.F) {
+    for _, name := range []string{ "v1-ping", "v1-store-put", "v1-store-ack" } {
+        f.Add(recordedPacket(f, name))
+    }
+    f.Add(Marshall(&Message{ Version: ProtocolVersion, Type: STORE, Flags: FlagReply, RequestId: 42, ActivityId: 7, ReplyTo: "me", Load: EncodeLoad(StoreDTO{ Key: []byte("k") }) }))
+    f.Add([]byte{ ProtocolVersion })
+
+    f.Fuzz(func(t *testing.T, packet []byte) {
+        m, err := Unmarshall(packet)
+        if err != nil || len(m.Load) > MaxLoadLength {
+            return
+        }
+
+        m1, err := Unmarshall(Marshall(m))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if m1.Version != m.Version || m1.Type != m.Type || m1.Operation != m.Operation || m1.Flags != m.Flags ||
+            m1.RequestId != m.RequestId || m1.ActivityId != m.ActivityId || m1.ReplyTo != m.ReplyTo ||
+            m1.Length != m.Length || !bytes.Equal(m1.Args, m.Args) || !bytes.Equal(m1.Load, m.Load) {
+            t.Error("Message changed after marshalling", m, m1)
+        }
+    })
+}
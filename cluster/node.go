@@ -1,14 +1,14 @@
-// Lower level cluster node discovery through Bonjour
+// Lower level cluster node: announcement and discovery of peers
 package cluster;
 
 import (
     "log"
+    "net"
     "time"
     "strings"
-    "github.com/noroutine/bonjour"
     "github.com/reusee/mmh3"
     "strconv"
-    "os"
+    "sync"
 )
 
 type Node struct {
@@ -17,13 +17,21 @@ type Node struct {
     Bind string
     Port int
     Group *string
-    server *bonjour.Server
+    Discovery Discovery
+    announced bool
     text map[string]string
     discoverLoopCh chan int
     Left chan Peer
     Joined chan Peer
-    Peers map[string]Peer
-    Groups map[string]Data
+    mu sync.RWMutex
+    view *Membership
+    incarnation uint64
+    introduced map[string]introduction      // peers that probed this node recently
+}
+
+type introduction struct {
+    peer Peer
+    at time.Time
 }
 
 type Data struct {
@@ -34,6 +42,7 @@ const ServiceType = "_dominion._tcp"
 const DefaultPort = 9999
 const browseWindow = 1000 * time.Millisecond
 const discoveryInterval = 5 * time.Second
+const introductionTTL = 3 * discoveryInterval
 const groupKey = "group"
 
 func NewNode(domain string, name string) *Node {
@@ -43,27 +52,28 @@ func NewNode(domain string, name string) *Node {
         Bind:           "127.0.0.1",
         Port:           DefaultPort,
         Group:          nil,
-        server:         nil,
+        Discovery:      NewBonjourDiscovery(),
+        announced:      false,
         discoverLoopCh: nil,
         text:           make(map[string]string),
-        Peers:          map[string]Peer{},
         Left:           make(chan Peer, 10),
         Joined:         make(chan Peer, 10),
-        Groups:         map[string]Data{},
+        view:           &Membership{
+            Version: 0,
+            Peers:   map[string]Peer{},
+            Groups:  map[string]Data{},
+            Members: map[string]Member{},
+        },
+        // restarted node shall not be taken for dead one it was before
+        incarnation:    uint64(time.Now().UnixNano()),
+        introduced:     make(map[string]introduction),
     }
 }
 
-// One-time peers discovery over the network
+// One-time peers discovery over the network, new peers become members,
+// but members are only removed by gossip
 func (node *Node) DiscoverPeers() {
-
-    resolver, err := bonjour.NewResolver(nil)
-    if err != nil {
-        log.Fatal("Failed to initialize resolver:", err.Error())
-    }
-
-    results := make(chan *bonjour.ServiceEntry)
-
-    err = resolver.Browse(ServiceType, *node.Domain, results)
+    found, err := node.Discovery.Browse(node)
     if err != nil {
         log.Println("Failed to browse:", err.Error())
         return
@@ -71,55 +81,182 @@ func (node *Node) DiscoverPeers() {
 
     ps := make(map[string]Peer)
     gs := make(map[string]Data)
-L:
-    for {
-        select {
-        case e := <- results:
-            g := getPeerGroup(e)
-            if g != nil {
-                gData, ok := gs[*g]
-                if ! ok {
-                    gs[*g] = Data{
-                        SeenMembers: 1,
-                    }
-                } else {
-                    gData.SeenMembers = gData.SeenMembers + 1
-                    gs[*g] = gData
-                }
+    seen := make(map[string]bool)
+    group := node.group()
+    for _, p := range found {
+        if p.Group == nil || seen[*p.Name] {
+            // not clustered or already seen from another source
+            continue
+        }
+        seen[*p.Name] = true
+
+        gData := gs[*p.Group]
+        gData.SeenMembers = gData.SeenMembers + 1
+        gs[*p.Group] = gData
 
-                if node.Group != nil && *node.Group == *g {
-                    ps[e.Instance] = Peer{
-                        Domain:       node.Domain,
-                        Name:         &e.Instance,
-                        Group:        g,
-                        HostName:     &e.HostName,
-                        Partitions:   getPeerPartitions(e),
-                        Port:         e.Port,
-                        AddrIPv4:     e.AddrIPv4,
-                        AddrIPv6:     e.AddrIPv6,
-                        Text:         e.Text,
-                    }
+        if group != nil && *group == *p.Group {
+            ps[*p.Name] = p
+        }
+    }
+
+    self := node.selfMember()
+
+    node.mu.Lock()
+    members := make(map[string]Member)
+    if node.Group != nil {
+        for name, m := range node.view.Members {
+            members[name] = m
+        }
+
+        for name, p := range ps {
+            m, ok := members[name]
+            switch {
+            case !ok:
+                members[name] = Member{
+                    Peer: p,
+                    Status: MemberAlive,
+                    Incarnation: 0,
+                    Since: time.Now(),
                 }
+            case m.IsPeer():
+                // addresses or partitions may change
+                m.Peer = p
+                members[name] = m
             }
-        case <- time.After(browseWindow):
-            resolver.Exit <- true
-            break L
+        }
+
+        members[*node.Name] = self
+    }
+    old := node.publish(members, gs)
+    view := node.view
+    node.mu.Unlock()
+
+    node.notify(old, view)
+}
+
+// Apply news about another member, returns false if they are not news
+func (node *Node) merge(m Member) bool {
+    node.mu.Lock()
+    if *m.Peer.Name == *node.Name || node.Group == nil {
+        node.mu.Unlock()
+        return false
+    }
+
+    known, ok := node.view.Members[*m.Peer.Name]
+    if ok && !m.supersedes(known) {
+        node.mu.Unlock()
+        return false
+    }
+
+    if !ok && (m.Peer.Group == nil || *m.Peer.Group != *node.Group) {
+        // member of another group
+        node.mu.Unlock()
+        return false
+    }
+
+    m.Since = time.Now()
+    if ok {
+        if known.Status == m.Status {
+            m.Since = known.Since
+        }
+        if m.Status != MemberAlive {
+            // only alive member tells its current details
+            m.Peer = known.Peer
+        }
+    }
+
+    members := make(map[string]Member, len(node.view.Members) + 1)
+    for name, o := range node.view.Members {
+        members[name] = o
+    }
+    members[*m.Peer.Name] = m
+
+    old := node.publish(members, node.view.Groups)
+    view := node.view
+    node.mu.Unlock()
+
+    node.notify(old, view)
+    return true
+}
+
+// Refute suspicion about the node of given incarnation, returns the node alive in new incarnation
+func (node *Node) refute(incarnation uint64) Member {
+    self := node.selfMember()
+
+    node.mu.Lock()
+    defer node.mu.Unlock()
+
+    if incarnation >= node.incarnation {
+        node.incarnation = incarnation + 1
+    }
+    self.Incarnation = node.incarnation
+
+    if node.Group != nil {
+        members := make(map[string]Member, len(node.view.Members))
+        for name, o := range node.view.Members {
+            members[name] = o
+        }
+        members[*node.Name] = self
+        node.publish(members, node.view.Groups)
+    }
+
+    return self
+}
+
+// Drop dead and left members after a while, so they can join again as new ones
+func (node *Node) forget(ttl time.Duration) {
+    node.mu.Lock()
+    defer node.mu.Unlock()
+
+    members := make(map[string]Member, len(node.view.Members))
+    for name, m := range node.view.Members {
+        if m.IsPeer() || time.Since(m.Since) < ttl {
+            members[name] = m
         }
     }
 
-    oldPeers := node.Peers
-    node.Peers = ps
-    node.Groups = gs
+    if len(members) != len(node.view.Members) {
+        node.publish(members, node.view.Groups)
+    }
+}
+
+// Current membership snapshot, shall not be modified
+func (node *Node) Membership() *Membership {
+    node.mu.RLock()
+    defer node.mu.RUnlock()
+    return node.view
+}
+
+// Replace membership with new snapshot, version changes only if peers did, returns previous snapshot.
+// Shall be called with the lock held
+func (node *Node) publish(members map[string]Member, groups map[string]Data) *Membership {
+    old := node.view
+    peers := memberPeers(members)
+    version := old.Version
+    if !samePeers(old.Peers, peers) {
+        version++
+    }
+
+    node.view = &Membership{
+        Version: version,
+        Peers: peers,
+        Groups: groups,
+        Members: members,
+    }
+
+    return old
+}
 
-    // find who left
-    for name, peer := range oldPeers {
-        if _, ok := ps[name]; !ok {
+// Tell who joined and who left between snapshots
+func (node *Node) notify(old, view *Membership) {
+    for name, peer := range old.Peers {
+        if _, ok := view.Peers[name]; !ok {
             node.Left <- peer
         }
     }
-    // find who joined
-    for name, peer := range ps {
-        if _, ok := oldPeers[name]; !ok {
+
+    for name, peer := range view.Peers {
+        if _, ok := old.Peers[name]; !ok {
             node.Joined <- peer
         }
     }
@@ -158,14 +295,13 @@ func (node *Node) IsDiscoveryActive() bool {
 // Announce the node on the network
 func (node *Node) AnnouncePresence() {
     // Run registration (blocking call)
-    if node.server == nil {
-        hostname, _ := os.Hostname()
-        s, err := bonjour.RegisterProxy(*node.Name, ServiceType, *node.Domain, node.Port, hostname, node.Bind, node.getNodeText(), nil)
+    if !node.announced {
+        err := node.Discovery.Announce(node)
         if err != nil {
             log.Fatalln(err.Error())
         } else {
             log.Printf("Registered")
-            node.server = s
+            node.announced = true
         }
     } else {
         log.Printf("Already registered")
@@ -174,12 +310,12 @@ func (node *Node) AnnouncePresence() {
 
 // Check if the node is announced
 func (node *Node) IsAnnounced() bool {
-    return node.server != nil
+    return node.announced
 }
 
 // Check if the node is part of the group
 func (node *Node) IsClustered() bool {
-    return node.Group != nil
+    return node.group() != nil
 }
 
 // Check if the node is operational - that is it is announced and joined some group
@@ -189,7 +325,7 @@ func (node *Node) IsOperational() bool {
 
 // Announce new node name
 func (node *Node) AnnounceName(newName string) {
-    if node.server != nil {
+    if node.announced {
         node.Shutdown()
         node.Name = &newName
         node.AnnouncePresence()
@@ -200,17 +336,21 @@ func (node *Node) AnnounceName(newName string) {
 
 // Announce new node group
 func (node *Node) AnnounceGroup(newGroup *string) {
+    node.mu.Lock()
     node.Group = newGroup
-    if (node.server != nil) {
-        node.server.SetText(node.getNodeText())
+    // members that knew the node in another group shall learn about it again
+    node.incarnation++
+    node.mu.Unlock()
+    if (node.announced) {
+        node.Discovery.SetText(node.getNodeText())
     }
 }
 
 // Shutdown the node, opposite of announcing
 func (node *Node) Shutdown() {
-    if node.server != nil {
-        node.server.Shutdown()
-        node.server = nil
+    if node.announced {
+        node.Discovery.Shutdown()
+        node.announced = false
         log.Printf("Shutdown")
     }
 }
@@ -219,8 +359,70 @@ func (n *Node) Hash() []byte {
     return mmh3.Sum128([]byte(*n.Name))
 }
 
-func getPeerGroup(e *bonjour.ServiceEntry) *string {
-    for _, s := range e.Text {
+// Group of the node, may change while discovery runs
+func (node *Node) group() *string {
+    node.mu.RLock()
+    defer node.mu.RUnlock()
+    return node.Group
+}
+
+// The node as a peer of itself
+func (node *Node) self() Peer {
+    text := node.getNodeText()
+    return Peer{
+        Domain:       node.Domain,
+        Name:         node.Name,
+        Group:        getPeerGroup(text),
+        Partitions:   getPeerPartitions(text),
+        Port:         node.Port,
+        AddrIPv4:     net.ParseIP(node.Bind),
+        Text:         text,
+    }
+}
+
+// The node as a member of its group
+func (node *Node) selfMember() Member {
+    peer := node.self()
+
+    node.mu.RLock()
+    defer node.mu.RUnlock()
+    return Member{
+        Peer: peer,
+        Status: MemberAlive,
+        Incarnation: node.incarnation,
+        Since: time.Now(),
+    }
+}
+
+// Remember the peer that made itself known by probing this node
+func (node *Node) introduce(p Peer) {
+    node.mu.Lock()
+    defer node.mu.Unlock()
+    node.introduced[*p.Name] = introduction{
+        peer: p,
+        at: time.Now(),
+    }
+}
+
+// Peers that probed this node recently
+func (node *Node) introductions() []Peer {
+    node.mu.Lock()
+    defer node.mu.Unlock()
+
+    peers := make([]Peer, 0, len(node.introduced))
+    for name, i := range node.introduced {
+        if time.Since(i.at) > introductionTTL {
+            delete(node.introduced, name)
+            continue
+        }
+        peers = append(peers, i.peer)
+    }
+
+    return peers
+}
+
+func getPeerGroup(text []string) *string {
+    for _, s := range text {
         if strings.HasPrefix(s, groupKey + "=") {
             group := strings.TrimPrefix(s, groupKey + "=")
             return &group
@@ -230,9 +432,9 @@ func getPeerGroup(e *bonjour.ServiceEntry) *string {
     return nil
 }
 
-func getPeerPartitions(e *bonjour.ServiceEntry) uint32 {
+func getPeerPartitions(text []string) uint32 {
     var partitionsValue *string
-    for _, s := range e.Text {
+    for _, s := range text {
         if strings.HasPrefix(s, partitionsKey + "=") {
             partitionTextValue := strings.TrimPrefix(s, partitionsKey + "=")
             partitionsValue = &partitionTextValue
@@ -257,8 +459,8 @@ func (node *Node) getNodeText() []string {
         text = append(text, k + "=" + v)
     }
 
-    if node.Group != nil {
-        text = append(text, groupKey + "=" + *node.Group)
+    if group := node.group(); group != nil {
+        text = append(text, groupKey + "=" + *group)
     }
 
     return text
@@ -266,8 +468,8 @@ func (node *Node) getNodeText() []string {
 
 func (node *Node) SetText(text map[string]string) {
     node.text = text
-    if (node.server != nil) {
-        node.server.SetText(node.getNodeText())
+    if (node.announced) {
+        node.Discovery.SetText(node.getNodeText())
     }
 }
 
@@ -4,7 +4,6 @@ package cluster
 import (
     "net"
     "github.com/reusee/mmh3"
-    "math/big"
     "sort"
     "strings"
 )
@@ -76,10 +75,9 @@ func PeerPartitionSorterSorter(ps []*PeerPartition) *peerPartitionSorter {
 }
 
 func (sorter *peerPartitionSorter) ByHash() *peerPartitionSorter {
+    // order shall match the one Clockwise uses to walk the ring
     sorter.less = func (p1, p2 *PeerPartition) bool {
-        iHash := new(big.Int).SetBytes(p1.Hash())
-        jHash := new(big.Int).SetBytes(p2.Hash())
-        return iHash.Cmp(jHash) < 0
+        return CompareHashes(p1.Hash(), p2.Hash()) < 0
     }
 
     return sorter
@@ -0,0 +1,123 @@
+// Phi accrual failure detection
+package cluster
+
+import (
+    "math"
+    "sync"
+    "time"
+)
+
+/*
+See Hayashibara et al., The Phi Accrual Failure Detector
+
+Instead of telling whether peer is up or down the detector tells how much it
+is suspected. Intervals between recent heartbeats from the peer are taken for
+normal distribution, and phi is -log10 of probability that heartbeat comes
+even later than now. Phi of 1 means 10% chance to be mistaken when taking the
+peer for failed, phi of 3 means 0.1% and so on.
+
+Every gossip message from the peer counts as heartbeat, and gossip sends one
+to every peer each protocol period
+ */
+
+const DefaultPhiThreshold = 8.0
+const phiWindowSize = 100                       // recent intervals to estimate from
+const phiMinStdDeviation = 100 * time.Millisecond
+const phiAcceptablePause = 500 * time.Millisecond
+
+type arrivals struct {
+    last time.Time
+    intervals []float64         // milliseconds, oldest first
+    sum float64
+    squares float64
+}
+
+type PhiDetector struct {
+    mu sync.Mutex
+    peers map[string]*arrivals
+}
+
+func NewPhiDetector() *PhiDetector {
+    return &PhiDetector{
+        peers: make(map[string]*arrivals),
+    }
+}
+
+// Record heartbeat from the peer
+func (d *PhiDetector) Heartbeat(peer string) {
+    d.heartbeat(peer, time.Now())
+}
+
+func (d *PhiDetector) heartbeat(peer string, at time.Time) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    a, ok := d.peers[peer]
+    if !ok {
+        // nothing known yet, guess the intervals are about protocol period
+        a = &arrivals{}
+        estimate := float64(protocolPeriod / time.Millisecond)
+        a.add(estimate * 3 / 4)
+        a.add(estimate * 5 / 4)
+        a.last = at
+        d.peers[peer] = a
+        return
+    }
+
+    a.add(float64(at.Sub(a.last) / time.Millisecond))
+    a.last = at
+}
+
+func (a *arrivals) add(interval float64) {
+    if len(a.intervals) == phiWindowSize {
+        oldest := a.intervals[0]
+        a.intervals = a.intervals[1:]
+        a.sum -= oldest
+        a.squares -= oldest * oldest
+    }
+
+    a.intervals = append(a.intervals, interval)
+    a.sum += interval
+    a.squares += interval * interval
+}
+
+// Suspicion level of the peer, 0 for peers never heard from
+func (d *PhiDetector) Phi(peer string) float64 {
+    return d.phi(peer, time.Now())
+}
+
+func (d *PhiDetector) phi(peer string, now time.Time) float64 {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    a, ok := d.peers[peer]
+    if !ok {
+        return 0
+    }
+
+    n := float64(len(a.intervals))
+    mean := a.sum / n
+    stdDeviation := math.Sqrt(math.Max(a.squares / n - mean * mean, 0))
+    stdDeviation = math.Max(stdDeviation, float64(phiMinStdDeviation / time.Millisecond))
+
+    elapsed := float64(now.Sub(a.last) / time.Millisecond)
+    return phi(elapsed, mean + float64(phiAcceptablePause / time.Millisecond), stdDeviation)
+}
+
+// Forget heartbeats of the peer, it starts over if it comes back
+func (d *PhiDetector) Remove(peer string) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    delete(d.peers, peer)
+}
+
+// -log10 of normal distribution tail, with logistic approximation of its CDF
+func phi(elapsed, mean, stdDeviation float64) float64 {
+    y := (elapsed - mean) / stdDeviation
+    e := math.Exp(-y * (1.5976 + 0.070566 * y * y))
+    if elapsed > mean {
+        return -math.Log10(e / (1 + e))
+    }
+
+    return -math.Log10(1 - 1 / (1 + e))
+}
@@ -0,0 +1,56 @@
+package cluster
+
+import (
+    "testing"
+    "time"
+    "github.com/reusee/mmh3"
+)
+
+func TestPhiDetector_Phi(t *testing.T) {
+    d := NewPhiDetector()
+    if d.Phi("peer") != 0 {
+        t.Fatal("Unknown peer shall not be suspected")
+    }
+
+    start := time.Now()
+    for i := 0; i <= 20; i++ {
+        d.heartbeat("peer", start.Add(time.Duration(i) * time.Second))
+    }
+    last := start.Add(20 * time.Second)
+
+    if phi := d.phi("peer", last.Add(time.Second)); phi > 1 {
+        t.Error("Peer on time shall not be suspected", phi)
+    }
+
+    if phi := d.phi("peer", last.Add(5 * time.Second)); phi < DefaultPhiThreshold {
+        t.Error("Silent peer shall be suspected", phi)
+    }
+
+    if d.phi("peer", last.Add(3 * time.Second)) >= d.phi("peer", last.Add(4 * time.Second)) {
+        t.Error("Suspicion shall grow with silence")
+    }
+
+    d.Remove("peer")
+    if d.Phi("peer") != 0 {
+        t.Error("Removed peer shall start over")
+    }
+}
+
+func TestPhiDetector_SkipSuspected(t *testing.T) {
+    c := client1.Cluster
+    key := mmh3.Sum128([]byte("suspected"))
+    partitions := c.Partitions()
+    owners := c.hashNodes(partitions, key, 3)
+
+    nodes := walkRing(partitions, key, 3, func(p *Peer) bool {
+        return p != owners[0]
+    })
+
+    if len(nodes) != 3 || containsPeer(nodes, *owners[0].Name) {
+        t.Fatal("Suspected primary was not passed over")
+    }
+
+    if nodes[0] != owners[1] || nodes[1] != owners[2] {
+        t.Error("Other replicas shall stay in ring order")
+    }
+}
@@ -4,11 +4,19 @@ package cluster
 import (
     "log"
     "fmt"
+    "net"
     "time"
     "errors"
     "github.com/noroutine/witnessd/fsa"
 )
 
+const (
+    PING_OP_PING byte = iota
+    PING_OP_PONG
+    PING_OP_PING_REQ            // ask to ping another member on sender's behalf
+    PING_OP_GOSSIP              // news only, not replied
+)
+
 const (
     PING_START = iota
     PING_SENT
@@ -31,7 +39,7 @@ func NewPongActivity(c *Cluster) *PongActivity {
 
 func (a *PongActivity) Route(r *Request) (h Handler, err error) {
     // reply to ping with pong
-    if r.Message.Type == PING && r.Message.Operation == 0 {
+    if r.Message.Type == PING && r.Message.Operation == PING_OP_PING {
         return a, nil
     }
 
@@ -39,20 +47,40 @@ func (a *PongActivity) Route(r *Request) (h Handler, err error) {
 }
 
 func (a *PongActivity) Handle(r *Request) error {
-    peer := string(r.Message.Load)
-    pongAddr, err := a.c.GetPeerAddr(peer)
+    if r.Message.Version < idVersion {
+        // version 1 ping carries only name of the sender, and no gossip
+        peer := string(r.Message.Load)
+        addr, err := a.c.GetPeerAddr(peer)
+        if err != nil {
+            return errors.New(fmt.Sprintf("Cannot pong peer %s", peer))
+        }
+
+        return a.c.reply(addr, r, &Message{
+            Version: ProtocolVersion,
+            Type: PING,
+            Operation: PING_OP_PONG,
+        })
+    }
+
+    dto, err := a.c.gossip.absorb(r)
     if err != nil {
-       return errors.New(fmt.Sprintf("Cannot pong peer %s", peer))
+        return err
+    }
+
+    addr, err := a.c.GetPeerAddr(r.Message.ReplyTo)
+    if err != nil {
+        // not known yet or taken for dead, reply where it listens
+        addr = &net.UDPAddr{
+            IP: r.From.IP,
+            Port: dto.From.Peer.Port,
+        }
     }
 
     // send pong back
-    go a.c.Send(pongAddr, &Message{
-        Version: 1,
-        Type: PING,
-        Operation: 1,   // pong
-        Length: 0,
-        Load: make([]byte, 0, 0),
-    })
+    err = a.c.reply(addr, r, a.c.gossip.message(PING_OP_PONG, r.Message.ReplyTo, ""))
+    if err != nil {
+       return errors.New(fmt.Sprintf("Cannot pong peer %s", r.Message.ReplyTo))
+    }
 
     return nil
 }
@@ -61,6 +89,7 @@ type PingActivity struct {
     Result chan int
     c *Cluster
     fsa *fsa.FSA
+    id uint64                   // activity id, set once registered
 }
 
 func NewPingActivity(c *Cluster) *PingActivity {
@@ -71,15 +100,8 @@ func NewPingActivity(c *Cluster) *PingActivity {
     }
 }
 
-func (a *PingActivity) Route(r *Request) (h Handler, err error)  {
-    if r.Message.Type == PING && r.Message.Operation == 1 {
-        return a, nil
-    }
-
-    return nil, errors.New("Cannot handle this")
-}
-
 func (a *PingActivity) Handle(r *Request) error {
+    a.c.gossip.absorb(r)
     go a.fsa.Send(PING_RCVD_PONG)
     return nil
 }
@@ -107,13 +129,7 @@ func (a *PingActivity) Run(target string) {
             }
 
             // send ping 
-            go a.c.Send(targetAddr, &Message{
-                Version: 1,
-                Type: PING,
-                Operation: 0,   // ping
-                Length: uint16(len(*a.c.proxy.Name)),
-                Load: []byte(*a.c.proxy.Name),
-            })
+            a.c.exchange.Request(targetAddr, a.c.gossip.message(PING_OP_PING, target, ""), a.id)
 
             go a.fsa.Send(PING_SENT)
             return PING_SENT
@@ -0,0 +1,247 @@
+// Protocol versions and features spoken by peers
+package cluster
+
+import (
+    "errors"
+    "log"
+    "net"
+    "strconv"
+    "strings"
+)
+
+/*
+Every node advertises along with its other text, in discovery records and
+gossip alike, the range of protocol versions it speaks and the features it
+serves:
+
+    proto=1-3
+    features=stream,watch,scan,batch,txn,ttl
+
+Nodes built before versioning advertise neither, they speak version 1 and
+none of the optional features. Messages to a peer carry the highest version
+both ends speak, peers with no version in common are left out of the ring.
+Nodes not known yet, like seeds, are spoken to in version 2, version 1 nodes
+are only found by discovery. Packets of versions the node does not speak are
+dropped on receipt.
+
+    1   first release: bytes 3 and 20-35 of the header are reserved and zero,
+        only ping, store and load messages, gob encoded loads. Ping carries
+        name of the sender as load, pong carries nothing. Replies are told
+        apart by type and operation only
+    2   flags, request and activity ids in the header as described in
+        message.go, replies are routed by ids, all message types
+    3   same header, compact loads described in codec.go
+
+Loads are encoded in the newest version and translated for older peers when
+sent, messages version 1 cannot carry are refused. Requests to version 1
+peers are not retransmitted, replies from them are taken for replies to the
+oldest pending request of the same type to the peer, see Exchange. Layout of
+a newer version shall keep the first byte for the version, so that older
+nodes can tell and drop it
+ */
+
+// Highest and lowest versions of the protocol the node speaks
+const ProtocolVersion byte = 3
+const MinProtocolVersion byte = 1
+
+// First version with flags and ids in the header
+const idVersion byte = 2
+
+const protocolKey string = "proto"
+const featuresKey string = "features"
+
+// Optional features, peers that do not advertise one are not asked for it
+const (
+    FeatureStream = "stream"            // messages over stream transport
+    FeatureWatch = "watch"
+    FeatureScan = "scan"
+    FeatureBatch = "batch"
+    FeatureTxn = "txn"
+    FeatureTTL = "ttl"
+)
+
+// Features served by the node
+var Features = []string{ FeatureStream, FeatureWatch, FeatureScan, FeatureBatch, FeatureTxn, FeatureTTL }
+
+var ErrUnsupportedVersion = errors.New("Unsupported protocol version")
+var ErrIncompatiblePeer = errors.New("Peer does not speak any common protocol version")
+var ErrUnsupportedMessage = errors.New("Message is not part of the protocol version")
+
+// Operations of version 1 by type, true for replies
+var v1Operations = map[OperationType]map[byte]bool{
+    PING: { PING_OP_PING: false, PING_OP_PONG: true },
+    STORE: { STORE_OP_PUT: false, STORE_OP_ACK: true },
+    LOAD: { LOAD_OP_GET: false, LOAD_OP_ACK: true, LOAD_OP_NACK: true },
+}
+
+func protocolText() string {
+    return strconv.Itoa(int(MinProtocolVersion)) + "-" + strconv.Itoa(int(ProtocolVersion))
+}
+
+func featuresText() string {
+    return strings.Join(Features, ",")
+}
+
+// Range of protocol versions the peer speaks, peers that do not tell speak version 1
+func (p *Peer) Protocol() (min, max byte) {
+    value := p.getText(protocolKey)
+    if value == nil {
+        return 1, 1
+    }
+
+    bounds := strings.SplitN(*value, "-", 2)
+    lo, err := strconv.ParseUint(bounds[0], 10, 8)
+    if err != nil {
+        return 1, 1
+    }
+    hi := lo
+    if len(bounds) == 2 {
+        if hi, err = strconv.ParseUint(bounds[1], 10, 8); err != nil || hi < lo {
+            return 1, 1
+        }
+    }
+
+    return byte(lo), byte(hi)
+}
+
+// Peer advertises the feature
+func (p *Peer) Supports(feature string) bool {
+    value := p.getText(featuresKey)
+    if value == nil {
+        return false
+    }
+
+    for _, f := range strings.Split(*value, ",") {
+        if f == feature {
+            return true
+        }
+    }
+
+    return false
+}
+
+// Highest version spoken by both the node and peer with given range
+func negotiate(min, max byte) (byte, bool) {
+    if max > ProtocolVersion {
+        max = ProtocolVersion
+    }
+    if max < min || max < MinProtocolVersion {
+        return 0, false
+    }
+
+    return max, true
+}
+
+// Peer is known to serve the feature, the node itself always does
+func (c *Cluster) PeerSupports(peer string, feature string) bool {
+    if peer == *c.proxy.Name {
+        return true
+    }
+
+    p, ok := c.proxy.Membership().Peers[peer]
+    return ok && p.Supports(feature)
+}
+
+// Member at the address, if any
+func (c *Cluster) peerAt(addr *net.UDPAddr) (Peer, bool) {
+    for _, p := range c.proxy.Membership().Peers {
+        if p.Port == addr.Port && p.AddrIPv4.Equal(addr.IP) {
+            return p, true
+        }
+    }
+
+    return Peer{}, false
+}
+
+// Version to speak to the peer at the address
+func (c *Cluster) versionAt(to *net.UDPAddr) (byte, error) {
+    p, ok := c.peerAt(to)
+    if !ok {
+        return idVersion, nil
+    }
+
+    version, ok := negotiate(p.Protocol())
+    if !ok {
+        return 0, ErrIncompatiblePeer
+    }
+    return version, nil
+}
+
+// Version and transport of the message fit for the peer at the address
+func (c *Cluster) adapt(to *net.UDPAddr, m *Message) (*Message, error) {
+    version, err := c.versionAt(to)
+    if err != nil {
+        return nil, err
+    }
+
+    m, err = translate(m, version)
+    if err != nil {
+        return nil, err
+    }
+
+    p, ok := c.peerAt(to)
+    if ok && !FitsDatagram(m) && *p.Name != *c.proxy.Name && !p.Supports(FeatureStream) {
+        log.Printf("Peer %s cannot take %d bytes message", *p.Name, len(m.Load))
+        return nil, errors.New("Message is too big for the peer")
+    }
+
+    return m, nil
+}
+
+// Copy of the message in given protocol version, the message itself is left as is
+func translate(m *Message, version byte) (*Message, error) {
+    if version == m.Version {
+        return m, nil
+    }
+
+    translated := *m
+    translated.Version = version
+    if version < compactVersion {
+        load, err := gobLoad(m.Load)
+        if err != nil {
+            return nil, err
+        }
+        translated.Load, translated.Length = load, uint16(len(load))
+    }
+
+    if version < idVersion {
+        return v1Message(&translated)
+    }
+    return &translated, nil
+}
+
+// Message in the form version 1 nodes take, or error if they cannot
+func v1Message(m *Message) (*Message, error) {
+    if _, ok := v1Operations[m.Type][m.Operation]; !ok || m.Flags & FlagFenced != 0 {
+        return nil, ErrUnsupportedMessage
+    }
+    m.Flags, m.RequestId, m.ActivityId = 0, 0, 0
+
+    switch m.Type {
+    case PING:
+        // gossip is not understood
+        m.Load = nil
+        if m.Operation == PING_OP_PING {
+            m.Load = []byte(m.ReplyTo)
+        }
+        m.Length = uint16(len(m.Load))
+    case STORE, LOAD:
+        if len(m.Load) == 0 {
+            break
+        }
+
+        var dto StoreDTO
+        if err := DecodeLoad(m.Load, &dto); err != nil {
+            return nil, err
+        }
+        // tombstones and expiring values would be kept as plain values
+        if dto.Deleted || dto.Expires > 0 {
+            if m.Type == STORE {
+                return nil, ErrUnsupportedMessage
+            }
+            m.Operation, m.Load, m.Length = LOAD_OP_NACK, nil, 0
+        }
+    }
+
+    return m, nil
+}
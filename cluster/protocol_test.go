@@ -0,0 +1,254 @@
+package cluster
+
+import (
+    "bytes"
+    "encoding/gob"
+    "encoding/hex"
+    "io/ioutil"
+    "net"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// Packets captured from the first release, see testdata/packets/README
+func recordedPacket(t testing.TB, name string) []byte {
+    raw, err := ioutil.ReadFile(filepath.Join("testdata", "packets", name + ".hex"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    packet, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return packet
+}
+
+// Store load as the first release has it
+type v1StoreDTO struct {
+    Key []byte
+    Value []byte
+}
+
+// Next packet the peer got, checked to be in version 1 layout
+func v1Packet(t *testing.T, conn *net.UDPConn) *Message {
+    buf := make([]byte, MaxDatagramSize)
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    n, _, err := conn.ReadFromUDP(buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if buf[0] != 1 || buf[3] != 0 || !bytes.Equal(buf[20:36], make([]byte, 16)) {
+        t.Fatalf("Packet is not in version 1 layout: % x", buf[:36])
+    }
+
+    m, err := Unmarshall(buf[:n])
+    if err != nil {
+        t.Fatal(err)
+    }
+    return m
+}
+
+// Route recorded packet as if it came from the peer
+func replay(t *testing.T, c *Cluster, conn *net.UDPConn, name string) {
+    m, err := Unmarshall(recordedPacket(t, name))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    r := &Request{ From: conn.LocalAddr().(*net.UDPAddr), Message: m }
+    h, err := c.Route(r)
+    if err != nil {
+        t.Fatal(name, err)
+    }
+    if err := h.Handle(r); err != nil {
+        t.Fatal(name, err)
+    }
+}
+
+func TestProtocol_Replay(t *testing.T) {
+    for _, name := range []string{ "v1-ping", "v1-pong", "v1-store-put", "v1-store-ack", "v1-load-get", "v1-load-ack", "v1-load-nack" } {
+        packet := recordedPacket(t, name)
+        m, err := Unmarshall(packet)
+        if err != nil {
+            t.Fatal(name, err)
+        }
+        if m.Version != 1 || m.Flags != 0 || m.RequestId != 0 || m.ActivityId != 0 {
+            t.Error("Unexpected header", name, m)
+        }
+        if _, ok := v1Operations[m.Type][m.Operation]; !ok {
+            t.Error("Unexpected message", name, m.Type, m.Operation)
+        }
+        if !bytes.Equal(Marshall(m), packet) {
+            t.Error("Packet shall marshall back the same", name)
+        }
+    }
+
+    m, _ := Unmarshall(recordedPacket(t, "v1-store-put"))
+    var dto StoreDTO
+    if err := DecodeLoad(m.Load, &dto); err != nil || string(dto.Key) != "site" || string(dto.Value) != "b" {
+        t.Error("Unexpected load", dto, err)
+    }
+}
+
+func TestProtocol_V1Store(t *testing.T) {
+    c, conn := standaloneCluster(t, NewInMemoryStorage(), "node-b", "partitions=1")
+
+    result := make(chan int, 1)
+    go func() { result <- c.Store([]byte("site"), []byte("b"), ConsistencyLevelZero) }()
+
+    m := v1Packet(t, conn)
+    var dto v1StoreDTO
+    if err := gob.NewDecoder(bytes.NewReader(m.Load)).Decode(&dto); err != nil {
+        t.Fatal(err)
+    }
+    if m.Type != STORE || m.Operation != STORE_OP_PUT || m.ReplyTo != "standalone" || string(dto.Key) != "site" || string(dto.Value) != "b" {
+        t.Fatal("Unexpected store", m, dto)
+    }
+
+    replay(t, c, conn, "v1-store-ack")
+    if r := <- result; r != STORE_SUCCESS {
+        t.Error("Store shall be acked by version 1 peer", r)
+    }
+
+    // ack nobody waits for is dropped
+    replay(t, c, conn, "v1-store-ack")
+}
+
+func TestProtocol_V1Ping(t *testing.T) {
+    c, conn := standaloneCluster(t, NewInMemoryStorage(), "node-b", "partitions=1")
+
+    result := make(chan int, 1)
+    go func() { result <- c.Ping("node-b") }()
+
+    m := v1Packet(t, conn)
+    if m.Type != PING || m.Operation != PING_OP_PING || string(m.Load) != "standalone" {
+        t.Fatal("Unexpected ping", m)
+    }
+
+    replay(t, c, conn, "v1-pong")
+    if r := <- result; r != PING_SUCCESS {
+        t.Error("Ping shall be ponged by version 1 peer", r)
+    }
+}
+
+func TestProtocol_V1Requests(t *testing.T) {
+    c, conn := standaloneCluster(t, NewInMemoryStorage(), "node-b", "partitions=1")
+
+    replay(t, c, conn, "v1-ping")
+    buf := make([]byte, MaxDatagramSize)
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    n, _, err := conn.ReadFromUDP(buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(buf[:n], recordedPacket(t, "v1-pong")) {
+        t.Errorf("Pong shall be the same as of the first release: % x", buf[:n])
+    }
+
+    replay(t, c, conn, "v1-store-put")
+    if m := v1Packet(t, conn); m.Type != STORE || m.Operation != STORE_OP_ACK || m.ReplyTo != "standalone" || len(m.Load) != 0 {
+        t.Error("Unexpected ack", m)
+    }
+    if v, ok := c.storage.Get([]byte("site")); !ok || string(v.Value) != "b" {
+        t.Error("Value shall be stored", v)
+    }
+
+    replay(t, c, conn, "v1-load-get")
+    m := v1Packet(t, conn)
+    var dto v1StoreDTO
+    if err := gob.NewDecoder(bytes.NewReader(m.Load)).Decode(&dto); err != nil {
+        t.Fatal(err)
+    }
+    if m.Type != LOAD || m.Operation != LOAD_OP_ACK || string(dto.Value) != "b" {
+        t.Error("Unexpected load ack", m, dto)
+    }
+
+    tombstone := c.newVersion(nil, nil)
+    tombstone.Deleted = true
+    c.storage.Put([]byte("site"), tombstone)
+    replay(t, c, conn, "v1-load-get")
+    if m := v1Packet(t, conn); m.Operation != LOAD_OP_NACK || len(m.Load) != 0 {
+        t.Error("Deleted key shall be nacked", m)
+    }
+}
+
+func TestProtocol_V1Refused(t *testing.T) {
+    c, conn := standaloneCluster(t, NewInMemoryStorage(), "node-b", "partitions=1")
+    addr := conn.LocalAddr().(*net.UDPAddr)
+
+    if err := c.Send(addr, &Message{ Version: ProtocolVersion, Type: SYNC }); err != ErrUnsupportedMessage {
+        t.Error("Message unknown to version 1 shall be refused", err)
+    }
+
+    fenced := &Message{ Version: ProtocolVersion, Type: STORE, Operation: STORE_OP_PUT }
+    fence(fenced, 1)
+    if err := c.Send(addr, fenced); err != ErrUnsupportedMessage {
+        t.Error("Fenced store shall be refused", err)
+    }
+
+    expiring := c.newVersion([]byte("v"), nil)
+    expiring.Expires = time.Now().Add(time.Minute).UnixNano()
+    load := EncodeLoad(NewStoreDTO([]byte("k"), expiring))
+    m := &Message{ Version: ProtocolVersion, Type: STORE, Operation: STORE_OP_PUT, Length: uint16(len(load)), Load: load }
+    if err := c.Send(addr, m); err != ErrUnsupportedMessage {
+        t.Error("Expiring value shall be refused", err)
+    }
+
+    // not a message of version 1
+    packet := recordedPacket(t, "v1-ping")
+    packet[1] = byte(SYNC)
+    r, _ := Unmarshall(packet)
+    if _, err := c.Route(&Request{ From: addr, Message: r }); err == nil {
+        t.Error("Unknown message of version 1 shall not be routed")
+    }
+}
+
+func TestProtocol_UnknownVersion(t *testing.T) {
+    for _, version := range []byte{ 0, ProtocolVersion + 1 } {
+        packet := recordedPacket(t, "v1-ping")
+        packet[0] = version
+        if _, err := Unmarshall(packet); err != ErrUnsupportedVersion {
+            t.Error("Version shall be rejected", version, err)
+        }
+    }
+}
+
+func TestProtocol_Negotiate(t *testing.T) {
+    if v, ok := negotiate(1, 1); !ok || v != 1 {
+        t.Error("Unexpected version", v)
+    }
+    if v, ok := negotiate(1, ProtocolVersion + 5); !ok || v != ProtocolVersion {
+        t.Error("Unexpected version", v)
+    }
+    if _, ok := negotiate(ProtocolVersion + 1, ProtocolVersion + 2); ok {
+        t.Error("Newer peer shall not be spoken to")
+    }
+}
+
+func TestProtocol_PeerText(t *testing.T) {
+    old := Peer{ Text: []string{ "partitions=10" } }
+    if min, max := old.Protocol(); min != 1 || max != 1 {
+        t.Error("Peer without version shall speak version 1", min, max)
+    }
+    if old.Supports(FeatureScan) {
+        t.Error("Peer without features shall support none")
+    }
+
+    peer := Peer{ Text: []string{ "proto=1-3", "features=stream,scan" } }
+    if min, max := peer.Protocol(); min != 1 || max != 3 {
+        t.Error("Unexpected versions", min, max)
+    }
+    if !peer.Supports(FeatureScan) || peer.Supports(FeatureTxn) {
+        t.Error("Unexpected features")
+    }
+
+    for _, p := range client1.Cluster.Peers() {
+        if _, max := p.Protocol(); max != ProtocolVersion || !p.Supports(FeatureTxn) {
+            t.Error("Peer shall advertise version and features", *p.Name, p.Text)
+        }
+    }
+}
@@ -0,0 +1,219 @@
+// Moving keys between peers when ring membership changes
+package cluster
+
+import (
+    "log"
+    "sync"
+    "time"
+    "github.com/reusee/mmh3"
+)
+
+/*
+On every membership change each node walks its local keys and compares the
+owners of every key on the ring it saw last time with the owners on the
+current ring:
+
+    - if node does not own the key anymore, it transfers the key to all
+      current owners and deletes local copy once every owner acknowledged
+    - if node still owns the key, the first of old owners that stays an
+      owner transfers the key to owners that are new for it
+
+Changes coming in quick succession are handled in one pass
+ */
+
+const rebalanceDelay = 2 * time.Second
+const rebalanceWorkers = 8
+
+type Rebalancer struct {
+    c *Cluster
+    ring []*PeerPartition       // ring as of last pass, nil before first pass
+    trigger chan bool
+    quit chan int
+}
+
+type rebalanceTask struct {
+    key []byte
+    version *Version
+    targets []*Peer
+    release bool                // delete local copy after all targets acked
+}
+
+func NewRebalancer(c *Cluster) *Rebalancer {
+    return &Rebalancer{
+        c: c,
+        ring: nil,
+        trigger: make(chan bool, 1),
+        quit: nil,
+    }
+}
+
+// Schedule rebalancing pass, does not block
+func (r *Rebalancer) Trigger() {
+    select {
+    case r.trigger <- true:
+    default:
+        // pass is already scheduled
+    }
+}
+
+// Launches background rebalancing on triggers
+func (r *Rebalancer) Start() {
+    if r.quit == nil {
+        r.quit = make(chan int, 1)
+        go func(quit chan int) {
+            for {
+                select {
+                case <- r.trigger:
+                    // let membership settle
+                    select {
+                    case <- time.After(rebalanceDelay):
+                    case <- quit:
+                        return
+                    }
+                    r.pass()
+                case <- quit:
+                    return
+                }
+            }
+        }(r.quit)
+    }
+}
+
+// Stops background rebalancing
+func (r *Rebalancer) Stop() {
+    if r.quit != nil {
+        r.quit <- 1
+        r.quit = nil
+    }
+}
+
+func containsPeer(peers []*Peer, name string) bool {
+    for _, p := range peers {
+        if *p.Name == name {
+            return true
+        }
+    }
+
+    return false
+}
+
+// Determine what has to be moved for the key, nil if nothing
+func (r *Rebalancer) plan(ring []*PeerPartition, copies int, key []byte) *rebalanceTask {
+    self := *r.c.proxy.Name
+    hash := mmh3.Sum128(key)
+    owners := r.c.hashNodes(ring, hash, copies)
+
+    if !containsPeer(owners, self) {
+        return &rebalanceTask{
+            key: key,
+            targets: owners,
+            release: true,
+        }
+    }
+
+    if r.ring == nil {
+        return nil
+    }
+
+    oldOwners := r.c.hashNodes(r.ring, hash, copies)
+    for _, p := range oldOwners {
+        if containsPeer(owners, *p.Name) {
+            if *p.Name != self {
+                // somebody else is responsible
+                return nil
+            }
+            break
+        }
+    }
+
+    targets := make([]*Peer, 0, copies)
+    for _, p := range owners {
+        if *p.Name != self && !containsPeer(oldOwners, *p.Name) {
+            targets = append(targets, p)
+        }
+    }
+
+    if len(targets) == 0 {
+        return nil
+    }
+
+    return &rebalanceTask{
+        key: key,
+        targets: targets,
+        release: false,
+    }
+}
+
+// One pass over local storage
+func (r *Rebalancer) pass() {
+    if r.c.Size() == 0 {
+        return
+    }
+
+    ring := r.c.Partitions()
+    copies := r.c.Copies(r.c.ReplicationLevel)
+
+    keys := make([][]byte, 0)
+    r.c.storage.ForEach(func(key []byte, version *Version) bool {
+        keys = append(keys, append([]byte{}, key...))
+        return true
+    })
+
+    tasks := make(chan *rebalanceTask)
+    var wg sync.WaitGroup
+    for i := 0; i < rebalanceWorkers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for t := range tasks {
+                r.run(t)
+            }
+        }()
+    }
+
+    moved := 0
+    for _, key := range keys {
+        t := r.plan(ring, copies, key)
+        if t == nil {
+            continue
+        }
+
+        version, ok := r.c.storage.Get(key)
+        if !ok {
+            continue
+        }
+        t.version = version
+        tasks <- t
+        moved++
+    }
+    close(tasks)
+    wg.Wait()
+
+    r.ring = ring
+    if moved > 0 {
+        log.Printf("Rebalanced %d of %d keys", moved, len(keys))
+    }
+}
+
+func (r *Rebalancer) run(t *rebalanceTask) {
+    acked := true
+    for _, p := range t.targets {
+        if !r.c.handoff.Transfer(*p.Name, t.key, t.version) {
+            log.Println("Cannot hand off key to", *p.Name)
+            acked = false
+        }
+    }
+
+    if !t.release || !acked {
+        return
+    }
+
+    // keep the key if it was overwritten in the meanwhile, writes are held off until it is released
+    r.c.applyMu.Lock()
+    defer r.c.applyMu.Unlock()
+    if version, ok := r.c.storage.Get(t.key); ok && version.Clock.Compare(t.version.Clock) == ClockEqual {
+        if err := r.c.storage.Delete(t.key); err != nil {
+            log.Println("Cannot release key:", err)
+        }
+    }
+}
@@ -0,0 +1,39 @@
+package cluster
+
+import (
+    "fmt"
+    "testing"
+    "github.com/reusee/mmh3"
+)
+
+func TestRebalancer_MovesForeignKey(t *testing.T) {
+    c := client1.Cluster
+
+    // find a key node1 does not replicate and put it to node1
+    var key []byte
+    var owners []*Peer
+    for i := 0; key == nil; i++ {
+        k := []byte(fmt.Sprintf("foreign%d", i))
+        owners = c.HashNodes(mmh3.Sum128(k), c.ReplicationLevel)
+        if !containsPeer(owners, *c.proxy.Name) {
+            key = k
+        }
+    }
+
+    c.storage.Put(key, c.newVersion([]byte("value"), nil))
+    c.rebalancer.pass()
+
+    if _, ok := c.storage.Get(key); ok {
+        t.Error("Key shall be released after handoff")
+    }
+
+    for _, client := range []*Client{ client2, client3, client4, client5 } {
+        if !containsPeer(owners, client.GetName()) {
+            continue
+        }
+
+        if v, ok := client.Cluster.storage.Get(key); !ok || string(v.Value) != "value" {
+            t.Error("Key was not handed off to", client.GetName())
+        }
+    }
+}
@@ -0,0 +1,277 @@
+// Listing keys in order
+package cluster
+
+import (
+    "bytes"
+    "errors"
+    "log"
+    "sort"
+    "time"
+    "github.com/reusee/mmh3"
+)
+
+/*
+Every peer owns some ranges of the ring, so scan asks all peers of the ring for
+keys with the prefix that follow the cursor and that they own:
+
+    N -> P   SCAN_OP_REQUEST   prefix, cursor and limit
+    P -> N   SCAN_OP_RESULT    up to limit keys in order with their clocks, whether there are more
+
+Replicas of the same key may know of different versions, they are merged as in
+load and keys that resolve to tombstones are left out. A peer that has more
+keys than limit may still have ones that sort before the last keys of others,
+so the page ends at the smallest last key among such peers, and the cursor
+of the page is where next page starts. Page can be shorter than limit even
+if more keys follow, only missing cursor means the scan is over
+ */
+
+const (
+    SCAN_OP_REQUEST byte = iota
+    SCAN_OP_RESULT
+)
+
+const DefaultScanLimit = 100
+const MaxScanLimit = 1000
+const scanTimeout = requestLifetime
+
+var ErrScanFailed = errors.New("No peer answered the scan")
+
+type ScanDTO struct {
+    Prefix []byte
+    After []byte                // cursor, nil for the first page
+    Limit int
+}
+
+// Key as known by one replica, values are not sent
+type ScanEntry struct {
+    Key []byte
+    Clock VectorClock
+    Timestamp int64
+    Deleted bool
+}
+
+type ScanResultDTO struct {
+    Entries []ScanEntry
+    More bool
+}
+
+// Keys of one page in order, Cursor is nil once there are no more keys
+type ScanPage struct {
+    Keys [][]byte
+    Cursor []byte
+}
+
+type ScanActivity struct {
+    c *Cluster
+}
+
+func NewScanActivity(c *Cluster) *ScanActivity {
+    return &ScanActivity{
+        c: c,
+    }
+}
+
+func (a *ScanActivity) Route(r *Request) (h Handler, err error) {
+    if r.Message.Type == SCAN && r.Message.Operation == SCAN_OP_REQUEST {
+        return a, nil
+    }
+
+    return nil, errors.New("Cannot handle this")
+}
+
+func (a *ScanActivity) Handle(r *Request) error {
+    var dto ScanDTO
+    if err := DecodeLoad(r.Message.Load, &dto); err != nil {
+        return err
+    }
+
+    load := EncodeLoad(a.c.scanLocal(dto.Prefix, dto.After, scanLimit(dto.Limit)))
+    return a.c.Reply(r, &Message{
+        Version: ProtocolVersion,
+        Type: SCAN,
+        Operation: SCAN_OP_RESULT,
+        ReplyTo: *a.c.proxy.Name,
+        Length: uint16(len(load)),
+        Load: load,
+    })
+}
+
+func scanLimit(limit int) int {
+    if limit <= 0 || limit > MaxScanLimit {
+        return MaxScanLimit
+    }
+    return limit
+}
+
+// Keys with the prefix after the cursor that the node owns on current ring
+func (c *Cluster) scanLocal(prefix, after []byte, limit int) ScanResultDTO {
+    ring := c.Partitions()
+    copies := c.Copies(c.ReplicationLevel)
+
+    from := prefix
+    if after != nil && bytes.Compare(after, prefix) >= 0 {
+        from = after
+    }
+
+    result := ScanResultDTO{ Entries: make([]ScanEntry, 0) }
+    c.storage.Scan(from, func(key []byte, v *Version) bool {
+        if !bytes.HasPrefix(key, prefix) {
+            return false
+        }
+        if after != nil && bytes.Compare(key, after) <= 0 {
+            return true
+        }
+        // left over from before rebalance
+        if !containsPeer(c.hashNodes(ring, mmh3.Sum128(key), copies), *c.proxy.Name) {
+            return true
+        }
+
+        if len(result.Entries) == limit {
+            result.More = true
+            return false
+        }
+
+        result.Entries = append(result.Entries, ScanEntry{
+            Key: append([]byte{}, key...),
+            Clock: v.Clock,
+            Timestamp: v.Timestamp,
+            Deleted: v.Deleted,
+        })
+        return true
+    })
+
+    return result
+}
+
+// Page of keys with the prefix after the cursor, nil cursor starts from the beginning
+func (c *Cluster) Scan(prefix, cursor []byte, limit int) (*ScanPage, error) {
+    limit = scanLimit(limit)
+
+    replies := make(chan *Request, len(c.Peers()))
+    id := c.begin(HandlerFunc(func(r *Request) error {
+        select {
+        case replies <- r:
+        default:
+        }
+        return nil
+    }))
+    defer c.end(id)
+
+    load := EncodeLoad(ScanDTO{
+        Prefix: prefix,
+        After: cursor,
+        Limit: limit,
+    })
+
+    asked := make(map[string]bool)
+    skipped := make(map[string]bool)
+    for _, p := range c.Partitions() {
+        name := *p.Peer.Name
+        if asked[name] || skipped[name] {
+            continue
+        }
+        if !c.PeerSupports(name, FeatureScan) {
+            log.Println("Peer does not list keys", name)
+            skipped[name] = true
+            continue
+        }
+
+        addr, err := c.GetPeerAddr(name)
+        if err != nil {
+            log.Println("Cannot contact peer", name)
+            continue
+        }
+        asked[name] = true
+
+        c.exchange.Request(addr, &Message{
+            Version: ProtocolVersion,
+            Type: SCAN,
+            Operation: SCAN_OP_REQUEST,
+            ReplyTo: *c.proxy.Name,
+            Length: uint16(len(load)),
+            Load: load,
+        }, id)
+    }
+
+    results := make([]ScanResultDTO, 0, len(asked))
+    answered := make(map[string]bool)
+    timeout := time.After(scanTimeout)
+wait:
+    for len(answered) < len(asked) {
+        select {
+        case r := <- replies:
+            var result ScanResultDTO
+            if answered[r.Message.ReplyTo] || DecodeLoad(r.Message.Load, &result) != nil {
+                continue
+            }
+            answered[r.Message.ReplyTo] = true
+            results = append(results, result)
+        case <- timeout:
+            log.Printf("Scan got answers from %d of %d peers", len(answered), len(asked))
+            break wait
+        }
+    }
+
+    if len(results) == 0 {
+        return nil, ErrScanFailed
+    }
+
+    return mergeScan(results, limit), nil
+}
+
+// Merge what replicas returned into one page
+func mergeScan(results []ScanResultDTO, limit int) *ScanPage {
+    // keys past the end of a truncated result may be missing from it
+    var end []byte
+    for _, result := range results {
+        if !result.More || len(result.Entries) == 0 {
+            continue
+        }
+        last := result.Entries[len(result.Entries) - 1].Key
+        if end == nil || bytes.Compare(last, end) < 0 {
+            end = last
+        }
+    }
+
+    versions := make(map[string][]*Version)
+    for _, result := range results {
+        for _, e := range result.Entries {
+            if end != nil && bytes.Compare(e.Key, end) > 0 {
+                continue
+            }
+            versions[string(e.Key)] = append(versions[string(e.Key)], &Version{
+                Clock: e.Clock,
+                Timestamp: e.Timestamp,
+                Deleted: e.Deleted,
+            })
+        }
+    }
+
+    keys := make([]string, 0, len(versions))
+    for k := range versions {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    page := &ScanPage{ Keys: make([][]byte, 0, limit) }
+    for i, k := range keys {
+        // values are not known here, later of concurrent versions wins
+        if Resolve(Siblings(versions[k]), LastWriteWins).Deleted {
+            continue
+        }
+
+        page.Keys = append(page.Keys, []byte(k))
+        if len(page.Keys) == limit {
+            if i < len(keys) - 1 || end != nil {
+                page.Cursor = []byte(k)
+            }
+            return page
+        }
+    }
+
+    if end != nil {
+        page.Cursor = end
+    }
+
+    return page
+}
@@ -0,0 +1,76 @@
+package cluster
+
+import (
+    "fmt"
+    "testing"
+)
+
+func TestScan_Storage(t *testing.T) {
+    s := NewInMemoryStorage()
+    for _, k := range []string{ "c", "a", "d", "b" } {
+        s.Put([]byte(k), &Version{ Value: []byte(k) })
+    }
+
+    keys := ""
+    s.Scan([]byte("b"), func(key []byte, v *Version) bool {
+        keys += string(key)
+        return len(keys) < 2
+    })
+    if keys != "bc" {
+        t.Fatal("Unexpected keys in scan", keys)
+    }
+}
+
+func TestScan_Merge(t *testing.T) {
+    entry := func(key string, counter uint64, deleted bool) ScanEntry {
+        return ScanEntry{ Key: []byte(key), Clock: VectorClock{ "a": counter }, Timestamp: int64(counter), Deleted: deleted }
+    }
+
+    results := []ScanResultDTO{
+        { Entries: []ScanEntry{ entry("a", 1, false), entry("b", 1, false), entry("c", 1, false) }, More: true },
+        { Entries: []ScanEntry{ entry("b", 2, true), entry("d", 1, false) } },
+    }
+
+    // d may come before keys first replica did not return
+    page := mergeScan(results, 10)
+    if len(page.Keys) != 2 || string(page.Keys[0]) != "a" || string(page.Keys[1]) != "c" || string(page.Cursor) != "c" {
+        t.Fatal("Unexpected page", page)
+    }
+
+    page = mergeScan(results[1:], 1)
+    if len(page.Keys) != 1 || string(page.Keys[0]) != "d" || page.Cursor != nil {
+        t.Fatal("Unexpected last page", page)
+    }
+}
+
+func TestScan_Keys(t *testing.T) {
+    for i := 0; i < 25; i++ {
+        client1.Store([]byte(fmt.Sprintf("scan/%02d", i)), []byte("value"), ConsistencyLevelTwo)
+    }
+    client1.Store([]byte("scanned"), []byte("value"), ConsistencyLevelTwo)
+    client2.Delete([]byte("scan/13"), ConsistencyLevelTwo)
+
+    keys := make([]string, 0)
+    page, err := client3.Scan([]byte("scan/"), 10)
+    for {
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, k := range page.Keys {
+            keys = append(keys, string(k))
+        }
+        if page.Cursor == nil {
+            break
+        }
+        page, err = client3.ScanAfter([]byte("scan/"), page.Cursor, 10)
+    }
+
+    if len(keys) != 24 {
+        t.Fatal("Unexpected number of keys", len(keys), keys)
+    }
+    for i := 1; i < len(keys); i++ {
+        if keys[i - 1] >= keys[i] {
+            t.Fatal("Keys shall come in order once", keys)
+        }
+    }
+}
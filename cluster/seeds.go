@@ -0,0 +1,235 @@
+// Discovery through known addresses of some peers
+package cluster
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+/*
+Seed addresses come from a static list, a file or DNS SRV records. Every seed
+is probed with JOIN hello carrying the node details, and replies with its own
+details and the peers it knows. Seeds remember who probed them for a while, so
+it is enough for every node to know a single seed.
+
+Nothing is announced, the node is visible to others as long as it is a seed
+for them or probes some seed itself
+ */
+
+type SeedDiscovery struct {
+    seeds func() ([]string, error)      // host:port of seeds
+}
+
+// Discovery through fixed list of seeds
+func NewStaticDiscovery(seeds []string) *SeedDiscovery {
+    return &SeedDiscovery{
+        seeds: func() ([]string, error) {
+            return seeds, nil
+        },
+    }
+}
+
+// Discovery through seeds listed in the file one per line, file is read again when it changes
+func NewFileDiscovery(path string) *SeedDiscovery {
+    f := &seedFile{
+        path: path,
+    }
+
+    return &SeedDiscovery{
+        seeds: f.read,
+    }
+}
+
+// Discovery through DNS SRV records of the name, default resolver is used if nil
+func NewDNSDiscovery(name string, resolver *net.Resolver) *SeedDiscovery {
+    if resolver == nil {
+        resolver = net.DefaultResolver
+    }
+
+    return &SeedDiscovery{
+        seeds: func() ([]string, error) {
+            return lookupSeeds(resolver, name)
+        },
+    }
+}
+
+func (d *SeedDiscovery) Announce(node *Node) error {
+    return nil
+}
+
+func (d *SeedDiscovery) SetText(text []string) {
+}
+
+func (d *SeedDiscovery) Shutdown() {
+}
+
+func (d *SeedDiscovery) Browse(node *Node) ([]Peer, error) {
+    seeds, err := d.seeds()
+    if err != nil {
+        return nil, err
+    }
+
+    peers := []Peer{ node.self() }
+    peers = append(peers, node.introductions()...)
+
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    for _, seed := range seeds {
+        wg.Add(1)
+        go func(seed string) {
+            defer wg.Done()
+            found, err := probe(node, seed)
+            if err != nil {
+                return
+            }
+
+            mu.Lock()
+            peers = append(peers, found...)
+            mu.Unlock()
+        }(seed)
+    }
+    wg.Wait()
+
+    return peers, nil
+}
+
+// Send hello to the seed, returns the seed and peers it knows
+func probe(node *Node, seed string) ([]Peer, error) {
+    raddr, err := net.ResolveUDPAddr("udp4", seed)
+    if err != nil {
+        return nil, err
+    }
+
+    // not connected, welcome comes from another port
+    conn, err := net.ListenUDP("udp4", nil)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    // seed may be older than the node, though not older than join which version 1 lacks
+    load := encodeLoad(JoinDTO{
+        Peers: []PeerDTO{ NewPeerDTO(node.self()) },
+    }, idVersion)
+
+    _, err = conn.WriteToUDP(Marshall(&Message{
+        Version: idVersion,
+        Type: JOIN,
+        Operation: JOIN_OP_HELLO,
+        ReplyTo: *node.Name,
+        Length: uint16(len(load)),
+        Load: load,
+    }), raddr)
+    if err != nil {
+        return nil, err
+    }
+
+    conn.SetReadDeadline(time.Now().Add(browseWindow))
+    buf := make([]byte, 65536)
+    n, _, err := conn.ReadFromUDP(buf)
+    if err != nil {
+        return nil, err
+    }
+
+    m, err := Unmarshall(buf[:n])
+    if err != nil {
+        return nil, err
+    }
+
+    var dto JoinDTO
+    if err := DecodeLoad(m.Load, &dto); err != nil {
+        return nil, err
+    }
+
+    peers := make([]Peer, 0, len(dto.Peers))
+    for i, p := range dto.Peers {
+        peer := p.Peer(node.Domain)
+        if i == 0 {
+            // seed itself, reachable where it was probed
+            peer.AddrIPv4 = raddr.IP
+        }
+        peers = append(peers, peer)
+    }
+
+    return peers, nil
+}
+
+type seedFile struct {
+    path string
+    mu sync.Mutex
+    modTime time.Time
+    size int64
+    seeds []string
+}
+
+// Seeds from the file, read again only if it changed
+func (f *seedFile) read() ([]string, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    info, err := os.Stat(f.path)
+    if err != nil {
+        return nil, err
+    }
+
+    if f.seeds != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+        return f.seeds, nil
+    }
+
+    file, err := os.Open(f.path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    seeds := make([]string, 0)
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if len(line) == 0 || strings.HasPrefix(line, "#") {
+            continue
+        }
+        seeds = append(seeds, line)
+    }
+
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+
+    f.seeds, f.modTime, f.size = seeds, info.ModTime(), info.Size()
+    return seeds, nil
+}
+
+// Seeds from SRV records, targets are resolved to IPv4 addresses
+func lookupSeeds(resolver *net.Resolver, name string) ([]string, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), browseWindow)
+    defer cancel()
+
+    _, records, err := resolver.LookupSRV(ctx, "", "", name)
+    if err != nil {
+        return nil, err
+    }
+
+    seeds := make([]string, 0, len(records))
+    for _, srv := range records {
+        addrs, err := resolver.LookupIPAddr(ctx, srv.Target)
+        if err != nil {
+            continue
+        }
+
+        for _, addr := range addrs {
+            if ip := addr.IP.To4(); ip != nil {
+                seeds = append(seeds, fmt.Sprintf("%s:%d", ip, srv.Port))
+                break
+            }
+        }
+    }
+
+    return seeds, nil
+}
@@ -0,0 +1,156 @@
+package cluster
+
+import (
+    "context"
+    "encoding/binary"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestSeedDiscovery_Static(t *testing.T) {
+    node := NewNode("local.", "seeker")
+    group := "test"
+    node.Group = &group
+    node.Port = 9979
+
+    // one seed is enough to find the whole group
+    peers, err := NewStaticDiscovery([]string{ "127.0.0.1:9991" }).Browse(node)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    found := make(map[string]bool)
+    for _, p := range peers {
+        found[*p.Name] = true
+    }
+
+    for _, name := range []string{ "seeker", "node1", "node2", "node3", "node4", "node5" } {
+        if !found[name] {
+            t.Error("Peer was not discovered:", name)
+        }
+    }
+
+    // seed remembers who probed it
+    introduced := false
+    for _, p := range client1.Node.introductions() {
+        if *p.Name == "seeker" && p.Port == 9979 {
+            introduced = true
+        }
+    }
+
+    if !introduced {
+        t.Error("Seed did not remember probing node")
+    }
+}
+
+func TestSeedDiscovery_File(t *testing.T) {
+    dir, err := ioutil.TempDir("", "seeds")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    path := filepath.Join(dir, "peers")
+    if err := ioutil.WriteFile(path, []byte("# seeds\n127.0.0.1:1\n\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    f := &seedFile{ path: path }
+    seeds, err := f.read()
+    if err != nil || len(seeds) != 1 || seeds[0] != "127.0.0.1:1" {
+        t.Fatal("Cannot read seeds", seeds, err)
+    }
+
+    ioutil.WriteFile(path, []byte("127.0.0.1:1\n127.0.0.1:2\n"), 0644)
+    os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+
+    if seeds, _ := f.read(); len(seeds) != 2 {
+        t.Fatal("Changed file was not read again", seeds)
+    }
+}
+
+func TestSeedDiscovery_DNS(t *testing.T) {
+    conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    go serveStubDNS(conn)
+
+    resolver := &net.Resolver{
+        PreferGo: true,
+        Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+            var d net.Dialer
+            return d.DialContext(ctx, "udp4", conn.LocalAddr().String())
+        },
+    }
+
+    seeds, err := lookupSeeds(resolver, "_witnessd._udp.test.")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(seeds) != 2 || seeds[0] != "127.0.0.1:9991" || seeds[1] != "127.0.0.1:9992" {
+        t.Fatal("Unexpected seeds", seeds)
+    }
+}
+
+// Answers SRV queries with node1.test. and node2.test. and A queries with loopback address
+func serveStubDNS(conn net.PacketConn) {
+    buf := make([]byte, 512)
+    for {
+        n, addr, err := conn.ReadFrom(buf)
+        if err != nil {
+            return
+        }
+
+        // question name ends with zero label, followed by type and class
+        q := buf[:n]
+        end := 12
+        for q[end] != 0 {
+            end += int(q[end]) + 1
+        }
+        question := q[12:end + 5]
+        qtype := binary.BigEndian.Uint16(q[end + 1:])
+
+        answers := make([][]byte, 0)
+        switch qtype {
+        case 33:    // SRV
+            for i, target := range []string{ "node1.test.", "node2.test." } {
+                rdata := []byte{ 0, byte(i), 0, 1 }
+                rdata = append(rdata, byte((9991 + i) >> 8), byte(9991 + i))
+                rdata = append(rdata, dnsName(target)...)
+                answers = append(answers, dnsRecord(33, rdata))
+            }
+        case 1:     // A
+            answers = append(answers, dnsRecord(1, []byte{ 127, 0, 0, 1 }))
+        }
+
+        reply := []byte{ q[0], q[1], 0x81, 0x80, 0, 1, 0, byte(len(answers)), 0, 0, 0, 0 }
+        reply = append(reply, question...)
+        for _, a := range answers {
+            reply = append(reply, a...)
+        }
+        conn.WriteTo(reply, addr)
+    }
+}
+
+func dnsName(name string) []byte {
+    raw := make([]byte, 0)
+    for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+        raw = append(raw, byte(len(label)))
+        raw = append(raw, label...)
+    }
+    return append(raw, 0)
+}
+
+// Record for the name in question, pointed to by compression
+func dnsRecord(rtype uint16, rdata []byte) []byte {
+    record := []byte{ 0xC0, 12, byte(rtype >> 8), byte(rtype), 0, 1, 0, 0, 0, 60, byte(len(rdata) >> 8), byte(len(rdata)) }
+    return append(record, rdata...)
+}
@@ -1,8 +1,13 @@
 package cluster
 
 import (
+    "bufio"
+    "container/list"
+    "errors"
+    "io"
     "net"
     "log"
+    "sync"
 )
 
 type Request struct {
@@ -18,10 +23,50 @@ type Router interface {
     Route(*Request) (Handler, error)
 }
 
+// Routers tried in order of registration, safe for concurrent use
+type Registry struct {
+    mu sync.RWMutex
+    routers *list.List
+}
+
+func NewRegistry() *Registry {
+    return &Registry{
+        routers: list.New(),
+    }
+}
+
+func (reg *Registry) Add(r Router) *list.Element {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    return reg.routers.PushBack(r)
+}
+
+func (reg *Registry) Remove(e *list.Element) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    reg.routers.Remove(e)
+}
+
+// Route to the handler of first router that accepts request, makes Registry a Router
+func (reg *Registry) Route(r *Request) (h Handler, err error) {
+    reg.mu.RLock()
+    defer reg.mu.RUnlock()
+
+    for e := reg.routers.Front(); e != nil; e = e.Next() {
+        h, err := e.Value.(Router).Route(r)
+        if h != nil && err == nil {
+            return h, nil
+        }
+    }
+
+    return nil, errors.New("Not supported")
+}
+
 type Server struct {
     ipv4conn *net.UDPConn
     ipv6conn *net.UDPConn
-    shouldShutdown bool
+    listener net.Listener       // stream transport
+    done chan bool              // closed on shutdown
     router Router
 }
 
@@ -31,21 +76,34 @@ func NewServer(port int, r Router) *Server {
         log.Println(err)
     }
 
-    return &Server{
+    l, err := net.ListenTCP("tcp4", &net.TCPAddr{ Port: port })
+    if err != nil {
+        log.Println(err)
+    }
+
+    s := &Server{
         ipv4conn: l4,
         ipv6conn: nil,
-        shouldShutdown: false,
+        done: make(chan bool),
         router: r,
     }
+
+    // keep interface nil if listening failed
+    if l != nil {
+        s.listener = l
+    }
+
+    return s
 }
 
 func (s *Server) Start() {
     go s.serve(s.ipv4conn)    
     go s.serve(s.ipv6conn)    
+    go s.accept()
 }
 
 func (s *Server) Shutdown() {
-    s.shouldShutdown = true
+    close(s.done)
 
     if s.ipv6conn != nil {
         s.ipv6conn.Close()
@@ -54,6 +112,19 @@ func (s *Server) Shutdown() {
     if s.ipv4conn != nil {
         s.ipv4conn.Close()
     }
+
+    if s.listener != nil {
+        s.listener.Close()
+    }
+}
+
+func (s *Server) isShutdown() bool {
+    select {
+    case <- s.done:
+        return true
+    default:
+        return false
+    }
 }
 
 func (s *Server) serve(c *net.UDPConn) {
@@ -66,30 +137,82 @@ func (s *Server) serve(c *net.UDPConn) {
     for {
         n, from, err := c.ReadFromUDP(buf)
         if err != nil {
-             log.Println(err)
-             continue
+            if s.isShutdown() {
+                return
+            }
+            log.Println(err)
+            continue
         }
 
-        m, err := Unmarshall(buf[:n])
+        // message refers to the packet, which outlives the next read when handed over to activities
+        packet := make([]byte, n)
+        copy(packet, buf[:n])
+
+        m, err := Unmarshall(packet)
         if err != nil {
             log.Println(err)
             continue
         }
 
-        r := &Request{
+        s.dispatch(&Request{
             From: from,
             Message: m,
-        }
+        })
+    }
+}
+
+func (s *Server) accept() {
+    if s.listener == nil {
+        return
+    }
 
-        h, err := s.router.Route(r)
+    for {
+        conn, err := s.listener.Accept()
         if err != nil {
+            if s.isShutdown() {
+                return
+            }
             log.Println(err)
             continue
         }
 
-        err = h.Handle(r)
+        go s.serveStream(conn)
+    }
+}
+
+// Handle frames coming over the connection until it is closed
+func (s *Server) serveStream(conn net.Conn) {
+    defer conn.Close()
+
+    tcpFrom := conn.RemoteAddr().(*net.TCPAddr)
+    from := &net.UDPAddr{ IP: tcpFrom.IP, Port: tcpFrom.Port }
+
+    r := bufio.NewReader(conn)
+    for {
+        m, err := ReadFrame(r)
         if err != nil {
-            log.Println(err)
+            if err != io.EOF && !s.isShutdown() {
+                log.Println(err)
+            }
+            return
         }
+
+        s.dispatch(&Request{
+            From: from,
+            Message: m,
+        })
+    }
+}
+
+func (s *Server) dispatch(r *Request) {
+    h, err := s.router.Route(r)
+    if err != nil {
+        log.Println(err)
+        return
+    }
+
+    err = h.Handle(r)
+    if err != nil {
+        log.Println(err)
     }
 }
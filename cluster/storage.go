@@ -1,25 +1,115 @@
 package cluster
 
+import (
+    "bytes"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Versions past their deadline are given out as tombstones, see ttl.go
 type Storage interface {
-    Get([]byte) ([]byte, bool)
-    Put([]byte, []byte)
+    Get([]byte) (*Version, bool)
+    // Writes fail only if they could not be made durable, see DiskStorage
+    Put([]byte, *Version) error
+    Delete([]byte) error
+    // Calls function for every stored key and version until it returns false,
+    // storage must not be modified from within the function
+    ForEach(func([]byte, *Version) bool)
+    // Same as ForEach, but in key order starting from the given key
+    Scan([]byte, func([]byte, *Version) bool)
+    // Rewrites expired values as tombstones, returns number of rewritten ones
+    Expire() int
+    Close() error
 }
 
 type InMemoryStorage struct {
-    data map[string][]byte
+    mu sync.RWMutex
+    data map[string]*Version
 }
 
 func NewInMemoryStorage() Storage {
     return &InMemoryStorage{
-        data: make(map[string][]byte, 10),
+        data: make(map[string]*Version, 10),
     }
 }
 
-func (m *InMemoryStorage) Get(key []byte) ([]byte, bool) {
+func (m *InMemoryStorage) Get(key []byte) (*Version, bool) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
     v, ok := m.data[string(key)]
-    return v, ok
+    if !ok {
+        return nil, false
+    }
+    return live(v, time.Now()), true
 }
 
-func (m *InMemoryStorage) Put(key, value []byte) {
+func (m *InMemoryStorage) Put(key []byte, value *Version) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
     m.data[string(key)] = value
+    return nil
+}
+
+func (m *InMemoryStorage) Delete(key []byte) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    delete(m.data, string(key))
+    return nil
+}
+
+func (m *InMemoryStorage) ForEach(f func([]byte, *Version) bool) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    now := time.Now()
+    for k, v := range m.data {
+        if !f([]byte(k), live(v, now)) {
+            return
+        }
+    }
+}
+
+func (m *InMemoryStorage) Scan(from []byte, f func([]byte, *Version) bool) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    now := time.Now()
+    keys := make([]string, 0, len(m.data))
+    for k := range m.data {
+        keys = append(keys, k)
+    }
+    for _, k := range sortedFrom(keys, from) {
+        if !f([]byte(k), live(m.data[k], now)) {
+            return
+        }
+    }
+}
+
+// Keys from the given one on, in order
+func sortedFrom(keys []string, from []byte) []string {
+    selected := make([]string, 0, len(keys))
+    for _, k := range keys {
+        if bytes.Compare([]byte(k), from) >= 0 {
+            selected = append(selected, k)
+        }
+    }
+    sort.Strings(selected)
+    return selected
+}
+
+func (m *InMemoryStorage) Expire() int {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    now := time.Now()
+    expired := 0
+    for k, v := range m.data {
+        if v.expiredBy(now) {
+            m.data[k] = live(v, now)
+            expired++
+        }
+    }
+    return expired
+}
+
+func (m *InMemoryStorage) Close() error {
+    return nil
 }
@@ -4,10 +4,10 @@ import (
     "errors"
     "log"
     "fmt"
-    "encoding/gob"
     "github.com/noroutine/witnessd/fsa"
     "github.com/reusee/mmh3"
-    "bytes"
+    "sync"
+    "time"
 )
 
 const (
@@ -22,15 +22,47 @@ const (
     STORE_PARTIAL_SUCCESS
     STORE_FAILURE
     STORE_ERROR
+    STORE_RCVD_REJECT
+    STORE_FENCED
+    STORE_PRECONDITION_FAILED
 )
 
+// Deletes use the same operations with DELETE message type, carrying a tombstone
 const (
     STORE_OP_PUT byte = iota
     STORE_OP_ACK
+    STORE_OP_REJECT             // fencing token is stale
+    STORE_OP_PUT_IF             // conditional write, see cas.go
+    STORE_OP_NACK               // precondition failed
 )
 type StoreDTO struct {
     Key []byte
     Value []byte
+    Clock VectorClock
+    Timestamp int64
+    Deleted bool
+    Expires int64
+}
+
+func NewStoreDTO(key []byte, v *Version) StoreDTO {
+    return StoreDTO{
+        Key: key,
+        Value: v.Value,
+        Clock: v.Clock,
+        Timestamp: v.Timestamp,
+        Deleted: v.Deleted,
+        Expires: v.Expires,
+    }
+}
+
+func (dto *StoreDTO) Version() *Version {
+    return &Version{
+        Value: dto.Value,
+        Clock: dto.Clock,
+        Timestamp: dto.Timestamp,
+        Deleted: dto.Deleted,
+        Expires: dto.Expires,
+    }
 }
 
 type BucketStoreActivity struct {
@@ -44,7 +76,7 @@ func NewBucketStoreActivity(c *Cluster) *BucketStoreActivity {
 }
 
 func (a *BucketStoreActivity) Route(r *Request) (h Handler, err error) {
-    if r.Message.Type == STORE && r.Message.Operation == STORE_OP_PUT {
+    if (r.Message.Type == STORE || r.Message.Type == DELETE) && r.Message.Operation == STORE_OP_PUT {
         return a, nil
     }
 
@@ -54,112 +86,199 @@ func (a *BucketStoreActivity) Route(r *Request) (h Handler, err error) {
 func (a *BucketStoreActivity) Handle(r *Request) error {
 
     peer := string(r.Message.ReplyTo)
-    ackAddr, err := a.c.GetPeerAddr(peer)
-    if err != nil {
+    if _, err := a.c.GetPeerAddr(peer); err != nil {
         return errors.New(fmt.Sprintf("Cannot ack request from %s", peer))
     }
 
-    raw := bytes.NewBuffer(r.Message.Load)
-    dec := gob.NewDecoder(raw)
     var dto StoreDTO
-    err = dec.Decode(&dto)
-    if err != nil {
-        log.Fatal("Decode error: ", err)
+    if err := DecodeLoad(r.Message.Load, &dto); err != nil {
+        return err
     }
 
-    a.c.storage.Put(dto.Key, dto.Value)
+    if token, ok := fencingToken(r.Message); ok {
+        // voters are asked over the network, server shall not wait for them
+        go func() {
+            switch err := a.c.leader.ConfirmFencingToken(token); err {
+            case nil:
+                if err := a.store(r, dto); err != nil {
+                    log.Println(err)
+                }
+            case ErrFenced:
+                log.Printf("Rejected %s from %s with fencing token %d", dto.Key, peer, token)
+                a.c.Reply(r, &Message{
+                    Version: ProtocolVersion,
+                    Type: r.Message.Type,
+                    Operation: STORE_OP_REJECT,
+                    ReplyTo: *a.c.proxy.Name,
+                    Length: 0,
+                })
+            default:
+                // not acked, coordinator counts the replica as failed
+                log.Printf("Cannot check fencing token of %s from %s: %v", dto.Key, peer, err)
+            }
+        }()
+        return nil
+    }
+
+    return a.store(r, dto)
+}
+
+// Apply the write and ack it
+func (a *BucketStoreActivity) store(r *Request, dto StoreDTO) error {
+    peer := string(r.Message.ReplyTo)
+    version := dto.Version()
+    if r.Message.Type == DELETE {
+        version.Deleted = true
+    }
+    if _, err := a.c.apply(dto.Key, version); err != nil {
+        // no ack, coordinator counts the replica as failed
+        log.Printf("Cannot store %s from %s: %v", dto.Key, peer, err)
+        return err
+    }
 
     //log.Printf("Got %d bytes of data to store, sending ack to %s", r.Message.Length, peer)
 
-    go a.c.Send(ackAddr, &Message{
-        Version: 1,
-        Type: STORE,
+    return a.c.Reply(r, &Message{
+        Version: ProtocolVersion,
+        Type: r.Message.Type,
         Operation: STORE_OP_ACK,
         ReplyTo: *a.c.proxy.Name,
         Length: 0,
     })
-
-    return nil
 }
 
 type StoreActivity struct {
     c *Cluster
+    kind OperationType          // STORE or DELETE
     level ConsistencyLevel
     fsa *fsa.FSA
     acks int
+    mu sync.Mutex
+    pending map[string]bool     // replicas that did not ack yet
+    acked int
+    id uint64                   // activity id, set once registered
+    token uint64                // fencing token, zero if not fenced
     Result chan int
 }
 
+const storeTimeout = 1000 * time.Millisecond
+
 func NewStoreActivity(c *Cluster, level ConsistencyLevel) *StoreActivity {
     return &StoreActivity{
         Result: make(chan int, 1),
         level: level,
         acks: c.Copies(level),
+        pending: make(map[string]bool),
         c: c,
+        kind: STORE,
         fsa: nil,
     }
 }
 
-func (a *StoreActivity) Route(r *Request) (h Handler, err error)  {
-    if r.Message.Type == STORE && r.Message.Operation == 1 {
-        return a, nil
-    }
-
-    return nil, errors.New("Cannot handle this")
+// Same as store activity, but sends tombstones as DELETE messages
+func NewDeleteActivity(c *Cluster, level ConsistencyLevel) *StoreActivity {
+    a := NewStoreActivity(c, level)
+    a.kind = DELETE
+    return a
 }
 
 func (a *StoreActivity) Handle(r *Request) error {
     //log.Println("Received ACK from ", r.Message.ReplyTo)
-    go a.fsa.Send(STORE_RCVD_ACK)
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    // count every replica once and ignore acks that come too late
+    if a.pending[r.Message.ReplyTo] {
+        delete(a.pending, r.Message.ReplyTo)
+        if r.Message.Operation == STORE_OP_REJECT {
+            go a.fsa.Send(STORE_RCVD_REJECT)
+            return nil
+        }
+
+        a.acked++
+        go a.fsa.Send(STORE_RCVD_ACK)
+    }
     return nil
 }
 
-func (a *StoreActivity) Run(key, data []byte) {
+// Keep hints for replicas that did not ack, returns number of replicas that did
+func (a *StoreActivity) giveUp(key []byte, version *Version) int {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    if a.acked > 0 {
+        for peer := range a.pending {
+            a.c.Hints.Add(peer, key, version)
+        }
+    }
+    a.pending = make(map[string]bool)
+
+    return a.acked
+}
+
+func (a *StoreActivity) Run(key []byte, version *Version) {
+    timeoutFunc := func(state int) (<-chan time.Time, func(int) int) {
+        if state == STORE_WAIT_ACK {
+            return time.After(storeTimeout), func(s int) int {
+                if a.giveUp(key, version) > 0 {
+                    go a.fsa.Send(STORE_PARTIAL_ACK)
+                    return STORE_PARTIAL_ACK
+                }
+
+                go a.fsa.Send(STORE_NO_ACK)
+                return STORE_NO_ACK
+            }
+        }
+
+        return fsa.NeverTimesOut()(state)
+    }
+
     a.fsa = fsa.New(func(state, input int) int {
         switch{
         case state == STORE_START && input == STORE_START:
             go a.fsa.Send(STORE_SEND)
             return STORE_SEND
         case state == STORE_SEND && input == STORE_SEND:
-
-            raw := new(bytes.Buffer)
-            enc := gob.NewEncoder(raw)
-            err := enc.Encode(StoreDTO {
-                Key: key,
-                Value: data,
-            })
-
-            if err != nil {
-                panic(fmt.Sprintf("Can't encode data for transfer: %v", err))
-            }
-
-            if raw.Len() > MaxLoadLength {
-                panic("Load is too big")
-            }
+            load := EncodeLoad(NewStoreDTO(key, version))
 
             // send store command to primary and secondary nodes
             m := &Message{
-                Version: 1,
-                Type: STORE,
+                Version: ProtocolVersion,
+                Type: a.kind,
                 Operation: STORE_OP_PUT,
                 ReplyTo: *a.c.proxy.Name,
-                Length: uint16(raw.Len()),
-                Load: raw.Bytes(),
+                Length: uint16(len(load)),
+                Load: load,
+            }
+            if a.token > 0 {
+                fence(m, a.token)
             }
 
             nodes := a.c.HashNodes(mmh3.Sum128(key), a.level)
 
             a.acks = len(nodes)
 
+            a.mu.Lock()
+            defer a.mu.Unlock()
+
+            sent := 0
             for _, node := range nodes {
+                a.pending[*node.Name] = true
+
                 addr, err := a.c.GetPeerAddr(*node.Name)
                 if err != nil {
+                    // replica will get a hint if others ack
                     log.Println("Cannot contact peer", *node.Name)
-                    a.Result <- STORE_ERROR
-                    return STORE_ERROR
+                    continue
                 }
 
-                go a.c.Send(addr, m)
+                a.c.exchange.Request(addr, m, a.id)
+                sent++
+            }
+
+            if sent == 0 {
+                a.Result <- STORE_ERROR
+                return STORE_ERROR
             }
 
             return STORE_WAIT_ACK
@@ -171,6 +290,13 @@ func (a *StoreActivity) Run(key, data []byte) {
             } else {
                 return STORE_WAIT_ACK
             }
+        case state == STORE_WAIT_ACK && input == STORE_RCVD_REJECT:
+            // writer is deposed, replicas that did not ack get no hints
+            a.mu.Lock()
+            a.pending = make(map[string]bool)
+            a.mu.Unlock()
+            a.Result <- STORE_FENCED
+            return STORE_FENCED
         case state == STORE_NO_ACK:
             a.Result <- STORE_FAILURE
             return STORE_FAILURE
@@ -184,7 +310,7 @@ func (a *StoreActivity) Run(key, data []byte) {
         log.Println("Invalid automat")
         a.Result <- STORE_ERROR
         return STORE_ERROR
-    }, fsa.TerminatesOn(STORE_SUCCESS, STORE_PARTIAL_SUCCESS, STORE_FAILURE), fsa.NeverTimesOut())
+    }, fsa.TerminatesOn(STORE_SUCCESS, STORE_PARTIAL_SUCCESS, STORE_FAILURE, STORE_FENCED), timeoutFunc)
 
     go a.fsa.Send(STORE_START)
 }
\ No newline at end of file
@@ -0,0 +1,79 @@
+package cluster
+
+import (
+    "errors"
+    "net"
+    "testing"
+    "time"
+)
+
+// Cluster of a node that is not connected, with one peer listening on returned socket
+func standaloneCluster(t *testing.T, storage Storage, peer string, text ...string) (*Cluster, *net.UDPConn) {
+    conn, err := net.ListenUDP("udp4", &net.UDPAddr{ IP: net.IPv4(127, 0, 0, 1) })
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+
+    node := NewNode("local.", "standalone")
+    group := "standalone"
+    node.Group = &group
+    node.announced = true
+
+    addr := conn.LocalAddr().(*net.UDPAddr)
+    node.publish(map[string]Member{
+        peer: Member{
+            Peer: Peer{ Name: &peer, Group: &group, Partitions: 1, Port: addr.Port, AddrIPv4: addr.IP, Text: text },
+            Status: MemberAlive,
+        },
+    }, map[string]Data{})
+
+    c, err := NewVia(node, 1, storage)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return c, conn
+}
+
+type failingStorage struct {
+    Storage
+}
+
+func (s failingStorage) Put([]byte, *Version) error {
+    return errors.New("Disk is full")
+}
+
+func TestStore_FailedWriteNotAcked(t *testing.T) {
+    c, conn := standaloneCluster(t, failingStorage{ NewInMemoryStorage() }, "node-b", "partitions=1")
+
+    load := EncodeLoad(NewStoreDTO([]byte("k"), c.newVersion([]byte("v"), nil)))
+    r := &Request{
+        From: conn.LocalAddr().(*net.UDPAddr),
+        Message: &Message{
+            Version: ProtocolVersion,
+            Type: STORE,
+            Operation: STORE_OP_PUT,
+            RequestId: 1,
+            ActivityId: 1,
+            ReplyTo: "node-b",
+            Length: uint16(len(load)),
+            Load: load,
+        },
+    }
+
+    h, err := c.Route(r)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := h.Handle(r); err == nil {
+        t.Error("Failed write shall be reported")
+    }
+
+    conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+    if _, _, err := conn.ReadFromUDP(make([]byte, MaxDatagramSize)); err == nil {
+        t.Error("Failed write shall not be acked")
+    }
+    if _, ok := c.storage.Get([]byte("k")); ok {
+        t.Error("Failed write shall not be stored")
+    }
+}
@@ -0,0 +1,88 @@
+// Stream transport for cluster messages that do not fit into a datagram
+package cluster
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "io"
+    "log"
+    "net"
+    "time"
+)
+
+/*
+Peers accept TCP connections on the same port they receive datagrams on. Every
+message is sent as a frame:
+
+    length      uint32      length of marshalled message, big endian
+    message     []byte      header and load, Length field of header is ignored
+
+Connection may carry any number of frames
+ */
+
+const streamDialTimeout = 1000 * time.Millisecond
+const streamWriteTimeout = 10 * time.Second
+
+type TcpClient struct {
+    conn net.Conn
+}
+
+func NewTcpClient(raddr *net.UDPAddr) (*TcpClient, error) {
+    c, err := net.DialTimeout("tcp4", (&net.TCPAddr{ IP: raddr.IP, Port: raddr.Port }).String(), streamDialTimeout)
+
+    if err != nil {
+        log.Println("Cannot connect to", raddr)
+        return nil, err
+    }
+
+    return &TcpClient{
+        conn: c,
+    }, nil
+}
+
+func (c *TcpClient) Send(m *Message) error {
+    c.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+    err := WriteFrame(c.conn, m)
+    if err != nil {
+        log.Println("error writing message", err)
+    }
+    return err
+}
+
+func (c *TcpClient) Close() {
+    c.conn.Close()
+}
+
+func WriteFrame(w io.Writer, m *Message) error {
+    raw := MarshallStream(m)
+
+    buf := bufio.NewWriter(w)
+    if err := binary.Write(buf, binary.BigEndian, uint32(len(raw))); err != nil {
+        return err
+    }
+
+    if _, err := buf.Write(raw); err != nil {
+        return err
+    }
+
+    return buf.Flush()
+}
+
+func ReadFrame(r io.Reader) (*Message, error) {
+    var l uint32
+    if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+        return nil, err
+    }
+
+    if l > HeaderSize + MaxStreamLoadLength {
+        return nil, errors.New("Frame is too big")
+    }
+
+    raw := make([]byte, l)
+    if _, err := io.ReadFull(r, raw); err != nil {
+        return nil, err
+    }
+
+    return Unmarshall(raw)
+}
@@ -0,0 +1,50 @@
+package cluster
+
+import (
+    "bytes"
+    "testing"
+)
+
+func TestTcpClient_Frame(t *testing.T) {
+    m := &Message{
+        Version: 1,
+        Type: STORE,
+        ReplyTo: "me",
+        Load: bytes.Repeat([]byte{ 7 }, 2 * MaxLoadLength),
+    }
+
+    if FitsDatagram(m) {
+        t.Fatal("Message shall not fit into datagram")
+    }
+
+    var buf bytes.Buffer
+    if err := WriteFrame(&buf, m); err != nil {
+        t.Fatal(err)
+    }
+
+    m1, err := ReadFrame(&buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if m1.ReplyTo != m.ReplyTo || !bytes.Equal(m1.Load, m.Load) {
+        t.Error("Frame was not read back as written")
+    }
+}
+
+func TestTcpClient_LargeValue(t *testing.T) {
+    key := []byte("large")
+    value := make([]byte, 4 * 1024 * 1024)
+    for i := range value {
+        value[i] = byte(i % 251)
+    }
+
+    if result := client1.Store(key, value, ConsistencyLevelTwo); result != STORE_SUCCESS {
+        t.Fatal("Cannot store large value", result)
+    }
+
+    data, result := client3.Load(key, ConsistencyLevelTwo)
+    if result != LOAD_SUCCESS || !bytes.Equal(data, value) {
+        t.Fatal("Cannot load large value", result, len(data))
+    }
+}
@@ -0,0 +1,98 @@
+// Purging tombstones of deleted keys
+package cluster
+
+import (
+    "log"
+    "time"
+)
+
+/*
+Deleted keys are kept as tombstones, so that replicas which missed the delete
+do not bring the value back with read repair, hints or anti-entropy. Once the
+tombstone is older than the grace period every replica is expected to have
+seen it and it is dropped from local storage. A replica that stays away for
+longer than the grace period may resurrect the value. Collector also turns
+values past their deadline into tombstones, see ttl.go
+ */
+
+const DefaultTombstoneGracePeriod = 24 * time.Hour
+const tombstoneCollectInterval = 1 * time.Minute
+
+type TombstoneCollector struct {
+    c *Cluster
+    quit chan int
+}
+
+func NewTombstoneCollector(c *Cluster) *TombstoneCollector {
+    return &TombstoneCollector{
+        c: c,
+        quit: nil,
+    }
+}
+
+// Tombstone is past grace period
+func (c *Cluster) expired(v *Version) bool {
+    return v.Deleted && time.Since(time.Unix(0, v.Timestamp)) > c.TombstoneGracePeriod
+}
+
+// Drop expired tombstones from local storage, returns number of dropped ones
+func (t *TombstoneCollector) Collect() int {
+    if expired := t.c.storage.Expire(); expired > 0 {
+        log.Printf("Expired %d values", expired)
+    }
+
+    keys := make([][]byte, 0)
+    t.c.storage.ForEach(func(key []byte, version *Version) bool {
+        if t.c.expired(version) {
+            keys = append(keys, append([]byte{}, key...))
+        }
+        return true
+    })
+
+    collected := 0
+    for _, key := range keys {
+        t.c.applyMu.Lock()
+        // key may have been written again in the meanwhile
+        if version, ok := t.c.storage.Get(key); ok && t.c.expired(version) {
+            if err := t.c.storage.Delete(key); err != nil {
+                log.Println("Cannot purge tombstone:", err)
+            } else {
+                collected++
+            }
+        }
+        t.c.applyMu.Unlock()
+    }
+
+    if collected > 0 {
+        log.Printf("Purged %d tombstones", collected)
+    }
+
+    return collected
+}
+
+// Launches periodic collection in background
+func (t *TombstoneCollector) Start() {
+    if t.quit == nil {
+        t.quit = make(chan int, 1)
+        go func(quit chan int) {
+            ticker := time.NewTicker(tombstoneCollectInterval)
+            defer ticker.Stop()
+            for {
+                select {
+                case <- ticker.C:
+                    t.Collect()
+                case <- quit:
+                    return
+                }
+            }
+        }(t.quit)
+    }
+}
+
+// Stops periodic collection
+func (t *TombstoneCollector) Stop() {
+    if t.quit != nil {
+        t.quit <- 1
+        t.quit = nil
+    }
+}
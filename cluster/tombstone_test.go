@@ -0,0 +1,61 @@
+package cluster
+
+import (
+    "testing"
+    "github.com/reusee/mmh3"
+)
+
+func TestTombstone_Delete(t *testing.T) {
+    key := []byte("deleted")
+
+    if client1.Store(key, []byte("value"), ConsistencyLevelTwo) != STORE_SUCCESS {
+        t.Fatal("Cannot store the key")
+    }
+
+    if client2.Delete(key, ConsistencyLevelTwo) != STORE_SUCCESS {
+        t.Fatal("Cannot delete the key")
+    }
+
+    if _, result := client3.Load(key, ConsistencyLevelTwo); result != LOAD_FAILURE {
+        t.Fatal("Deleted key shall not load", result)
+    }
+
+    // replicas keep the tombstone, not the value
+    owners := client1.KeyNodes(mmh3.Sum128(key), ConsistencyLevelTwo)
+    for _, client := range []*Client{ client1, client2, client3, client4, client5 } {
+        if !containsPeer(owners, client.GetName()) {
+            continue
+        }
+
+        if v, ok := client.Cluster.storage.Get(key); !ok || !v.Deleted {
+            t.Error("No tombstone on replica", client.GetName())
+        }
+    }
+}
+
+func TestTombstone_Collect(t *testing.T) {
+    c := client1.Cluster
+    key := []byte("purged")
+
+    tombstone := c.newVersion(nil, nil)
+    tombstone.Deleted = true
+    c.storage.Put(key, tombstone)
+
+    if c.collector.Collect() != 0 {
+        t.Fatal("Tombstone shall be kept during grace period")
+    }
+
+    grace := c.TombstoneGracePeriod
+    c.TombstoneGracePeriod = 0
+    defer func() { c.TombstoneGracePeriod = grace }()
+
+    c.collector.Collect()
+    if _, ok := c.storage.Get(key); ok {
+        t.Fatal("Expired tombstone shall be purged")
+    }
+
+    // expired tombstone coming from another replica is not taken back
+    if changed, _ := c.apply(key, tombstone); changed {
+        t.Fatal("Expired tombstone shall not be stored again")
+    }
+}
@@ -0,0 +1,49 @@
+// Expiring values
+package cluster
+
+import (
+    "time"
+)
+
+/*
+Value can be stored with time-to-live. The writer turns it into a deadline in
+wall clock, which travels with the version to every replica, so replicas agree
+on when the value is gone however late they got it. Past the deadline storage
+gives the version out as a tombstone written at the deadline, with the same
+clock. So expired key loads as deleted everywhere, replicas that missed the
+write are repaired with the tombstone rather than bringing older values back,
+and the tombstone is purged after grace period like any other.
+
+Storage expires values lazily whenever they are read, and Expire rewrites
+expired ones as tombstones, which tombstone collector calls periodically.
+Replicas shall keep their clocks close, a node that is ahead expires values
+earlier than the rest
+ */
+
+// Value is past its deadline
+func (v *Version) expiredBy(now time.Time) bool {
+    return v.Expires > 0 && !v.Deleted && now.UnixNano() >= v.Expires
+}
+
+// Version as storage gives it out at the moment
+func live(v *Version, now time.Time) *Version {
+    if !v.expiredBy(now) {
+        return v
+    }
+
+    return &Version{
+        Clock: v.Clock,
+        Timestamp: v.Expires,
+        Deleted: true,
+    }
+}
+
+// Store the value that is gone after ttl, zero ttl keeps it forever
+func (c *Cluster) StoreTTL(key, data []byte, ttl time.Duration, level ConsistencyLevel) int {
+    version := c.newVersion(data, nil)
+    if ttl > 0 {
+        version.Expires = version.Timestamp + int64(ttl)
+    }
+
+    return c.store(key, version, c.AdjustedConsistencyLevel(level), 0)
+}
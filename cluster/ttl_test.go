@@ -0,0 +1,77 @@
+package cluster
+
+import (
+    "testing"
+    "time"
+)
+
+func TestTTL_Encoding(t *testing.T) {
+    v := &Version{ Value: []byte("value"), Clock: VectorClock{ "node1": 1 }, Timestamp: 10, Expires: 20 }
+
+    decoded, err := DecodeVersion(EncodeVersion(v))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if decoded.Expires != 20 || decoded.Timestamp != 10 || string(decoded.Value) != "value" {
+        t.Error("Decoded version differs from encoded one", decoded)
+    }
+}
+
+func TestTTL_Storage(t *testing.T) {
+    disk, err := NewDiskStorage(t.TempDir(), SyncNever)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer disk.Close()
+
+    past := time.Now().Add(-time.Second).UnixNano()
+    future := time.Now().Add(time.Hour).UnixNano()
+
+    for _, s := range []Storage{ NewInMemoryStorage(), disk } {
+        s.Put([]byte("gone"), &Version{ Value: []byte("1"), Clock: VectorClock{ "a": 1 }, Expires: past })
+        s.Put([]byte("kept"), &Version{ Value: []byte("2"), Clock: VectorClock{ "a": 2 }, Expires: future })
+
+        // expired value reads as tombstone written at the deadline
+        v, ok := s.Get([]byte("gone"))
+        if !ok || !v.Deleted || v.Timestamp != past || v.Clock.Compare(VectorClock{ "a": 1 }) != ClockEqual {
+            t.Fatal("Expired value shall read as tombstone", v)
+        }
+
+        if v, ok := s.Get([]byte("kept")); !ok || v.Deleted || string(v.Value) != "2" {
+            t.Fatal("Value shall be kept until deadline", v)
+        }
+
+        if expired := s.Expire(); expired != 1 {
+            t.Fatal("Unexpected number of expired values", expired)
+        }
+        if expired := s.Expire(); expired != 0 {
+            t.Fatal("Value shall only expire once", expired)
+        }
+    }
+}
+
+func TestTTL_Store(t *testing.T) {
+    key := []byte("expiring")
+
+    if result := client1.StoreTTL(key, []byte("value"), 500 * time.Millisecond, ConsistencyLevelTwo); result != STORE_SUCCESS {
+        t.Fatal("Cannot store", result)
+    }
+
+    if data, result := client2.Load(key, ConsistencyLevelTwo); result != LOAD_SUCCESS || string(data) != "value" {
+        t.Fatal("Value shall load before deadline", result)
+    }
+
+    time.Sleep(600 * time.Millisecond)
+
+    if _, result := client3.Load(key, ConsistencyLevelTwo); result != LOAD_FAILURE {
+        t.Fatal("Expired value shall not load", result)
+    }
+
+    // written again it stays
+    if result := client1.Store(key, []byte("again"), ConsistencyLevelTwo); result != STORE_SUCCESS {
+        t.Fatal("Cannot store", result)
+    }
+    if data, _ := client4.Load(key, ConsistencyLevelTwo); string(data) != "again" {
+        t.Fatal("Unexpected value", string(data))
+    }
+}
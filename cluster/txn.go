@@ -0,0 +1,621 @@
+// Atomic transactions over many keys
+package cluster
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+    "github.com/reusee/mmh3"
+)
+
+/*
+Transaction writes keys owned by different replicas all or none, with
+two-phase commit coordinated by the node that runs it:
+
+    C -> P   TXN_OP_PREPARE    writes and checks of keys the participant owns
+    P -> C   TXN_OP_VOTE_YES   prepare is logged and keys are locked, or TXN_OP_VOTE_NO
+    C -> P   TXN_OP_COMMIT     once every participant voted yes and decision is logged,
+                               TXN_OP_ABORT otherwise
+    P -> C   TXN_OP_ACK        writes are applied or dropped, keys are unlocked
+
+Participant votes no if some key is locked by another transaction or some check
+does not hold against its copy of the key. Prepared participant that does not
+hear of the decision for a while asks the coordinator:
+
+    P -> C   TXN_OP_QUERY      answered with TXN_OP_COMMIT or TXN_OP_ABORT
+
+Coordinator only logs decisions to commit, so transaction it has no record of
+is aborted, unless it is still collecting votes. Logged decisions are sent
+until every participant acknowledged them, after restart as well, and prepared
+participants restore their locks and keep asking. Participant that cannot
+apply or log the writes does not acknowledge and stays prepared until the
+decision is sent again. Participant stays in doubt while coordinator is away. Locks keep transactions apart only, plain writes to
+locked keys go through
+ */
+
+const (
+    TXN_OP_PREPARE byte = iota
+    TXN_OP_VOTE_YES
+    TXN_OP_VOTE_NO
+    TXN_OP_COMMIT
+    TXN_OP_ABORT
+    TXN_OP_ACK
+    TXN_OP_QUERY
+)
+
+// Reasons to vote no
+const (
+    txnVoteConflict byte = iota
+    txnVotePrecondition
+    txnVoteFailure
+)
+
+const txnTimeout = requestLifetime
+const txnRecoverInterval = 5 * time.Second
+const txnInDoubtAfter = 2 * requestLifetime
+
+var ErrTxnConflict = errors.New("Keys are locked by another transaction")
+var ErrTxnPrecondition = errors.New("Transaction precondition does not hold")
+var ErrTxnAborted = errors.New("Transaction aborted")
+
+type TxnCheck struct {
+    Key []byte
+    If Precondition
+}
+
+type TxnDTO struct {
+    Id string
+    Coordinator string
+    Writes []StoreDTO
+    Checks []TxnCheck
+}
+
+type TxnVoteDTO struct {
+    Reason byte
+}
+
+// Writes and checks of a transaction, nothing happens until Commit
+type Txn struct {
+    c *Cluster
+    writes []txnWrite
+    checks []TxnCheck
+}
+
+type txnWrite struct {
+    key []byte
+    value []byte
+    deleted bool
+}
+
+type preparedTxn struct {
+    record TxnRecord
+    at time.Time                // zero if restored from log
+}
+
+type decidedTxn struct {
+    record TxnRecord
+    acked map[string]bool
+}
+
+type TxnActivity struct {
+    c *Cluster
+    mu sync.Mutex
+    log TxnLog
+    lastId uint64
+    locks map[string]string                 // transaction holding the key
+    prepared map[string]*preparedTxn        // as participant, by transaction id
+    decided map[string]*decidedTxn          // as coordinator, commits not acknowledged by everyone
+    running map[string]bool                 // as coordinator, collecting votes
+    quit chan int
+}
+
+func NewTxnActivity(c *Cluster) *TxnActivity {
+    return &TxnActivity{
+        c: c,
+        log: NewInMemoryTxnLog(),
+        lastId: uint64(time.Now().UnixNano()),
+        locks: make(map[string]string),
+        prepared: make(map[string]*preparedTxn),
+        decided: make(map[string]*decidedTxn),
+        running: make(map[string]bool),
+        quit: nil,
+    }
+}
+
+func (c *Cluster) Txn() *Txn {
+    return &Txn{
+        c: c,
+    }
+}
+
+// Store the value on commit
+func (t *Txn) Put(key, value []byte) *Txn {
+    t.writes = append(t.writes, txnWrite{ key: key, value: value })
+    return t
+}
+
+// Delete the key on commit
+func (t *Txn) Delete(key []byte) *Txn {
+    t.writes = append(t.writes, txnWrite{ key: key, deleted: true })
+    return t
+}
+
+// Commit only if the precondition holds for the key on every replica
+func (t *Txn) If(key []byte, cond Precondition) *Txn {
+    t.checks = append(t.checks, TxnCheck{ Key: key, If: cond })
+    return t
+}
+
+// Apply all writes or none, ErrTxnConflict and ErrTxnPrecondition tell why transaction did not commit
+func (t *Txn) Commit(level ConsistencyLevel) error {
+    return t.c.txns.commit(t, t.c.AdjustedConsistencyLevel(level))
+}
+
+// Replace the transaction log and recover transactions left unfinished in it,
+// shall be set before any transaction runs
+func (a *TxnActivity) SetLog(l TxnLog) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    a.log = l
+    for _, r := range l.Pending() {
+        switch r.State {
+        case TxnPrepared:
+            a.prepared[r.Id] = &preparedTxn{ record: r }
+            for _, key := range txnKeys(r.Writes, r.Checks) {
+                a.locks[key] = r.Id
+            }
+        case TxnDecided:
+            a.decided[r.Id] = &decidedTxn{ record: r, acked: make(map[string]bool) }
+        }
+    }
+
+    if len(a.prepared) > 0 || len(a.decided) > 0 {
+        log.Printf("Recovered %d prepared and %d committed transactions", len(a.prepared), len(a.decided))
+    }
+}
+
+func txnKeys(writes []StoreDTO, checks []TxnCheck) []string {
+    keys := make([]string, 0, len(writes) + len(checks))
+    for _, w := range writes {
+        keys = append(keys, string(w.Key))
+    }
+    for _, check := range checks {
+        keys = append(keys, string(check.Key))
+    }
+    return keys
+}
+
+func (a *TxnActivity) Route(r *Request) (h Handler, err error) {
+    if r.Message.Type == TXN {
+        switch r.Message.Operation {
+        case TXN_OP_PREPARE, TXN_OP_COMMIT, TXN_OP_ABORT, TXN_OP_QUERY:
+            return a, nil
+        }
+    }
+
+    return nil, errors.New("Cannot handle this")
+}
+
+func (a *TxnActivity) Handle(r *Request) error {
+    var dto TxnDTO
+    if err := DecodeLoad(r.Message.Load, &dto); err != nil {
+        return err
+    }
+
+    var op byte
+    var load []byte
+    switch r.Message.Operation {
+    case TXN_OP_PREPARE:
+        op = TXN_OP_VOTE_YES
+        if reason, ok := a.prepare(dto); !ok {
+            op, load = TXN_OP_VOTE_NO, EncodeLoad(TxnVoteDTO{ Reason: reason })
+        }
+    case TXN_OP_COMMIT, TXN_OP_ABORT:
+        // no ack, coordinator sends the decision again
+        if err := a.finish(dto.Id, r.Message.Operation == TXN_OP_COMMIT); err != nil {
+            return err
+        }
+        op = TXN_OP_ACK
+    case TXN_OP_QUERY:
+        a.mu.Lock()
+        running := a.running[dto.Id]
+        _, committed := a.decided[dto.Id]
+        a.mu.Unlock()
+
+        if running {
+            // participant asks again later
+            return nil
+        }
+        op = TXN_OP_ABORT
+        if committed {
+            op = TXN_OP_COMMIT
+        }
+    }
+
+    return a.c.Reply(r, &Message{
+        Version: ProtocolVersion,
+        Type: TXN,
+        Operation: op,
+        ReplyTo: *a.c.proxy.Name,
+        Length: uint16(len(load)),
+        Load: load,
+    })
+}
+
+// Lock keys and log the writes as participant, returns reason if it cannot
+func (a *TxnActivity) prepare(dto TxnDTO) (byte, bool) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    if _, ok := a.prepared[dto.Id]; ok {
+        return 0, true
+    }
+
+    keys := txnKeys(dto.Writes, dto.Checks)
+    for _, key := range keys {
+        if id, ok := a.locks[key]; ok && id != dto.Id {
+            return txnVoteConflict, false
+        }
+    }
+
+    for _, check := range dto.Checks {
+        versions := make([]*Version, 0, 1)
+        if v, ok := a.c.storage.Get(check.Key); ok {
+            versions = append(versions, v)
+        }
+        if !check.If.holds(versions, a.c.Resolver) {
+            return txnVotePrecondition, false
+        }
+    }
+
+    record := TxnRecord{
+        Id: dto.Id,
+        State: TxnPrepared,
+        Coordinator: dto.Coordinator,
+        Writes: dto.Writes,
+        Checks: dto.Checks,
+    }
+    if err := a.log.Append(record); err != nil {
+        log.Println("Cannot log transaction:", err)
+        return txnVoteFailure, false
+    }
+
+    for _, key := range keys {
+        a.locks[key] = dto.Id
+    }
+    a.prepared[dto.Id] = &preparedTxn{ record: record, at: time.Now() }
+    return 0, true
+}
+
+// Apply or drop the writes of prepared transaction as participant, transaction
+// stays prepared with its keys locked if writes cannot be applied or logged
+func (a *TxnActivity) finish(id string, commit bool) error {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    p, ok := a.prepared[id]
+    if !ok {
+        return nil
+    }
+
+    state := TxnAborted
+    if commit {
+        for _, w := range p.record.Writes {
+            if _, err := a.c.apply(w.Key, w.Version()); err != nil {
+                log.Printf("Cannot store %s of transaction %s: %v", w.Key, id, err)
+                return err
+            }
+        }
+        state = TxnCommitted
+    }
+
+    // applying writes again after restart does no harm
+    if err := a.log.Append(TxnRecord{ Id: id, State: state, Coordinator: p.record.Coordinator }); err != nil {
+        log.Println("Cannot log transaction:", err)
+        return err
+    }
+
+    for _, key := range txnKeys(p.record.Writes, p.record.Checks) {
+        if a.locks[key] == id {
+            delete(a.locks, key)
+        }
+    }
+    delete(a.prepared, id)
+    return nil
+}
+
+// Send requests to peers and wait for replies, returns replies by peer
+func (a *TxnActivity) request(op byte, dtos map[string]TxnDTO) map[string]*Request {
+    replies := make(chan *Request, len(dtos))
+    id := a.c.begin(HandlerFunc(func(r *Request) error {
+        select {
+        case replies <- r:
+        default:
+        }
+        return nil
+    }))
+    defer a.c.end(id)
+
+    sent := 0
+    for peer, dto := range dtos {
+        addr, err := a.c.GetPeerAddr(peer)
+        if err != nil {
+            log.Println("Cannot contact peer", peer)
+            continue
+        }
+
+        load := EncodeLoad(dto)
+        a.c.exchange.Request(addr, &Message{
+            Version: ProtocolVersion,
+            Type: TXN,
+            Operation: op,
+            ReplyTo: *a.c.proxy.Name,
+            Length: uint16(len(load)),
+            Load: load,
+        }, id)
+        sent++
+    }
+
+    result := make(map[string]*Request, sent)
+    timeout := time.After(txnTimeout)
+    for len(result) < sent {
+        select {
+        case r := <- replies:
+            result[r.Message.ReplyTo] = r
+        case <- timeout:
+            return result
+        }
+    }
+
+    return result
+}
+
+// Current clocks of the keys, so that writes of transaction supersede them
+func (c *Cluster) contexts(keys [][]byte, level ConsistencyLevel) map[string]VectorClock {
+    groups := make(map[string][]StoreDTO)
+    for _, key := range keys {
+        for _, node := range c.HashNodes(mmh3.Sum128(key), level) {
+            groups[*node.Name] = append(groups[*node.Name], StoreDTO{ Key: key })
+        }
+    }
+
+    contexts := make(map[string]VectorClock)
+    c.batch(BATCH_OP_GET, groups, func(peer string, result *BatchResultDTO) {
+        for _, dto := range result.Found {
+            contexts[string(dto.Key)] = contexts[string(dto.Key)].Merge(dto.Clock)
+        }
+    })
+
+    return contexts
+}
+
+// Run the transaction as coordinator
+func (a *TxnActivity) commit(t *Txn, level ConsistencyLevel) error {
+    if len(t.writes) == 0 {
+        return nil
+    }
+
+    self := *a.c.proxy.Name
+    a.mu.Lock()
+    a.lastId++
+    id := fmt.Sprintf("%s/%d", self, a.lastId)
+    a.running[id] = true
+    a.mu.Unlock()
+
+    defer func() {
+        a.mu.Lock()
+        delete(a.running, id)
+        a.mu.Unlock()
+    }()
+
+    keys := make([][]byte, 0, len(t.writes))
+    for _, w := range t.writes {
+        keys = append(keys, w.key)
+    }
+    contexts := a.c.contexts(keys, level)
+
+    dtos := make(map[string]TxnDTO)
+    participant := func(peer string) TxnDTO {
+        dto, ok := dtos[peer]
+        if !ok {
+            dto = TxnDTO{ Id: id, Coordinator: self }
+        }
+        return dto
+    }
+
+    for _, w := range t.writes {
+        version := a.c.newVersion(w.value, contexts[string(w.key)])
+        version.Deleted = w.deleted
+
+        nodes := a.c.HashNodes(mmh3.Sum128(w.key), level)
+        if len(nodes) == 0 {
+            return ErrTxnAborted
+        }
+        for _, node := range nodes {
+            dto := participant(*node.Name)
+            dto.Writes = append(dto.Writes, NewStoreDTO(w.key, version))
+            dtos[*node.Name] = dto
+        }
+    }
+
+    for _, check := range t.checks {
+        nodes := a.c.HashNodes(mmh3.Sum128(check.Key), level)
+        if len(nodes) == 0 {
+            return ErrTxnAborted
+        }
+        for _, node := range nodes {
+            dto := participant(*node.Name)
+            dto.Checks = append(dto.Checks, check)
+            dtos[*node.Name] = dto
+        }
+    }
+
+    for peer := range dtos {
+        if !a.c.PeerSupports(peer, FeatureTxn) {
+            log.Printf("Peer %s does not take part in transactions", peer)
+            return ErrTxnAborted
+        }
+    }
+
+    votes := a.request(TXN_OP_PREPARE, dtos)
+
+    var err error
+    for peer := range dtos {
+        vote, ok := votes[peer]
+        switch {
+        case !ok:
+            err = ErrTxnAborted
+        case vote.Message.Operation == TXN_OP_VOTE_NO:
+            var reason TxnVoteDTO
+            DecodeLoad(vote.Message.Load, &reason)
+            switch {
+            case reason.Reason == txnVotePrecondition:
+                err = ErrTxnPrecondition
+            case reason.Reason == txnVoteConflict && err != ErrTxnPrecondition:
+                err = ErrTxnConflict
+            case err == nil:
+                err = ErrTxnAborted
+            }
+        }
+    }
+
+    if err == nil {
+        participants := make([]string, 0, len(dtos))
+        for peer := range dtos {
+            participants = append(participants, peer)
+        }
+        record := TxnRecord{ Id: id, State: TxnDecided, Coordinator: self, Participants: participants }
+
+        a.mu.Lock()
+        if err = a.log.Append(record); err == nil {
+            a.decided[id] = &decidedTxn{ record: record, acked: make(map[string]bool) }
+            delete(a.running, id)
+        }
+        a.mu.Unlock()
+
+        if err == nil {
+            a.complete(id)
+            return nil
+        }
+        log.Println("Cannot log transaction:", err)
+        err = ErrTxnAborted
+    }
+
+    // participants that did not get it ask later
+    aborts := make(map[string]TxnDTO, len(votes))
+    for peer, vote := range votes {
+        if vote.Message.Operation == TXN_OP_VOTE_YES {
+            aborts[peer] = TxnDTO{ Id: id }
+        }
+    }
+    a.request(TXN_OP_ABORT, aborts)
+
+    return err
+}
+
+// Tell participants that did not acknowledge yet about the commit
+func (a *TxnActivity) complete(id string) {
+    a.mu.Lock()
+    d, ok := a.decided[id]
+    if !ok {
+        a.mu.Unlock()
+        return
+    }
+    dtos := make(map[string]TxnDTO)
+    for _, peer := range d.record.Participants {
+        if !d.acked[peer] {
+            dtos[peer] = TxnDTO{ Id: id }
+        }
+    }
+    a.mu.Unlock()
+
+    replies := a.request(TXN_OP_COMMIT, dtos)
+
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    for peer, r := range replies {
+        if r.Message.Operation == TXN_OP_ACK {
+            d.acked[peer] = true
+        }
+    }
+
+    if _, ok := a.decided[id]; !ok || len(d.acked) < len(d.record.Participants) {
+        return
+    }
+
+    if err := a.log.Append(TxnRecord{ Id: id, State: TxnDone, Coordinator: d.record.Coordinator }); err != nil {
+        log.Println("Cannot log transaction:", err)
+        return
+    }
+    delete(a.decided, id)
+}
+
+// Ask coordinator about the outcome of prepared transaction
+func (a *TxnActivity) resolve(id string, coordinator string) {
+    replies := a.request(TXN_OP_QUERY, map[string]TxnDTO{
+        coordinator: TxnDTO{ Id: id },
+    })
+
+    r, ok := replies[coordinator]
+    if !ok {
+        log.Printf("Transaction %s is in doubt, coordinator does not answer", id)
+        return
+    }
+
+    if err := a.finish(id, r.Message.Operation == TXN_OP_COMMIT); err != nil {
+        log.Printf("Transaction %s stays prepared: %v", id, err)
+    }
+}
+
+// Finish what was left unfinished
+func (a *TxnActivity) recover() {
+    a.mu.Lock()
+    decided := make([]string, 0, len(a.decided))
+    for id := range a.decided {
+        decided = append(decided, id)
+    }
+    inDoubt := make(map[string]string)
+    for id, p := range a.prepared {
+        if time.Since(p.at) > txnInDoubtAfter {
+            inDoubt[id] = p.record.Coordinator
+        }
+    }
+    a.mu.Unlock()
+
+    for _, id := range decided {
+        a.complete(id)
+    }
+    for id, coordinator := range inDoubt {
+        a.resolve(id, coordinator)
+    }
+}
+
+// Launches background recovery of unfinished transactions
+func (a *TxnActivity) Start() {
+    if a.quit == nil {
+        a.quit = make(chan int, 1)
+        go func(quit chan int) {
+            ticker := time.NewTicker(txnRecoverInterval)
+            defer ticker.Stop()
+            for {
+                select {
+                case <- ticker.C:
+                    a.recover()
+                case <- quit:
+                    return
+                }
+            }
+        }(a.quit)
+    }
+}
+
+func (a *TxnActivity) Stop() {
+    if a.quit != nil {
+        a.quit <- 1
+        a.quit = nil
+    }
+}
@@ -0,0 +1,289 @@
+// Transaction log kept by participants and coordinators
+package cluster
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/gob"
+    "errors"
+    "hash/crc32"
+    "io"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "sync"
+)
+
+/*
+Log record layout, integers are big endian
+
+    crc32       uint32      checksum of the record
+    length      uint32      length of the record
+    record      []byte      gob encoded TxnRecord
+
+Every change of transaction state is appended and synced before the node acts
+on it. Only the latest record of every unfinished transaction matters, so on
+open the log is rewritten with just those, and it is emptied whenever no
+transaction is left unfinished
+ */
+
+type TxnState byte
+
+const (
+    TxnPrepared TxnState = iota + 1         // participant voted to commit, keys are locked
+    TxnCommitted                            // participant applied the writes
+    TxnAborted                              // participant dropped the writes
+    TxnDecided                              // coordinator decided to commit, participants are being told
+    TxnDone                                 // every participant acknowledged the commit
+)
+
+const txnLogFileName = "txn.log"
+const txnRecordHeaderSize = 8
+
+type TxnRecord struct {
+    Id string
+    State TxnState
+    Coordinator string
+    Participants []string       // of coordinator records
+    Writes []StoreDTO           // of participant records
+    Checks []TxnCheck           // of participant records
+}
+
+func (r *TxnRecord) finished() bool {
+    return r.State == TxnCommitted || r.State == TxnAborted || r.State == TxnDone
+}
+
+// Node can be both coordinator and participant of the same transaction, their records are kept apart
+func (r *TxnRecord) slot() string {
+    if r.State == TxnDecided || r.State == TxnDone {
+        return "coordinator/" + r.Id
+    }
+    return "participant/" + r.Id
+}
+
+type TxnLog interface {
+    // Record the state of transaction, it is durable once this returns
+    Append(TxnRecord) error
+    // Latest records of unfinished transactions
+    Pending() []TxnRecord
+    Close() error
+}
+
+type InMemoryTxnLog struct {
+    mu sync.Mutex
+    pending map[string]TxnRecord
+}
+
+func NewInMemoryTxnLog() TxnLog {
+    return &InMemoryTxnLog{
+        pending: make(map[string]TxnRecord),
+    }
+}
+
+func (l *InMemoryTxnLog) Append(r TxnRecord) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    track(l.pending, r)
+    return nil
+}
+
+func (l *InMemoryTxnLog) Pending() []TxnRecord {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return records(l.pending)
+}
+
+func (l *InMemoryTxnLog) Close() error {
+    return nil
+}
+
+func track(pending map[string]TxnRecord, r TxnRecord) {
+    if r.finished() {
+        delete(pending, r.slot())
+    } else {
+        pending[r.slot()] = r
+    }
+}
+
+func records(pending map[string]TxnRecord) []TxnRecord {
+    result := make([]TxnRecord, 0, len(pending))
+    for _, r := range pending {
+        result = append(result, r)
+    }
+    return result
+}
+
+type FileTxnLog struct {
+    mu sync.Mutex
+    file *os.File
+    pending map[string]TxnRecord
+}
+
+// Open or create transaction log in given directory
+func NewFileTxnLog(dir string) (*FileTxnLog, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+
+    path := filepath.Join(dir, txnLogFileName)
+    l := &FileTxnLog{
+        pending: make(map[string]TxnRecord),
+    }
+
+    if raw, err := ioutil.ReadFile(path); err == nil {
+        l.recover(raw)
+    } else if !os.IsNotExist(err) {
+        return nil, err
+    }
+
+    // rewrite with unfinished transactions only
+    tmp := path + ".tmp"
+    f, err := os.OpenFile(tmp, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0644)
+    if err != nil {
+        return nil, err
+    }
+    l.file = f
+    for _, r := range l.pending {
+        if err := l.write(r); err != nil {
+            f.Close()
+            return nil, err
+        }
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return nil, err
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        f.Close()
+        return nil, err
+    }
+    if err := syncDir(dir); err != nil {
+        f.Close()
+        return nil, err
+    }
+
+    return l, nil
+}
+
+// Make rename within the directory durable
+func syncDir(dir string) error {
+    d, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer d.Close()
+    return d.Sync()
+}
+
+// Read records until the end or a torn tail
+func (l *FileTxnLog) recover(raw []byte) {
+    pos := 0
+    for pos + txnRecordHeaderSize <= len(raw) {
+        crc := binary.BigEndian.Uint32(raw[pos:pos + 4])
+        length := int(binary.BigEndian.Uint32(raw[pos + 4:pos + 8]))
+        if pos + txnRecordHeaderSize + length > len(raw) {
+            break
+        }
+
+        body := raw[pos + txnRecordHeaderSize:pos + txnRecordHeaderSize + length]
+        if crc32.ChecksumIEEE(body) != crc {
+            break
+        }
+
+        var r TxnRecord
+        if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&r); err != nil {
+            break
+        }
+        track(l.pending, r)
+        pos += txnRecordHeaderSize + length
+    }
+
+    if pos < len(raw) {
+        log.Printf("Transaction log is damaged at offset %d, discarding %d bytes", pos, len(raw) - pos)
+    }
+}
+
+// Append the record to the file, caller must hold the lock. Partly written
+// record is cut off, records appended after it would be lost on recovery
+func (l *FileTxnLog) write(r TxnRecord) error {
+    body := new(bytes.Buffer)
+    if err := gob.NewEncoder(body).Encode(r); err != nil {
+        return err
+    }
+
+    buf := make([]byte, txnRecordHeaderSize + body.Len())
+    binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(body.Bytes()))
+    binary.BigEndian.PutUint32(buf[4:8], uint32(body.Len()))
+    copy(buf[txnRecordHeaderSize:], body.Bytes())
+
+    offset, err := l.file.Seek(0, io.SeekCurrent)
+    if err != nil {
+        return err
+    }
+    if _, err := l.file.Write(buf); err != nil {
+        l.truncate(offset)
+        return err
+    }
+    return nil
+}
+
+// Drop everything past offset and continue writing there
+func (l *FileTxnLog) truncate(offset int64) {
+    if err := l.file.Truncate(offset); err != nil {
+        log.Println("Cannot truncate transaction log:", err)
+    }
+    if _, err := l.file.Seek(offset, io.SeekStart); err != nil {
+        log.Println("Cannot truncate transaction log:", err)
+    }
+}
+
+func (l *FileTxnLog) Append(r TxnRecord) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if l.file == nil {
+        return errors.New("Transaction log is closed")
+    }
+
+    offset, err := l.file.Seek(0, io.SeekCurrent)
+    if err != nil {
+        return err
+    }
+    if err := l.write(r); err != nil {
+        return err
+    }
+    if err := l.file.Sync(); err != nil {
+        // record is not durable, node must not act on it
+        l.truncate(offset)
+        return err
+    }
+    track(l.pending, r)
+
+    if len(l.pending) == 0 {
+        // nothing left to recover, records left behind on failure are finished anyway
+        l.truncate(0)
+        if err := l.file.Sync(); err != nil {
+            log.Println("Cannot sync transaction log:", err)
+        }
+    }
+    return nil
+}
+
+func (l *FileTxnLog) Pending() []TxnRecord {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return records(l.pending)
+}
+
+func (l *FileTxnLog) Close() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if l.file == nil {
+        return nil
+    }
+    err := l.file.Close()
+    l.file = nil
+    return err
+}
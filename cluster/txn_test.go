@@ -0,0 +1,176 @@
+package cluster
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestTxn_Commit(t *testing.T) {
+    err := client1.Txn().
+        Put([]byte("txn/site"), []byte("b")).
+        Put([]byte("txn/epoch"), []byte("2")).
+        Delete([]byte("txn/old")).
+        Commit(ConsistencyLevelTwo)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if data, _ := client2.Load([]byte("txn/site"), ConsistencyLevelTwo); string(data) != "b" {
+        t.Error("Unexpected value", string(data))
+    }
+    if data, _ := client3.Load([]byte("txn/epoch"), ConsistencyLevelTwo); string(data) != "2" {
+        t.Error("Unexpected value", string(data))
+    }
+
+    // all keys are unlocked
+    for _, client := range []*Client{ client1, client2, client3, client4, client5 } {
+        client.Cluster.txns.mu.Lock()
+        locked := len(client.Cluster.txns.locks)
+        client.Cluster.txns.mu.Unlock()
+        if locked > 0 {
+            t.Error("Keys are left locked on", client.GetName())
+        }
+    }
+}
+
+func TestTxn_Precondition(t *testing.T) {
+    client1.Store([]byte("txn/epoch2"), []byte("1"), ConsistencyLevelTwo)
+
+    err := client2.Txn().
+        If([]byte("txn/epoch2"), Precondition{ Hash: ValueHash([]byte("0")) }).
+        Put([]byte("txn/epoch2"), []byte("2")).
+        Put([]byte("txn/site2"), []byte("b")).
+        Commit(ConsistencyLevelTwo)
+    if err != ErrTxnPrecondition {
+        t.Fatal("Transaction shall not commit", err)
+    }
+
+    if _, result := client3.Load([]byte("txn/site2"), ConsistencyLevelTwo); result != LOAD_FAILURE {
+        t.Fatal("Writes of aborted transaction shall not be applied")
+    }
+
+    err = client2.Txn().
+        If([]byte("txn/epoch2"), Precondition{ Hash: ValueHash([]byte("1")) }).
+        Put([]byte("txn/epoch2"), []byte("2")).
+        Commit(ConsistencyLevelTwo)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestTxn_Conflict(t *testing.T) {
+    key := []byte("txn/locked")
+    other := TxnDTO{ Id: "other/1", Coordinator: "other", Checks: []TxnCheck{ { Key: key } } }
+    clients := []*Client{ client1, client2, client3, client4, client5 }
+    for _, client := range clients {
+        client.Cluster.txns.prepare(other)
+    }
+
+    if err := client1.Txn().Put(key, []byte("1")).Commit(ConsistencyLevelTwo); err != ErrTxnConflict {
+        t.Error("Locked key shall not be written", err)
+    }
+
+    for _, client := range clients {
+        client.Cluster.txns.finish(other.Id, false)
+    }
+
+    if err := client1.Txn().Put(key, []byte("1")).Commit(ConsistencyLevelTwo); err != nil {
+        t.Error(err)
+    }
+}
+
+func TestTxn_Recover(t *testing.T) {
+    key := []byte("txn/recovered")
+    version := client1.Cluster.newVersion([]byte("value"), nil)
+    coordinator, participant := client1.Cluster, client3.Cluster
+
+    // participant prepared and coordinator decided, but both restarted before commit got through
+    prepared := NewInMemoryTxnLog()
+    prepared.Append(TxnRecord{
+        Id: "txn/1",
+        State: TxnPrepared,
+        Coordinator: *coordinator.proxy.Name,
+        Writes: []StoreDTO{ NewStoreDTO(key, version) },
+    })
+    prepared.Append(TxnRecord{ Id: "txn/2", State: TxnPrepared, Coordinator: *coordinator.proxy.Name })
+    participant.SetTxnLog(prepared)
+
+    decided := NewInMemoryTxnLog()
+    decided.Append(TxnRecord{ Id: "txn/1", State: TxnDecided, Coordinator: *coordinator.proxy.Name, Participants: []string{ *participant.proxy.Name } })
+    coordinator.SetTxnLog(decided)
+
+    // txn/1 is committed, txn/2 coordinator has no record of is aborted
+    participant.txns.recover()
+    if v, ok := participant.storage.Get(key); !ok || string(v.Value) != "value" {
+        t.Fatal("Committed transaction shall be applied on recovery")
+    }
+    if len(prepared.Pending()) != 0 {
+        t.Error("Transactions shall be finished", prepared.Pending())
+    }
+
+    coordinator.txns.recover()
+    if len(decided.Pending()) != 0 {
+        t.Error("Acknowledged commit shall be done", decided.Pending())
+    }
+
+    participant.SetTxnLog(NewInMemoryTxnLog())
+    coordinator.SetTxnLog(NewInMemoryTxnLog())
+}
+
+func TestTxn_FailedCommitStaysPrepared(t *testing.T) {
+    c, _ := standaloneCluster(t, failingStorage{ NewInMemoryStorage() }, "node-b", "partitions=1")
+    l := NewInMemoryTxnLog()
+    c.SetTxnLog(l)
+
+    key := []byte("txn/full")
+    dto := TxnDTO{ Id: "txn/1", Coordinator: "node-b", Writes: []StoreDTO{ NewStoreDTO(key, c.newVersion([]byte("v"), nil)) } }
+    if _, ok := c.txns.prepare(dto); !ok {
+        t.Fatal("Cannot prepare")
+    }
+
+    if err := c.txns.finish(dto.Id, true); err == nil {
+        t.Error("Failed commit shall be reported")
+    }
+    if _, ok := c.txns.prepared[dto.Id]; !ok || c.txns.locks[string(key)] != dto.Id {
+        t.Error("Transaction shall stay prepared with keys locked")
+    }
+    if pending := l.Pending(); len(pending) != 1 || pending[0].State != TxnPrepared {
+        t.Error("Commit shall not be logged", pending)
+    }
+}
+
+func TestTxn_FileLog(t *testing.T) {
+    dir := t.TempDir()
+
+    l, err := NewFileTxnLog(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    l.Append(TxnRecord{ Id: "a", State: TxnPrepared })
+    l.Append(TxnRecord{ Id: "b", State: TxnDecided, Participants: []string{ "p" } })
+    l.Append(TxnRecord{ Id: "c", State: TxnPrepared })
+    l.Append(TxnRecord{ Id: "c", State: TxnCommitted })
+    l.Close()
+
+    // torn tail is discarded
+    f, _ := os.OpenFile(filepath.Join(dir, txnLogFileName), os.O_WRONLY | os.O_APPEND, 0644)
+    f.Write([]byte{ 1, 2, 3, 4, 0, 0, 1, 0 })
+    f.Close()
+
+    l, err = NewFileTxnLog(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+
+    pending := l.Pending()
+    if len(pending) != 2 {
+        t.Fatal("Unexpected pending transactions", pending)
+    }
+    for _, r := range pending {
+        if r.Id == "c" || (r.Id == "b" && r.Participants[0] != "p") {
+            t.Error("Unexpected record", r)
+        }
+    }
+}
@@ -1,5 +1,7 @@
 package cluster
 
+import "math/big"
+
 /*
 
 Checks if three given hash values are in clockwise order on the hash ring
@@ -47,4 +49,12 @@ func CompareHashes(a, b []byte) int {
     return 0
 }
 
+// Position of the hash on the ring as a number, in the same order CompareHashes uses
+func RingPosition(hash []byte) *big.Int {
+    reversed := make([]byte, len(hash))
+    for i, b := range hash {
+        reversed[len(hash) - 1 - i] = b
+    }
 
+    return new(big.Int).SetBytes(reversed)
+}
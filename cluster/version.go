@@ -0,0 +1,301 @@
+// Object versions: vector clocks, conflict detection and resolution
+package cluster
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Counter of writes coordinated by each node
+type VectorClock map[string]uint64
+
+type Ordering int
+
+const (
+    ClockEqual Ordering = iota
+    ClockBefore                 // happened before the other
+    ClockAfter                  // happened after the other
+    ClockConcurrent             // neither
+)
+
+// Version of an object value as kept by replicas
+type Version struct {
+    Value []byte
+    Clock VectorClock
+    Timestamp int64             // wall clock of the write in nanoseconds, only used to break ties
+    Deleted bool                // tombstone of a removed value
+    Expires int64               // wall clock in nanoseconds after which value is gone, zero if never, see ttl.go
+}
+
+// Picks or builds one version out of concurrent siblings
+type Resolver func(siblings []*Version) *Version
+
+func (vc VectorClock) Clone() VectorClock {
+    clone := make(VectorClock, len(vc))
+    for node, counter := range vc {
+        clone[node] = counter
+    }
+
+    return clone
+}
+
+// Compare this clock to the other one
+func (vc VectorClock) Compare(other VectorClock) Ordering {
+    before, after := false, false
+
+    for node, counter := range vc {
+        switch o := other[node]; {
+        case counter > o:
+            after = true
+        case counter < o:
+            before = true
+        }
+    }
+
+    for node, o := range other {
+        if _, ok := vc[node]; !ok && o > 0 {
+            before = true
+        }
+    }
+
+    switch {
+    case before && after:
+        return ClockConcurrent
+    case before:
+        return ClockBefore
+    case after:
+        return ClockAfter
+    }
+
+    return ClockEqual
+}
+
+// Clock that descends both this and the other clock
+func (vc VectorClock) Merge(other VectorClock) VectorClock {
+    merged := vc.Clone()
+    for node, counter := range other {
+        if counter > merged[node] {
+            merged[node] = counter
+        }
+    }
+
+    return merged
+}
+
+// Resolver that keeps the version written last according to wall clock
+func LastWriteWins(siblings []*Version) *Version {
+    var winner *Version
+    for _, v := range siblings {
+        if winner == nil || v.Timestamp > winner.Timestamp ||
+            (v.Timestamp == winner.Timestamp && bytes.Compare(v.Value, winner.Value) > 0) {
+            winner = v
+        }
+    }
+
+    return winner
+}
+
+// Drop versions that are older than or equal to some other version, what is left are concurrent siblings
+func Siblings(versions []*Version) []*Version {
+    siblings := make([]*Version, 0, len(versions))
+    for i, v := range versions {
+        keep := true
+        for j, o := range versions {
+            if i == j {
+                continue
+            }
+
+            switch v.Clock.Compare(o.Clock) {
+            case ClockBefore:
+                keep = false
+            case ClockEqual:
+                // first of equal versions stays
+                keep = keep && i < j
+            }
+        }
+
+        if keep {
+            siblings = append(siblings, v)
+        }
+    }
+
+    return siblings
+}
+
+// Single version out of siblings, resolved one descends all of them
+func Resolve(siblings []*Version, resolver Resolver) *Version {
+    if len(siblings) == 1 {
+        return siblings[0]
+    }
+
+    resolved := *resolver(siblings)
+    clock := VectorClock{}
+    for _, s := range siblings {
+        clock = clock.Merge(s.Clock)
+    }
+    resolved.Clock = clock
+
+    return &resolved
+}
+
+// Source of monotonic clock ticks for writes coordinated by the node, close to wall clock in microseconds
+type clockSource struct {
+    mu sync.Mutex
+    last uint64
+}
+
+func (s *clockSource) tick() uint64 {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    now := uint64(time.Now().UnixNano() / 1000)
+    if now <= s.last {
+        now = s.last + 1
+    }
+    s.last = now
+
+    return now
+}
+
+// New version of the value coordinated by the node, descending context if given
+func (c *Cluster) newVersion(value []byte, context VectorClock) *Version {
+    clock := VectorClock{}
+    if context != nil {
+        clock = context.Clone()
+    }
+    clock[*c.proxy.Name] = c.clock.tick()
+
+    return &Version{
+        Value: value,
+        Clock: clock,
+        Timestamp: time.Now().UnixNano(),
+    }
+}
+
+// Merge incoming version into local storage, returns true if local copy changed
+// and error if the change could not be stored
+func (c *Cluster) apply(key []byte, incoming *Version) (bool, error) {
+    c.applyMu.Lock()
+    defer c.applyMu.Unlock()
+
+    local, ok := c.storage.Get(key)
+    if !ok {
+        if v := live(incoming, time.Now()); v.Deleted && c.expired(v) {
+            // already purged here, no need to bring it back
+            return false, nil
+        }
+        return true, c.put(key, incoming)
+    }
+
+    switch incoming.Clock.Compare(local.Clock) {
+    case ClockAfter:
+        return true, c.put(key, incoming)
+    case ClockConcurrent:
+        return true, c.put(key, Resolve([]*Version{ local, incoming }, c.Resolver))
+    }
+
+    return false, nil
+}
+
+// Keep the version and tell watchers about it
+func (c *Cluster) put(key []byte, v *Version) error {
+    if err := c.storage.Put(key, v); err != nil {
+        return err
+    }
+    if c.watches != nil {
+        c.watches.changed(key, live(v, time.Now()))
+    }
+    return nil
+}
+
+/*
+Binary layout of a version in storage, integers are big endian
+
+    flags       byte        bit 0 marks tombstone, bit 1 expiring value, other bits are reserved
+    timestamp   int64
+    expires     int64       only if bit 1 is set
+    entries     uint16      number of clock entries
+    entry       ...         node name length (byte), node name, counter (uint64)
+    value       []byte      until the end
+ */
+
+const (
+    versionTombstone byte = 1
+    versionExpires byte = 2
+)
+
+func EncodeVersion(v *Version) []byte {
+    buf := new(bytes.Buffer)
+    var flags byte
+    if v.Deleted {
+        flags |= versionTombstone
+    }
+    if v.Expires > 0 {
+        flags |= versionExpires
+    }
+    buf.WriteByte(flags)
+    binary.Write(buf, binary.BigEndian, v.Timestamp)
+    if v.Expires > 0 {
+        binary.Write(buf, binary.BigEndian, v.Expires)
+    }
+    binary.Write(buf, binary.BigEndian, uint16(len(v.Clock)))
+
+    // sorted to have same bytes for same versions
+    nodes := make([]string, 0, len(v.Clock))
+    for node := range v.Clock {
+        nodes = append(nodes, node)
+    }
+    sort.Strings(nodes)
+
+    for _, node := range nodes {
+        buf.WriteByte(byte(len(node)))
+        buf.WriteString(node)
+        binary.Write(buf, binary.BigEndian, v.Clock[node])
+    }
+    buf.Write(v.Value)
+
+    return buf.Bytes()
+}
+
+func DecodeVersion(raw []byte) (*Version, error) {
+    if len(raw) < 11 {
+        return nil, errors.New("Version is too short")
+    }
+
+    v := &Version{
+        Timestamp: int64(binary.BigEndian.Uint64(raw[1:9])),
+        Clock: VectorClock{},
+        Deleted: raw[0] & versionTombstone != 0,
+    }
+
+    pos := 9
+    if raw[0] & versionExpires != 0 {
+        if len(raw) < 19 {
+            return nil, errors.New("Version is too short")
+        }
+        v.Expires = int64(binary.BigEndian.Uint64(raw[9:17]))
+        pos = 17
+    }
+
+    entries := int(binary.BigEndian.Uint16(raw[pos:pos + 2]))
+    pos += 2
+    for i := 0; i < entries; i++ {
+        if pos >= len(raw) {
+            return nil, errors.New("Version clock is truncated")
+        }
+        l := int(raw[pos])
+        if pos + 1 + l + 8 > len(raw) {
+            return nil, errors.New("Version clock is truncated")
+        }
+        node := string(raw[pos + 1:pos + 1 + l])
+        v.Clock[node] = binary.BigEndian.Uint64(raw[pos + 1 + l:])
+        pos += 1 + l + 8
+    }
+    v.Value = raw[pos:]
+
+    return v, nil
+}
@@ -0,0 +1,71 @@
+package cluster
+
+import (
+    "testing"
+)
+
+func TestVersion_Compare(t *testing.T) {
+    a := VectorClock{ "a": 1 }
+    b := VectorClock{ "a": 1, "b": 1 }
+    c := VectorClock{ "a": 2 }
+
+    if a.Compare(a.Clone()) != ClockEqual {
+        t.Error("Clock is not equal to its clone")
+    }
+
+    if a.Compare(b) != ClockBefore || b.Compare(a) != ClockAfter {
+        t.Error("Descendant clock is not ordered after ancestor")
+    }
+
+    if b.Compare(c) != ClockConcurrent || c.Compare(b) != ClockConcurrent {
+        t.Error("Diverged clocks are not concurrent")
+    }
+
+    merged := b.Merge(c)
+    if merged.Compare(b) != ClockAfter || merged.Compare(c) != ClockAfter {
+        t.Error("Merged clock does not descend both clocks")
+    }
+}
+
+func TestVersion_Siblings(t *testing.T) {
+    old := &Version{ Value: []byte("old"), Clock: VectorClock{ "a": 1 }, Timestamp: 1 }
+    left := &Version{ Value: []byte("left"), Clock: VectorClock{ "a": 2 }, Timestamp: 2 }
+    right := &Version{ Value: []byte("right"), Clock: VectorClock{ "a": 1, "b": 1 }, Timestamp: 3 }
+    dup := &Version{ Value: []byte("left"), Clock: VectorClock{ "a": 2 }, Timestamp: 2 }
+
+    siblings := Siblings([]*Version{ old, left, right, dup })
+    if len(siblings) != 2 {
+        t.Fatal("Expected 2 siblings, got", len(siblings))
+    }
+
+    resolved := Resolve(siblings, LastWriteWins)
+    if string(resolved.Value) != "right" {
+        t.Error("Last write did not win:", string(resolved.Value))
+    }
+
+    if resolved.Clock.Compare(left.Clock) != ClockAfter || resolved.Clock.Compare(right.Clock) != ClockAfter {
+        t.Error("Resolved version does not descend siblings")
+    }
+}
+
+func TestVersion_Encoding(t *testing.T) {
+    v := &Version{
+        Value: []byte("value"),
+        Clock: VectorClock{ "node1": 10, "node2": 1 << 40 },
+        Timestamp: 1234567890,
+        Deleted: true,
+    }
+
+    decoded, err := DecodeVersion(EncodeVersion(v))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if string(decoded.Value) != "value" || decoded.Timestamp != v.Timestamp || !decoded.Deleted || decoded.Clock.Compare(v.Clock) != ClockEqual {
+        t.Error("Decoded version differs from encoded one")
+    }
+
+    if _, err := DecodeVersion(EncodeVersion(v)[:14]); err == nil {
+        t.Error("Truncated version decoded without error")
+    }
+}
@@ -0,0 +1,326 @@
+// Watching keys for changes
+package cluster
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+    "github.com/reusee/mmh3"
+)
+
+/*
+Watcher subscribes to changes of a key with the replicas of the key, and to
+changes of keys with a prefix with every peer, since those keys may be kept
+anywhere. Replica tells watchers about every version it applies:
+
+    W -> R   WATCH_OP_SUBSCRIBE     watch id, key or prefix
+    R -> W   WATCH_OP_NOTIFY        watch id, key and applied version
+    W -> R   WATCH_OP_UNSUBSCRIBE   watch id
+
+Subscriptions expire after watchTTL, so watcher renews them every
+watchRenewInterval with whoever keeps the key at the moment. Several replicas
+tell about the same write, watcher only passes on versions that are newer than
+or concurrent to what it passed on before. Events the watch channel has no room
+for are dropped, whoever watches shall keep up
+ */
+
+const (
+    WATCH_OP_SUBSCRIBE byte = iota
+    WATCH_OP_UNSUBSCRIBE
+    WATCH_OP_NOTIFY
+    WATCH_OP_ACK
+)
+
+const watchTTL = 30 * time.Second
+const watchRenewInterval = 10 * time.Second
+const watchBufferSize = 64
+
+type WatchEvent struct {
+    Key []byte
+    Value []byte
+    Deleted bool
+    Clock VectorClock
+}
+
+type WatchDTO struct {
+    Id uint64
+    Key []byte
+    Prefix bool
+    Event WatchEvent
+}
+
+// Watch of the key or prefix, events come to C until it is cancelled
+type Watch struct {
+    C chan WatchEvent
+    a *WatchActivity
+    id uint64
+    key []byte
+    prefix bool
+    seen map[string]VectorClock // merged clocks of versions passed on
+}
+
+// Subscription kept by replica
+type subscription struct {
+    watcher string
+    id uint64
+    key []byte
+    prefix bool
+    expires time.Time
+}
+
+func (s *subscription) matches(key []byte) bool {
+    if s.prefix {
+        return bytes.HasPrefix(key, s.key)
+    }
+    return bytes.Equal(key, s.key)
+}
+
+type WatchActivity struct {
+    c *Cluster
+    mu sync.Mutex
+    lastId uint64
+    watches map[uint64]*Watch               // of the node
+    subscriptions map[string]*subscription  // kept for watchers, by watcher and watch id
+    quit chan int
+}
+
+func NewWatchActivity(c *Cluster) *WatchActivity {
+    return &WatchActivity{
+        c: c,
+        // ids shall not repeat after restart, replicas may still keep old subscriptions
+        lastId: uint64(time.Now().UnixNano()),
+        watches: make(map[uint64]*Watch),
+        subscriptions: make(map[string]*subscription),
+        quit: nil,
+    }
+}
+
+func (a *WatchActivity) Route(r *Request) (h Handler, err error) {
+    if r.Message.Type == WATCH && r.Message.Operation != WATCH_OP_ACK {
+        return a, nil
+    }
+
+    return nil, errors.New("Cannot handle this")
+}
+
+func (a *WatchActivity) Handle(r *Request) error {
+    var dto WatchDTO
+    if err := DecodeLoad(r.Message.Load, &dto); err != nil {
+        return err
+    }
+
+    switch r.Message.Operation {
+    case WATCH_OP_SUBSCRIBE:
+        a.subscribe(r.Message.ReplyTo, dto, time.Now())
+    case WATCH_OP_UNSUBSCRIBE:
+        a.mu.Lock()
+        delete(a.subscriptions, subscriptionId(r.Message.ReplyTo, dto.Id))
+        a.mu.Unlock()
+    case WATCH_OP_NOTIFY:
+        a.deliver(dto.Id, dto.Event)
+    }
+
+    return a.c.Reply(r, &Message{
+        Version: ProtocolVersion,
+        Type: WATCH,
+        Operation: WATCH_OP_ACK,
+        ReplyTo: *a.c.proxy.Name,
+        Length: 0,
+    })
+}
+
+func subscriptionId(watcher string, id uint64) string {
+    return fmt.Sprintf("%s/%d", watcher, id)
+}
+
+func (a *WatchActivity) subscribe(watcher string, dto WatchDTO, now time.Time) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    a.subscriptions[subscriptionId(watcher, dto.Id)] = &subscription{
+        watcher: watcher,
+        id: dto.Id,
+        key: dto.Key,
+        prefix: dto.Prefix,
+        expires: now.Add(watchTTL),
+    }
+}
+
+// Tell watchers about the version applied by the node
+func (a *WatchActivity) changed(key []byte, v *Version) {
+    now := time.Now()
+
+    a.mu.Lock()
+    targets := make([]*subscription, 0)
+    for id, s := range a.subscriptions {
+        if !now.Before(s.expires) {
+            delete(a.subscriptions, id)
+            continue
+        }
+        if s.matches(key) {
+            targets = append(targets, s)
+        }
+    }
+    a.mu.Unlock()
+
+    for _, s := range targets {
+        a.send(s.watcher, WATCH_OP_NOTIFY, WatchDTO{
+            Id: s.id,
+            Event: WatchEvent{
+                Key: key,
+                Value: v.Value,
+                Deleted: v.Deleted,
+                Clock: v.Clock,
+            },
+        })
+    }
+}
+
+// Pass the event on to the watch, unless it already knows of the same or newer version
+func (a *WatchActivity) deliver(id uint64, e WatchEvent) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    w, ok := a.watches[id]
+    if !ok {
+        return
+    }
+
+    // consumer gets the clock of the version, merged one only filters out what was passed on
+    seen := w.seen[string(e.Key)]
+    if seen != nil {
+        switch e.Clock.Compare(seen) {
+        case ClockEqual, ClockBefore:
+            return
+        }
+    }
+    w.seen[string(e.Key)] = e.Clock.Merge(seen)
+
+    select {
+    case w.C <- e:
+    default:
+        log.Printf("Watch of %s is not read, change of %s dropped", w.key, e.Key)
+    }
+}
+
+func (a *WatchActivity) send(peer string, op byte, dto WatchDTO) {
+    if !a.c.PeerSupports(peer, FeatureWatch) {
+        return
+    }
+
+    addr, err := a.c.GetPeerAddr(peer)
+    if err != nil {
+        log.Println("Cannot contact peer", peer)
+        return
+    }
+
+    load := EncodeLoad(dto)
+    // acks are only needed to stop retransmissions
+    a.c.exchange.Request(addr, &Message{
+        Version: ProtocolVersion,
+        Type: WATCH,
+        Operation: op,
+        ReplyTo: *a.c.proxy.Name,
+        Length: uint16(len(load)),
+        Load: load,
+    }, 0)
+}
+
+// Peers that shall know about the watch
+func (a *WatchActivity) replicas(w *Watch) []*Peer {
+    if w.prefix {
+        return a.c.Peers()
+    }
+    return a.c.HashNodes(mmh3.Sum128(w.key), a.c.ReplicationLevel)
+}
+
+func (a *WatchActivity) subscribeAll(w *Watch) {
+    for _, p := range a.replicas(w) {
+        a.send(*p.Name, WATCH_OP_SUBSCRIBE, WatchDTO{
+            Id: w.id,
+            Key: w.key,
+            Prefix: w.prefix,
+        })
+    }
+}
+
+// Start watching the key, or all keys with the prefix
+func (a *WatchActivity) Watch(key []byte, prefix bool) *Watch {
+    a.mu.Lock()
+    a.lastId++
+    w := &Watch{
+        C: make(chan WatchEvent, watchBufferSize),
+        a: a,
+        id: a.lastId,
+        key: key,
+        prefix: prefix,
+        seen: make(map[string]VectorClock),
+    }
+    a.watches[w.id] = w
+    a.mu.Unlock()
+
+    a.subscribeAll(w)
+    return w
+}
+
+// Stop watching, channel of the watch is closed
+func (w *Watch) Cancel() {
+    w.a.cancel(w)
+}
+
+func (a *WatchActivity) cancel(w *Watch) {
+    a.mu.Lock()
+    _, ok := a.watches[w.id]
+    delete(a.watches, w.id)
+    if ok {
+        close(w.C)
+    }
+    a.mu.Unlock()
+
+    if !ok {
+        return
+    }
+
+    for _, p := range a.replicas(w) {
+        a.send(*p.Name, WATCH_OP_UNSUBSCRIBE, WatchDTO{
+            Id: w.id,
+        })
+    }
+}
+
+// Launches background renewal of subscriptions
+func (a *WatchActivity) Start() {
+    if a.quit == nil {
+        a.quit = make(chan int, 1)
+        go func(quit chan int) {
+            for {
+                select {
+                case <- time.After(watchRenewInterval):
+                case <- quit:
+                    return
+                }
+
+                a.mu.Lock()
+                watches := make([]*Watch, 0, len(a.watches))
+                for _, w := range a.watches {
+                    watches = append(watches, w)
+                }
+                a.mu.Unlock()
+
+                for _, w := range watches {
+                    a.subscribeAll(w)
+                }
+            }
+        }(a.quit)
+    }
+}
+
+func (a *WatchActivity) Stop() {
+    if a.quit != nil {
+        a.quit <- 1
+        a.quit = nil
+    }
+}
@@ -0,0 +1,80 @@
+package cluster
+
+import (
+    "testing"
+    "time"
+)
+
+func nextEvent(t *testing.T, w *Watch) WatchEvent {
+    select {
+    case e := <- w.C:
+        return e
+    case <- time.After(2 * time.Second):
+        t.Fatal("No change notified")
+    }
+    return WatchEvent{}
+}
+
+func TestWatch_Key(t *testing.T) {
+    w := client5.Watch([]byte("watched"))
+    time.Sleep(200 * time.Millisecond)
+
+    if result := client1.Store([]byte("watched"), []byte("1"), ConsistencyLevelTwo); result != STORE_SUCCESS {
+        t.Fatal("Cannot store", result)
+    }
+
+    if e := nextEvent(t, w); string(e.Key) != "watched" || string(e.Value) != "1" || e.Deleted {
+        t.Fatal("Unexpected change", e)
+    }
+
+    // every replica tells about the same write
+    select {
+    case e := <- w.C:
+        t.Fatal("Change notified twice", e)
+    case <- time.After(300 * time.Millisecond):
+    }
+
+    client2.Delete([]byte("watched"), ConsistencyLevelTwo)
+    if e := nextEvent(t, w); !e.Deleted {
+        t.Fatal("Delete was not notified", e)
+    }
+
+    w.Cancel()
+    if _, ok := <- w.C; ok {
+        t.Fatal("Cancelled watch shall be closed")
+    }
+}
+
+func TestWatch_Prefix(t *testing.T) {
+    w := client3.WatchPrefix([]byte("watch/"))
+    defer w.Cancel()
+    time.Sleep(200 * time.Millisecond)
+
+    client1.Store([]byte("unwatched"), []byte("1"), ConsistencyLevelTwo)
+    client1.Store([]byte("watch/a"), []byte("2"), ConsistencyLevelTwo)
+
+    if e := nextEvent(t, w); string(e.Key) != "watch/a" || string(e.Value) != "2" {
+        t.Fatal("Unexpected change", e)
+    }
+}
+
+func TestWatch_ConcurrentClocks(t *testing.T) {
+    a := client5.Cluster.watches
+    w := a.Watch([]byte("watch/concurrent"), false)
+    defer w.Cancel()
+
+    key := []byte("watch/concurrent")
+    a.deliver(w.id, WatchEvent{ Key: key, Value: []byte("a"), Clock: VectorClock{ "a": 1 } })
+    a.deliver(w.id, WatchEvent{ Key: key, Value: []byte("b"), Clock: VectorClock{ "b": 1 } })
+    a.deliver(w.id, WatchEvent{ Key: key, Value: []byte("a"), Clock: VectorClock{ "a": 1 } })
+
+    nextEvent(t, w)
+    if e := nextEvent(t, w); e.Clock.Compare(VectorClock{ "b": 1 }) != ClockEqual {
+        t.Fatal("Event shall carry clock of its version", e.Clock)
+    }
+    select {
+    case e := <- w.C:
+        t.Fatal("Change notified twice", e)
+    default:
+    }
+}
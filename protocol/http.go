@@ -7,6 +7,13 @@ import (
     "html"
     "github.com/noroutine/witnessd/cluster"
     "bytes"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "io/ioutil"
+    "strconv"
+    "strings"
+    "time"
 )
 
 type HttpClient struct {
@@ -80,7 +87,7 @@ func (client *HttpClient) Serve() {
                 break
             }
 
-            if buf.Len() < cluster.MaxLoadLength {
+            if buf.Len() < cluster.MaxValueSize {
                 buf.Write(buf1[:n])
             } else {
                 http.Error(w, "Too large", http.StatusRequestEntityTooLarge)
@@ -102,5 +109,276 @@ func (client *HttpClient) Serve() {
         }
     })
 
+    http.HandleFunc("/nodes", func(w http.ResponseWriter, r *http.Request) {
+        log.Printf("GET %s", html.EscapeString(r.URL.Path))
+        suspicions := client.cl.Suspicions()
+        for _, p := range client.cl.Peers() {
+            fmt.Fprintf(w, "%s %s:%d %.2f %t\n", *p.Name, p.AddrIPv4, p.Port, suspicions[*p.Name], client.cl.IsSuspected(*p.Name))
+        }
+    })
+
+    // Keys in order as JSON, a page at a time: ?prefix=a&limit=100, then &after=<cursor> while there is one
+    http.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+        log.Printf("GET %s", html.EscapeString(r.URL.String()))
+        query := r.URL.Query()
+
+        limit := cluster.DefaultScanLimit
+        if param := query.Get("limit"); len(param) > 0 {
+            n, err := strconv.Atoi(param)
+            if err != nil || n <= 0 || n > cluster.MaxScanLimit {
+                http.Error(w, "Invalid limit", http.StatusBadRequest)
+                return
+            }
+            limit = n
+        }
+
+        var cursor []byte
+        if _, ok := query["after"]; ok {
+            cursor = []byte(query.Get("after"))
+        }
+
+        page, err := client.cl.Scan([]byte(query.Get("prefix")), cursor, limit)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusServiceUnavailable)
+            return
+        }
+
+        keys := make([]string, 0, len(page.Keys))
+        for _, key := range page.Keys {
+            keys = append(keys, string(key))
+        }
+        result := map[string]interface{}{ "keys": keys }
+        if page.Cursor != nil {
+            result["cursor"] = string(page.Cursor)
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(result)
+    })
+
+    // Many keys at once: POST {"store": {"key": "value"}, "load": ["key"]}, stores go first,
+    // answers store results and loaded values, null for missing keys
+    http.HandleFunc("/batch", func(w http.ResponseWriter, r *http.Request) {
+        log.Printf("%s %s", r.Method, html.EscapeString(r.URL.Path))
+        if r.Method != "POST" {
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+
+        var batch struct {
+            Store map[string]string `json:"store"`
+            Load []string `json:"load"`
+        }
+        if err := json.NewDecoder(io.LimitReader(r.Body, cluster.MaxValueSize + 1)).Decode(&batch); err != nil {
+            http.Error(w, "Invalid batch", http.StatusBadRequest)
+            return
+        }
+
+        stored := make(map[string]string, len(batch.Store))
+        if len(batch.Store) > 0 {
+            values := make(map[string][]byte, len(batch.Store))
+            for key, value := range batch.Store {
+                values[key] = []byte(value)
+            }
+
+            for key, result := range client.cl.MultiStore(values, cluster.ConsistencyLevelTwo) {
+                switch result {
+                case cluster.STORE_SUCCESS: stored[key] = "success"
+                case cluster.STORE_PARTIAL_SUCCESS: stored[key] = "partial"
+                case cluster.STORE_FAILURE: stored[key] = "failure"
+                default: stored[key] = "error"
+                }
+            }
+        }
+
+        loaded := make(map[string]*string, len(batch.Load))
+        if len(batch.Load) > 0 {
+            keys := make([][]byte, 0, len(batch.Load))
+            for _, key := range batch.Load {
+                keys = append(keys, []byte(key))
+            }
+
+            for key, result := range client.cl.MultiLoad(keys, cluster.ConsistencyLevelTwo) {
+                switch result.Result {
+                case cluster.LOAD_SUCCESS, cluster.LOAD_PARTIAL_SUCCESS:
+                    value := string(result.Value)
+                    loaded[key] = &value
+                default:
+                    loaded[key] = nil
+                }
+            }
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "store": stored,
+            "load": loaded,
+        })
+    })
+
+    // Server-Sent Events with changes of the key, or of all keys with the prefix if it ends with *
+    http.HandleFunc("/watch/", func(w http.ResponseWriter, r *http.Request) {
+        log.Printf("GET %s", html.EscapeString(r.URL.Path))
+        key := strings.TrimPrefix(r.URL.Path, "/watch/")
+        if len(key) == 0 {
+            http.Error(w, "No key", http.StatusBadRequest)
+            return
+        }
+
+        flusher, ok := w.(http.Flusher)
+        if !ok {
+            http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+            return
+        }
+
+        var watch *cluster.Watch
+        if strings.HasSuffix(key, "*") {
+            watch = client.cl.WatchPrefix([]byte(strings.TrimSuffix(key, "*")))
+        } else {
+            watch = client.cl.Watch([]byte(key))
+        }
+        defer watch.Cancel()
+
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Header().Set("Cache-Control", "no-cache")
+        w.WriteHeader(http.StatusOK)
+        flusher.Flush()
+
+        for {
+            select {
+            case e, ok := <- watch.C:
+                if !ok {
+                    return
+                }
+                event := "store"
+                if e.Deleted {
+                    event = "delete"
+                }
+                data, _ := json.Marshal(map[string]string{
+                    "key": string(e.Key),
+                    "value": string(e.Value),
+                })
+                fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+                flusher.Flush()
+            case <- r.Context().Done():
+                return
+            }
+        }
+    })
+
+    http.HandleFunc("/primary", func(w http.ResponseWriter, r *http.Request) {
+        log.Printf("GET %s", html.EscapeString(r.URL.Path))
+        lease, ok := client.cl.Primary()
+        if !ok {
+            http.Error(w, "No primary", http.StatusNotFound)
+            return
+        }
+
+        fmt.Fprintf(w, "%s %d %s %s\n", lease.Site, lease.Term, lease.Holder, lease.Expires.Format(time.RFC3339Nano))
+    })
+
+    http.HandleFunc("/leader", func(w http.ResponseWriter, r *http.Request) {
+        log.Printf("GET %s", html.EscapeString(r.URL.Path))
+        lease, ok := client.cl.Leader()
+        if !ok {
+            http.Error(w, "No leader", http.StatusNotFound)
+            return
+        }
+
+        fmt.Fprintf(w, "%s %d %s\n", lease.Site, lease.Term, lease.Expires.Format(time.RFC3339Nano))
+    })
+
+    http.HandleFunc("/keys/", func(w http.ResponseWriter, r *http.Request) {
+        log.Printf("%s %s", r.Method, html.EscapeString(r.URL.Path))
+        key := strings.TrimPrefix(r.URL.Path, "/keys/")
+        if len(key) == 0 {
+            http.Error(w, "No key", http.StatusBadRequest)
+            return
+        }
+
+        switch r.Method {
+        case "GET":
+            data, result := client.cl.Load([]byte(key), cluster.ConsistencyLevelTwo)
+            switch result {
+            case cluster.LOAD_SUCCESS, cluster.LOAD_PARTIAL_SUCCESS:
+                w.Header().Set("ETag", etag(data))
+                w.Write(data)
+            case cluster.LOAD_FAILURE:
+                http.Error(w, "Not found", http.StatusNotFound)
+            default:
+                http.Error(w, "Error", http.StatusInternalServerError)
+            }
+        case "PUT":
+            data, err := ioutil.ReadAll(io.LimitReader(r.Body, cluster.MaxValueSize + 1))
+            if err != nil {
+                http.Error(w, "Cannot read value", http.StatusBadRequest)
+                return
+            }
+            if len(data) > cluster.MaxValueSize {
+                http.Error(w, "Too large", http.StatusRequestEntityTooLarge)
+                return
+            }
+
+            // ?ttl=30s makes the value expire
+            var ttl time.Duration
+            if param := r.URL.Query().Get("ttl"); len(param) > 0 {
+                if ttl, err = time.ParseDuration(param); err != nil || ttl < 0 {
+                    http.Error(w, "Invalid ttl", http.StatusBadRequest)
+                    return
+                }
+            }
+
+            // If-Match compares value with ETag from GET, If-None-Match: * only creates
+            var result int
+            match, noneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+            if ttl > 0 && (len(match) > 0 || len(noneMatch) > 0) {
+                http.Error(w, "Conditional writes cannot expire", http.StatusBadRequest)
+                return
+            }
+
+            switch {
+            case len(match) > 0:
+                hash, err := hex.DecodeString(strings.Trim(match, `"`))
+                if err != nil {
+                    http.Error(w, "Invalid If-Match", http.StatusBadRequest)
+                    return
+                }
+                result = client.cl.StoreIf([]byte(key), data, cluster.Precondition{ Hash: hash }, cluster.ConsistencyLevelTwo)
+            case noneMatch == "*":
+                result = client.cl.StoreIf([]byte(key), data, cluster.Precondition{ Absent: true }, cluster.ConsistencyLevelTwo)
+            default:
+                result = client.cl.StoreTTL([]byte(key), data, ttl, cluster.ConsistencyLevelTwo)
+            }
+
+            switch result {
+            case cluster.STORE_SUCCESS, cluster.STORE_PARTIAL_SUCCESS:
+                w.Header().Set("ETag", etag(data))
+                w.WriteHeader(http.StatusNoContent)
+            case cluster.STORE_PRECONDITION_FAILED:
+                http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+            case cluster.STORE_FAILURE:
+                http.Error(w, "Failure", http.StatusInternalServerError)
+            default:
+                http.Error(w, "Error", http.StatusInternalServerError)
+            }
+        case "DELETE":
+            switch client.cl.Delete([]byte(key), cluster.ConsistencyLevelTwo) {
+            case cluster.STORE_SUCCESS, cluster.STORE_PARTIAL_SUCCESS:
+                w.WriteHeader(http.StatusNoContent)
+            case cluster.STORE_FAILURE:
+                http.Error(w, "Failure", http.StatusInternalServerError)
+            default:
+                http.Error(w, "Error", http.StatusInternalServerError)
+            }
+        default:
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        }
+    })
+
     log.Fatal(http.ListenAndServe(client.Address, nil))
+}
+
+// Entity tag of the value, as expected in If-Match
+func etag(value []byte) string {
+    return `"` + hex.EncodeToString(cluster.ValueHash(value)) + `"`
 }
\ No newline at end of file
@@ -6,8 +6,10 @@ import (
     "log"
     "fmt"
     "github.com/noroutine/witnessd/cluster"
+    "github.com/noroutine/witnessd/rules"
     "math/big"
     "strings"
+    "time"
 )
 
 type ReplClient struct {
@@ -31,6 +33,7 @@ func NewReplClient(name string, description string, clusterClient *cluster.Clien
         for s := range repl.Signals {
             if s == os.Interrupt {
                 log.Printf("Interrupted")
+                clusterClient.Close()
                 os.Exit(42)
             }
         }
@@ -44,8 +47,13 @@ func NewReplClient(name string, description string, clusterClient *cluster.Clien
         }
 
         fmt.Printf("Nodes in group %s:\n", clusterClient.GetGroup())
+        suspicions := clusterClient.Suspicions()
         for _, p := range clusterClient.DiscoverPeers() {
-            fmt.Printf("%-20s (%s:%d)\n", *p.Name, p.AddrIPv4, p.Port)
+            status := ""
+            if clusterClient.IsSuspected(*p.Name) {
+                status = "suspected"
+            }
+            fmt.Printf("%-20s (%s:%d) phi %6.2f %s\n", *p.Name, p.AddrIPv4, p.Port, suspicions[*p.Name], status)
         }
     })
 
@@ -73,7 +81,7 @@ func NewReplClient(name string, description string, clusterClient *cluster.Clien
         byPeer := make(map[string]float64)
         for i, p := range partitions {
             prevHash, partitionHash := prev.Hash(), p.Hash()
-            diff := new(big.Int).Sub(new(big.Int).SetBytes(partitionHash), new(big.Int).SetBytes(prevHash))
+            diff := new(big.Int).Sub(cluster.RingPosition(partitionHash), cluster.RingPosition(prevHash))
             if i == 0 {
                 diff = diff.Add(diff, keyspace)
             }
@@ -140,13 +148,53 @@ func NewReplClient(name string, description string, clusterClient *cluster.Clien
 
     repl.Register("store", func(args []string) {
         if len(args) < 2 {
-            fmt.Println("Usage: store <key> <value>")
+            fmt.Println("Usage: store <key> <value> [ttl]")
+            return
+        }
+
+        var ttl time.Duration
+        if len(args) > 2 {
+            d, err := time.ParseDuration(args[2])
+            if err != nil || d < 0 {
+                fmt.Println("Invalid ttl", args[2])
+                return
+            }
+            ttl = d
+        }
+
+        switch clusterClient.StoreTTL([]byte(args[0]), []byte(args[1]), ttl, cluster.ConsistencyLevelTwo) {
+        case cluster.STORE_SUCCESS: fmt.Println("Success")
+        case cluster.STORE_PARTIAL_SUCCESS: fmt.Println("Partial success")
+        case cluster.STORE_ERROR: fmt.Println("Error")
+        case cluster.STORE_FAILURE: fmt.Println("Failure")
+        }
+    })
+
+    repl.Register("create", func(args []string) {
+        if len(args) < 2 {
+            fmt.Println("Usage: create <key> <value>")
             return
         }
 
-        switch clusterClient.Store([]byte(args[0]), []byte(args[1]), cluster.ConsistencyLevelTwo) {
+        switch clusterClient.StoreIfAbsent([]byte(args[0]), []byte(args[1]), cluster.ConsistencyLevelTwo) {
         case cluster.STORE_SUCCESS: fmt.Println("Success")
         case cluster.STORE_PARTIAL_SUCCESS: fmt.Println("Partial success")
+        case cluster.STORE_PRECONDITION_FAILED: fmt.Println("Key exists")
+        case cluster.STORE_ERROR: fmt.Println("Error")
+        case cluster.STORE_FAILURE: fmt.Println("Failure")
+        }
+    })
+
+    repl.Register("cas", func(args []string) {
+        if len(args) < 3 {
+            fmt.Println("Usage: cas <key> <old value> <new value>")
+            return
+        }
+
+        switch clusterClient.CompareAndSwap([]byte(args[0]), []byte(args[1]), []byte(args[2]), cluster.ConsistencyLevelTwo) {
+        case cluster.STORE_SUCCESS: fmt.Println("Success")
+        case cluster.STORE_PARTIAL_SUCCESS: fmt.Println("Partial success")
+        case cluster.STORE_PRECONDITION_FAILED: fmt.Println("Value changed")
         case cluster.STORE_ERROR: fmt.Println("Error")
         case cluster.STORE_FAILURE: fmt.Println("Failure")
         }
@@ -168,6 +216,96 @@ func NewReplClient(name string, description string, clusterClient *cluster.Clien
         }
     })
 
+    repl.Register("keys", func(args []string) {
+        var prefix []byte
+        if len(args) > 0 {
+            prefix = []byte(args[0])
+        }
+
+        var cursor []byte
+        count := 0
+        for {
+            page, err := clusterClient.ScanAfter(prefix, cursor, cluster.DefaultScanLimit)
+            if err != nil {
+                fmt.Println(err)
+                return
+            }
+
+            for _, key := range page.Keys {
+                fmt.Println(string(key))
+            }
+            count += len(page.Keys)
+
+            if page.Cursor == nil {
+                break
+            }
+            cursor = page.Cursor
+        }
+        fmt.Printf("%d keys\n", count)
+    })
+
+    repl.Register("delete", func(args []string) {
+        if len(args) < 1 {
+            fmt.Println("Usage: delete <key>")
+            return
+        }
+
+        switch clusterClient.Delete([]byte(args[0]), cluster.ConsistencyLevelTwo) {
+        case cluster.STORE_SUCCESS: fmt.Println("Success")
+        case cluster.STORE_PARTIAL_SUCCESS: fmt.Println("Partial success")
+        case cluster.STORE_ERROR: fmt.Println("Error")
+        case cluster.STORE_FAILURE: fmt.Println("Failure")
+        }
+    })
+
+    watches := make(map[string]*cluster.Watch)
+    repl.Register("watch", func(args []string) {
+        if len(args) != 1 {
+            fmt.Println("Usage: watch <key> | watch <prefix>*")
+            return
+        }
+
+        if _, ok := watches[args[0]]; ok {
+            fmt.Println("Already watching", args[0])
+            return
+        }
+
+        var watch *cluster.Watch
+        if strings.HasSuffix(args[0], "*") {
+            watch = clusterClient.WatchPrefix([]byte(strings.TrimSuffix(args[0], "*")))
+        } else {
+            watch = clusterClient.Watch([]byte(args[0]))
+        }
+        watches[args[0]] = watch
+
+        go func() {
+            for e := range watch.C {
+                if e.Deleted {
+                    fmt.Printf("%s deleted\n", e.Key)
+                } else {
+                    fmt.Printf("%s = %s\n", e.Key, e.Value)
+                }
+            }
+        }()
+        fmt.Println("Watching", args[0])
+    })
+
+    repl.Register("unwatch", func(args []string) {
+        if len(args) != 1 {
+            fmt.Println("Usage: unwatch <key> | unwatch <prefix>*")
+            return
+        }
+
+        watch, ok := watches[args[0]]
+        if !ok {
+            fmt.Println("Not watching", args[0])
+            return
+        }
+
+        watch.Cancel()
+        delete(watches, args[0])
+    })
+
     repl.Register("ping", func(args []string) {
         if len(args) < 1 {
             fmt.Println("Usage: ping <peer>")
@@ -181,6 +319,77 @@ func NewReplClient(name string, description string, clusterClient *cluster.Clien
         }
     })
 
+    repl.Register("primary", func(args []string) {
+        lease, ok := clusterClient.Primary()
+        if !ok {
+            fmt.Println("No primary site known")
+            return
+        }
+
+        fmt.Printf("Primary site %s, term %d, held by %s, expires in %s\n",
+            lease.Site, lease.Term, lease.Holder, time.Until(lease.Expires).Truncate(time.Millisecond))
+    })
+
+    repl.Register("leader", func(args []string) {
+        lease, ok := clusterClient.Leader()
+        if !ok {
+            fmt.Println("No leader known")
+            return
+        }
+
+        fmt.Printf("Leader %s, term %d, expires in %s\n",
+            lease.Site, lease.Term, time.Until(lease.Expires).Truncate(time.Millisecond))
+    })
+
+    repl.Register("lock", func(args []string) {
+        if len(args) < 1 || len(args) > 2 {
+            fmt.Println("Usage: lock <name> [ttl]")
+            return
+        }
+
+        ttl := 30 * time.Second
+        if len(args) == 2 {
+            d, err := time.ParseDuration(args[1])
+            if err != nil {
+                fmt.Println("Invalid ttl", args[1])
+                return
+            }
+            ttl = d
+        }
+
+        token, err := clusterClient.Lock(args[0], ttl)
+        if err != nil {
+            fmt.Println(err)
+            return
+        }
+        fmt.Printf("Locked %s for %s, token %d\n", args[0], ttl, token)
+    })
+
+    repl.Register("unlock", func(args []string) {
+        if len(args) != 1 {
+            fmt.Println("Usage: unlock <name>")
+            return
+        }
+
+        if err := clusterClient.Unlock(args[0]); err != nil {
+            fmt.Println(err)
+            return
+        }
+        fmt.Println("Unlocked", args[0])
+    })
+
+    repl.Register("locks", func(args []string) {
+        locks := clusterClient.Locks()
+        if len(locks) == 0 {
+            fmt.Println("No locks held")
+            return
+        }
+
+        for _, l := range locks {
+            fmt.Printf("%-20s token %d, expires in %s\n", l.Name, l.Token, time.Until(l.Expires).Truncate(time.Millisecond))
+        }
+    })
+
     repl.Register("help", func(args []string) {
         fmt.Printf("Commands: %s\n", strings.Join(repl.GetKnownCommands(), ", "))
     })
@@ -203,6 +412,52 @@ func NewReplClient(name string, description string, clusterClient *cluster.Clien
     }
 }
 
+// Make rules inspectable with 'rules' command
+func (replClient *ReplClient) SetRuleEngine(engine *rules.Engine) {
+    replClient.repl.Register("rules", func(args []string) {
+        if len(args) == 2 && args[0] == "dry-run" && (args[1] == "on" || args[1] == "off") {
+            engine.SetDryRun(args[1] == "on")
+            fmt.Println("Dry run", args[1])
+            return
+        }
+
+        if len(args) > 0 {
+            fmt.Println("Usage: rules [dry-run on|off]")
+            return
+        }
+
+        if engine.IsDryRun() {
+            fmt.Println("Rules, dry run:")
+        } else {
+            fmt.Println("Rules:")
+        }
+
+        for _, s := range engine.Status() {
+            state := "idle"
+            switch {
+            case s.Active:
+                state = "active"
+            case s.Holds:
+                state = "pending"
+            }
+
+            fmt.Printf("%-20s %-8s for %s\n", s.Name, state, time.Since(s.Since).Truncate(time.Second))
+            if !s.Fired.IsZero() {
+                fmt.Printf("    fired at %s\n", s.Fired.Format(time.RFC3339))
+            }
+            if s.Err != nil {
+                fmt.Printf("    error: %v\n", s.Err)
+            }
+            for _, c := range s.Conditions {
+                fmt.Printf("    when %s\n", c)
+            }
+            for _, a := range s.Actions {
+                fmt.Printf("    then %s\n", a)
+            }
+        }
+    })
+}
+
 func (replCient *ReplClient) Serve() {
     replCient.repl.Serve();
 }
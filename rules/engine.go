@@ -0,0 +1,265 @@
+// Continuous evaluation of rules
+package rules
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+/*
+Every interval all rules are evaluated against the state, which is looked at
+once per evaluation, so rules referring to the same peer do not ping it twice.
+
+Rule fires once its conditions held for its `for` duration, and then stays
+active until they did not hold for its `clear` duration, so flapping
+conditions neither fire it again and again nor keep it from firing. Rule
+whose action failed does not stay active, it fires again once its conditions
+held for its `for` duration since the failure. In dry run mode rules are
+evaluated and fire as usual, but actions are only logged.
+
+When Leads is set, only the node it tells is leading evaluates rules, others
+keep them inactive, so rules fire on new leader only after their conditions
+held for `for` duration there
+ */
+
+const DefaultInterval = time.Second
+
+type Engine struct {
+    state State
+    rules []*Rule
+    Interval time.Duration
+    mu sync.Mutex
+    dryRun bool
+    Leads func() bool           // nil if every node takes actions
+    quit chan int
+    now func() time.Time
+}
+
+// What rule looks like at the moment
+type RuleStatus struct {
+    Name string
+    Conditions []string
+    Actions []string
+    Holds bool
+    Since time.Time             // when conditions started or stopped to hold
+    Active bool
+    Fired time.Time             // zero if never
+    Err error
+}
+
+func NewEngine(state State, rules []*Rule) *Engine {
+    now := time.Now()
+    for _, r := range rules {
+        r.since = now
+    }
+
+    return &Engine{
+        state: state,
+        rules: rules,
+        Interval: DefaultInterval,
+        quit: nil,
+        now: time.Now,
+    }
+}
+
+// In dry run mode actions are logged instead of taken
+func (e *Engine) SetDryRun(dryRun bool) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    e.dryRun = dryRun
+}
+
+func (e *Engine) IsDryRun() bool {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    return e.dryRun
+}
+
+// Evaluate all rules once, taking actions of rules that fire
+func (e *Engine) Evaluate() {
+    if e.Leads != nil && !e.Leads() {
+        e.reset()
+        return
+    }
+
+    state := newRoundState(e.state)
+
+    for _, r := range e.rules {
+        holds, err := r.eval(state)
+        now := e.now()
+
+        e.mu.Lock()
+        if err != nil {
+            // state is unknown, rule stays as it was
+            r.err = err
+            e.mu.Unlock()
+            log.Printf("Rule %s: %v", r.Name, err)
+            continue
+        }
+
+        if holds != r.holds {
+            r.holds, r.since = holds, now
+        }
+
+        fire := false
+        switch {
+        case !r.active && r.holds && now.Sub(r.since) >= r.For:
+            r.active, r.fired, r.err = true, now, nil
+            fire = true
+        case r.active && !r.holds && now.Sub(r.since) >= r.Clear:
+            r.active = false
+            log.Printf("Rule %s cleared", r.Name)
+        }
+        dryRun := e.dryRun
+        e.mu.Unlock()
+
+        if fire {
+            e.fire(r, dryRun)
+        }
+    }
+}
+
+// Rules start over, as if conditions stopped to hold now
+func (e *Engine) reset() {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    now := e.now()
+    for _, r := range e.rules {
+        if r.holds || r.active {
+            r.holds, r.active, r.since = false, false, now
+        }
+    }
+}
+
+func (e *Engine) fire(r *Rule, dryRun bool) {
+    if dryRun {
+        log.Printf("Rule %s fired, dry run", r.Name)
+        for _, a := range r.Actions {
+            log.Printf("Rule %s would %s", r.Name, a)
+        }
+        return
+    }
+
+    log.Printf("Rule %s fired", r.Name)
+    for _, a := range r.Actions {
+        if err := a.Do(e.state, r); err != nil {
+            log.Printf("Rule %s cannot %s: %v", r.Name, a, err)
+
+            // try again once conditions held for another while
+            e.mu.Lock()
+            r.err, r.active, r.since = err, false, e.now()
+            e.mu.Unlock()
+            return
+        }
+    }
+}
+
+// Current status of all rules
+func (e *Engine) Status() []RuleStatus {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    status := make([]RuleStatus, 0, len(e.rules))
+    for _, r := range e.rules {
+        s := RuleStatus{
+            Name: r.Name,
+            Conditions: make([]string, 0, len(r.Conditions)),
+            Actions: make([]string, 0, len(r.Actions)),
+            Holds: r.holds,
+            Since: r.since,
+            Active: r.active,
+            Fired: r.fired,
+            Err: r.err,
+        }
+
+        for _, c := range r.Conditions {
+            s.Conditions = append(s.Conditions, c.String())
+        }
+        for _, a := range r.Actions {
+            s.Actions = append(s.Actions, a.String())
+        }
+
+        status = append(status, s)
+    }
+
+    return status
+}
+
+// Launches background evaluation of rules
+func (e *Engine) Start() {
+    if e.quit == nil {
+        e.quit = make(chan int, 1)
+        go func(quit chan int) {
+            ticker := time.NewTicker(e.Interval)
+            defer ticker.Stop()
+            for {
+                select {
+                case <- ticker.C:
+                    e.Evaluate()
+                case <- quit:
+                    return
+                }
+            }
+        }(e.quit)
+    }
+}
+
+// Stops background evaluation of rules
+func (e *Engine) Stop() {
+    if e.quit != nil {
+        e.quit <- 1
+        e.quit = nil
+    }
+}
+
+// State looked at once per evaluation
+type roundState struct {
+    State
+    peers map[string]bool
+    groups map[string]int
+    keys map[string]loaded
+}
+
+type loaded struct {
+    value string
+    found bool
+    err error
+}
+
+func newRoundState(s State) *roundState {
+    return &roundState{
+        State: s,
+        peers: make(map[string]bool),
+        groups: make(map[string]int),
+        keys: make(map[string]loaded),
+    }
+}
+
+func (s *roundState) PeerAlive(peer string) bool {
+    alive, ok := s.peers[peer]
+    if !ok {
+        alive = s.State.PeerAlive(peer)
+        s.peers[peer] = alive
+    }
+    return alive
+}
+
+func (s *roundState) GroupMembers(group string) int {
+    n, ok := s.groups[group]
+    if !ok {
+        n = s.State.GroupMembers(group)
+        s.groups[group] = n
+    }
+    return n
+}
+
+func (s *roundState) Load(key string) (string, bool, error) {
+    l, ok := s.keys[key]
+    if !ok {
+        l.value, l.found, l.err = s.State.Load(key)
+        s.keys[key] = l
+    }
+    return l.value, l.found, l.err
+}
@@ -0,0 +1,199 @@
+package rules
+
+import (
+    "errors"
+    "testing"
+    "time"
+)
+
+type fakeState struct {
+    alive map[string]bool
+    groups map[string]int
+    keys map[string]string
+}
+
+func newFakeState() *fakeState {
+    return &fakeState{
+        alive: make(map[string]bool),
+        groups: make(map[string]int),
+        keys: make(map[string]string),
+    }
+}
+
+func (s *fakeState) PeerAlive(peer string) bool {
+    return s.alive[peer]
+}
+
+func (s *fakeState) GroupMembers(group string) int {
+    return s.groups[group]
+}
+
+func (s *fakeState) Load(key string) (string, bool, error) {
+    value, ok := s.keys[key]
+    return value, ok, nil
+}
+
+func (s *fakeState) Store(key string, value string) error {
+    s.keys[key] = value
+    return nil
+}
+
+func failover() *Rule {
+    return &Rule{
+        Name: "failover",
+        Conditions: []Condition{ &peerCondition{ peer: "dc1", up: false } },
+        Actions: []Action{ &siteAction{ site: "dc2", active: true } },
+        For: 10 * time.Second,
+        Clear: 10 * time.Second,
+    }
+}
+
+func TestEngine_Hysteresis(t *testing.T) {
+    state := newFakeState()
+    e := NewEngine(state, []*Rule{ failover() })
+
+    now := time.Now()
+    e.now = func() time.Time {
+        return now
+    }
+    step := func(d time.Duration) {
+        now = now.Add(d)
+        e.Evaluate()
+    }
+
+    // short outage does not fire
+    step(time.Second)
+    step(5 * time.Second)
+    state.alive["dc1"] = true
+    step(time.Second)
+    state.alive["dc1"] = false
+    step(time.Second)
+    step(5 * time.Second)
+    if _, ok := state.keys["sites/dc2"]; ok {
+        t.Fatal("Rule fired before conditions held long enough")
+    }
+
+    step(5 * time.Second)
+    if state.keys["sites/dc2"] != "active" {
+        t.Fatal("Rule did not fire")
+    }
+
+    // short recovery does not re-arm
+    delete(state.keys, "sites/dc2")
+    state.alive["dc1"] = true
+    step(5 * time.Second)
+    state.alive["dc1"] = false
+    step(20 * time.Second)
+    if _, ok := state.keys["sites/dc2"]; ok {
+        t.Fatal("Rule fired again without clearing")
+    }
+
+    state.alive["dc1"] = true
+    step(time.Second)
+    step(10 * time.Second)
+    if e.Status()[0].Active {
+        t.Fatal("Rule did not clear")
+    }
+
+    state.alive["dc1"] = false
+    step(time.Second)
+    step(10 * time.Second)
+    if state.keys["sites/dc2"] != "active" {
+        t.Fatal("Cleared rule did not fire again")
+    }
+}
+
+type flakyState struct {
+    *fakeState
+    failures int
+}
+
+func (s *flakyState) Store(key string, value string) error {
+    if s.failures > 0 {
+        s.failures--
+        return errors.New("Store failed")
+    }
+    return s.fakeState.Store(key, value)
+}
+
+func TestEngine_FailedAction(t *testing.T) {
+    state := &flakyState{ fakeState: newFakeState(), failures: 1 }
+    e := NewEngine(state, []*Rule{ failover() })
+
+    now := time.Now()
+    e.now = func() time.Time {
+        return now
+    }
+    step := func(d time.Duration) {
+        now = now.Add(d)
+        e.Evaluate()
+    }
+
+    step(time.Second)
+    step(10 * time.Second)
+    if s := e.Status()[0]; s.Active || s.Err == nil {
+        t.Fatal("Rule shall not stay active after failed action", s)
+    }
+
+    step(5 * time.Second)
+    if _, ok := state.keys["sites/dc2"]; ok {
+        t.Fatal("Failed rule fired again before conditions held long enough")
+    }
+
+    step(5 * time.Second)
+    if s := e.Status()[0]; state.keys["sites/dc2"] != "active" || !s.Active || s.Err != nil {
+        t.Fatal("Failed rule did not fire again", s)
+    }
+}
+
+func TestEngine_DryRun(t *testing.T) {
+    state := newFakeState()
+    r := failover()
+    r.For = 0
+    e := NewEngine(state, []*Rule{ r })
+    e.SetDryRun(true)
+    e.Evaluate()
+
+    if _, ok := state.keys["sites/dc2"]; ok {
+        t.Fatal("Action was taken in dry run")
+    }
+
+    if s := e.Status()[0]; !s.Active || s.Fired.IsZero() {
+        t.Error("Rule shall fire in dry run", s)
+    }
+}
+
+func TestEngine_Leads(t *testing.T) {
+    state := newFakeState()
+    e := NewEngine(state, []*Rule{ failover() })
+
+    leads := false
+    e.Leads = func() bool {
+        return leads
+    }
+
+    now := time.Now()
+    e.now = func() time.Time {
+        return now
+    }
+
+    now = now.Add(20 * time.Second)
+    e.Evaluate()
+    if _, ok := state.keys["sites/dc2"]; ok || e.Status()[0].Holds {
+        t.Fatal("Rule evaluated while not leading")
+    }
+
+    // conditions shall hold for `for` duration once leading
+    leads = true
+    now = now.Add(time.Second)
+    e.Evaluate()
+    if _, ok := state.keys["sites/dc2"]; ok {
+        t.Fatal("Rule fired as soon as node leads")
+    }
+
+    now = now.Add(10 * time.Second)
+    e.Evaluate()
+    if state.keys["sites/dc2"] != "active" {
+        t.Fatal("Rule did not fire on leader")
+    }
+}
@@ -0,0 +1,195 @@
+// Reading rules from file
+package rules
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+/*
+Rules file lists rules one after another, every line is a keyword followed by
+arguments, lines starting with # are comments:
+
+    # move to dc2 once dc1 is gone for half a minute
+    rule failover-dc2
+        when peer dc1-node1 down
+        when group dc1 members < 2
+        when key sites/dc2 != active
+        for 30s
+        clear 1m
+        then site dc1 passive
+        then site dc2 active
+        then run /usr/local/bin/promote dc2
+        then store switchover/last dc2
+
+Conditions are
+
+    when peer <name> up|down
+    when group <name> members ==|!=|<|<=|>|>= <count>
+    when key <key> ==|!= <value>
+    when key <key> missing|present
+
+Actions are taken in order once all conditions held for `for` duration, zero
+by default. Rule fires again only after conditions did not hold for `clear`
+duration, same as `for` by default
+ */
+
+// Read rules from the file
+func LoadRules(path string) ([]*Rule, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    return ParseRules(f)
+}
+
+func ParseRules(r io.Reader) ([]*Rule, error) {
+    rules := make([]*Rule, 0)
+    names := make(map[string]bool)
+    clears := make(map[*Rule]bool)
+
+    var rule *Rule
+    scanner := bufio.NewScanner(r)
+    for n := 1; scanner.Scan(); n++ {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+            continue
+        }
+
+        if fields[0] == "rule" {
+            if len(fields) != 2 {
+                return nil, fmt.Errorf("line %d: Usage: rule <name>", n)
+            }
+            if names[fields[1]] {
+                return nil, fmt.Errorf("line %d: Duplicate rule %s", n, fields[1])
+            }
+
+            names[fields[1]] = true
+            rule = &Rule{
+                Name: fields[1],
+                Conditions: make([]Condition, 0),
+                Actions: make([]Action, 0),
+            }
+            rules = append(rules, rule)
+            continue
+        }
+
+        if rule == nil {
+            return nil, fmt.Errorf("line %d: %s outside of rule", n, fields[0])
+        }
+
+        var err error
+        switch fields[0] {
+        case "when":
+            var c Condition
+            c, err = parseCondition(fields[1:])
+            if err == nil {
+                rule.Conditions = append(rule.Conditions, c)
+            }
+        case "then":
+            var a Action
+            a, err = parseAction(fields[1:])
+            if err == nil {
+                rule.Actions = append(rule.Actions, a)
+            }
+        case "for":
+            rule.For, err = parseDuration(fields[1:])
+        case "clear":
+            rule.Clear, err = parseDuration(fields[1:])
+            clears[rule] = true
+        default:
+            err = fmt.Errorf("Unknown keyword %s", fields[0])
+        }
+
+        if err != nil {
+            return nil, fmt.Errorf("line %d: %v", n, err)
+        }
+    }
+
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+
+    for _, rule := range rules {
+        if len(rule.Conditions) == 0 || len(rule.Actions) == 0 {
+            return nil, fmt.Errorf("Rule %s needs at least one condition and one action", rule.Name)
+        }
+        if !clears[rule] {
+            rule.Clear = rule.For
+        }
+    }
+
+    return rules, nil
+}
+
+func parseCondition(args []string) (Condition, error) {
+    switch {
+    case len(args) == 3 && args[0] == "peer" && (args[2] == "up" || args[2] == "down"):
+        return &peerCondition{
+            peer: args[1],
+            up: args[2] == "up",
+        }, nil
+    case len(args) == 5 && args[0] == "group" && args[2] == "members":
+        n, err := strconv.Atoi(args[4])
+        if err != nil {
+            return nil, fmt.Errorf("Invalid count %s", args[4])
+        }
+        if _, err := compareInts(0, args[3], n); err != nil {
+            return nil, err
+        }
+        return &groupCondition{
+            group: args[1],
+            op: args[3],
+            n: n,
+        }, nil
+    case len(args) == 3 && args[0] == "key" && (args[2] == "missing" || args[2] == "present"):
+        return &keyCondition{
+            key: args[1],
+            op: args[2],
+        }, nil
+    case len(args) >= 4 && args[0] == "key" && (args[2] == "==" || args[2] == "!="):
+        return &keyCondition{
+            key: args[1],
+            op: args[2],
+            value: strings.Join(args[3:], " "),
+        }, nil
+    }
+
+    return nil, fmt.Errorf("Invalid condition: %s", strings.Join(args, " "))
+}
+
+func parseAction(args []string) (Action, error) {
+    switch {
+    case len(args) == 3 && args[0] == "site" && (args[2] == "active" || args[2] == "passive"):
+        return &siteAction{
+            site: args[1],
+            active: args[2] == "active",
+        }, nil
+    case len(args) >= 2 && args[0] == "run":
+        return &runAction{
+            command: args[1:],
+        }, nil
+    case len(args) >= 3 && args[0] == "store":
+        return &storeAction{
+            key: args[1],
+            value: strings.Join(args[2:], " "),
+        }, nil
+    }
+
+    return nil, fmt.Errorf("Invalid action: %s", strings.Join(args, " "))
+}
+
+func parseDuration(args []string) (time.Duration, error) {
+    if len(args) != 1 {
+        return 0, fmt.Errorf("Duration expected")
+    }
+
+    return time.ParseDuration(args[0])
+}
@@ -0,0 +1,70 @@
+package rules
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+const example = `
+# move to dc2 once dc1 is gone
+rule failover-dc2
+    when peer dc1-node1 down
+    when group dc1 members < 2
+    when key sites/dc2 != active
+    for 30s
+    then site dc1 passive
+    then site dc2 active
+    then run /usr/local/bin/promote dc2
+    then store switchover/last dc1 lost
+
+rule failback
+    when key sites/dc1 missing
+    clear 1m
+    then store sites/dc1 active
+`
+
+func TestParseRules_Example(t *testing.T) {
+    rs, err := ParseRules(strings.NewReader(example))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(rs) != 2 {
+        t.Fatal("Expected two rules, got", len(rs))
+    }
+
+    r := rs[0]
+    if r.Name != "failover-dc2" || len(r.Conditions) != 3 || len(r.Actions) != 4 {
+        t.Fatal("Rule was not read completely", r)
+    }
+
+    if r.For != 30 * time.Second || r.Clear != 30 * time.Second {
+        t.Error("Clear shall default to for", r.For, r.Clear)
+    }
+
+    if r.Conditions[1].String() != "group dc1 members < 2" || r.Actions[3].String() != "store switchover/last dc1 lost" {
+        t.Error("Unexpected rule", r.Conditions[1], r.Actions[3])
+    }
+
+    if rs[1].For != 0 || rs[1].Clear != time.Minute {
+        t.Error("Unexpected durations", rs[1].For, rs[1].Clear)
+    }
+}
+
+func TestParseRules_Errors(t *testing.T) {
+    invalid := []string{
+        "when peer a down",
+        "rule a\n    when peer a sideways\n    then site a active",
+        "rule a\n    when group a members ~ 1\n    then site a active",
+        "rule a\n    when peer a down",
+        "rule a\n    when peer a down\n    then site a active\nrule a\n    when peer a up\n    then site a passive",
+        "rule a\n    when peer a down\n    then site a active\n    for soon",
+    }
+
+    for _, text := range invalid {
+        if _, err := ParseRules(strings.NewReader(text)); err == nil {
+            t.Error("Invalid rules were accepted:", text)
+        }
+    }
+}
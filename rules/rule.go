@@ -0,0 +1,197 @@
+// Rules: conditions over cluster state and actions taken when they hold
+package rules
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "os/exec"
+    "strings"
+    "time"
+)
+
+// Key under which site state is stored
+const SiteKeyPrefix = "sites/"
+
+const hookTimeout = 30 * time.Second
+
+// What rules look at and act upon
+type State interface {
+    // Check if the peer answers ping
+    PeerAlive(peer string) bool
+    // Number of members seen in the group
+    GroupMembers(group string) int
+    // Value of the key, found is false if there is none
+    Load(key string) (value string, found bool, err error)
+    Store(key string, value string) error
+}
+
+type Condition interface {
+    Eval(s State) (bool, error)
+    String() string
+}
+
+type Action interface {
+    Do(s State, rule *Rule) error
+    String() string
+}
+
+type Rule struct {
+    Name string
+    Conditions []Condition          // all shall hold
+    Actions []Action
+    For time.Duration               // conditions hold this long before actions are taken
+    Clear time.Duration             // conditions do not hold this long before rule can fire again
+
+    holds bool
+    since time.Time                 // when conditions started or stopped to hold
+    active bool                     // fired and not cleared yet
+    fired time.Time
+    err error                       // last evaluation or action error
+}
+
+type peerCondition struct {
+    peer string
+    up bool
+}
+
+func (c *peerCondition) Eval(s State) (bool, error) {
+    return s.PeerAlive(c.peer) == c.up, nil
+}
+
+func (c *peerCondition) String() string {
+    if c.up {
+        return fmt.Sprintf("peer %s up", c.peer)
+    }
+    return fmt.Sprintf("peer %s down", c.peer)
+}
+
+type groupCondition struct {
+    group string
+    op string
+    n int
+}
+
+func (c *groupCondition) Eval(s State) (bool, error) {
+    return compareInts(s.GroupMembers(c.group), c.op, c.n)
+}
+
+func (c *groupCondition) String() string {
+    return fmt.Sprintf("group %s members %s %d", c.group, c.op, c.n)
+}
+
+type keyCondition struct {
+    key string
+    op string                       // ==, !=, missing or present
+    value string
+}
+
+func (c *keyCondition) Eval(s State) (bool, error) {
+    value, found, err := s.Load(c.key)
+    if err != nil {
+        return false, err
+    }
+
+    switch c.op {
+    case "missing":
+        return !found, nil
+    case "present":
+        return found, nil
+    case "==":
+        return found && value == c.value, nil
+    case "!=":
+        return !found || value != c.value, nil
+    }
+
+    return false, fmt.Errorf("Unknown operator %s", c.op)
+}
+
+func (c *keyCondition) String() string {
+    if c.op == "missing" || c.op == "present" {
+        return fmt.Sprintf("key %s %s", c.key, c.op)
+    }
+    return fmt.Sprintf("key %s %s %s", c.key, c.op, c.value)
+}
+
+func compareInts(a int, op string, b int) (bool, error) {
+    switch op {
+    case "==": return a == b, nil
+    case "!=": return a != b, nil
+    case "<": return a < b, nil
+    case "<=": return a <= b, nil
+    case ">": return a > b, nil
+    case ">=": return a >= b, nil
+    }
+
+    return false, fmt.Errorf("Unknown operator %s", op)
+}
+
+// Mark the site active or passive, site state is kept in the store for every node to see
+type siteAction struct {
+    site string
+    active bool
+}
+
+func (a *siteAction) Do(s State, rule *Rule) error {
+    return s.Store(SiteKeyPrefix + a.site, a.state())
+}
+
+func (a *siteAction) state() string {
+    if a.active {
+        return "active"
+    }
+    return "passive"
+}
+
+func (a *siteAction) String() string {
+    return fmt.Sprintf("site %s %s", a.site, a.state())
+}
+
+// Run the hook, rule name is passed in WITNESSD_RULE environment variable
+type runAction struct {
+    command []string
+}
+
+func (a *runAction) Do(s State, rule *Rule) error {
+    ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+    defer cancel()
+
+    cmd := exec.CommandContext(ctx, a.command[0], a.command[1:]...)
+    cmd.Env = append(os.Environ(), "WITNESSD_RULE=" + rule.Name)
+    out, err := cmd.CombinedOutput()
+    if err != nil {
+        return errors.New(fmt.Sprintf("%s: %v %s", a.command[0], err, strings.TrimSpace(string(out))))
+    }
+
+    return nil
+}
+
+func (a *runAction) String() string {
+    return "run " + strings.Join(a.command, " ")
+}
+
+type storeAction struct {
+    key string
+    value string
+}
+
+func (a *storeAction) Do(s State, rule *Rule) error {
+    return s.Store(a.key, a.value)
+}
+
+func (a *storeAction) String() string {
+    return fmt.Sprintf("store %s %s", a.key, a.value)
+}
+
+// Check if all conditions hold
+func (r *Rule) eval(s State) (bool, error) {
+    for _, c := range r.Conditions {
+        ok, err := c.Eval(s)
+        if err != nil || !ok {
+            return false, err
+        }
+    }
+
+    return true, nil
+}
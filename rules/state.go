@@ -0,0 +1,62 @@
+// Cluster state as seen by rules
+package rules
+
+import (
+    "errors"
+    "github.com/noroutine/witnessd/cluster"
+)
+
+type ClientState struct {
+    client *cluster.Client
+    Level cluster.ConsistencyLevel
+    Fenced bool                 // store as leader with fencing token
+}
+
+func NewClientState(client *cluster.Client) *ClientState {
+    return &ClientState{
+        client: client,
+        Level: cluster.ConsistencyLevelTwo,
+    }
+}
+
+func (s *ClientState) PeerAlive(peer string) bool {
+    return s.client.Ping(peer) == cluster.PING_SUCCESS
+}
+
+func (s *ClientState) GroupMembers(group string) int {
+    return s.client.Node.Membership().Groups[group].SeenMembers
+}
+
+func (s *ClientState) Load(key string) (string, bool, error) {
+    data, result := s.client.Load([]byte(key), s.Level)
+    switch result {
+    case cluster.LOAD_SUCCESS, cluster.LOAD_PARTIAL_SUCCESS:
+        return string(data), true, nil
+    case cluster.LOAD_FAILURE:
+        return "", false, nil
+    }
+
+    return "", false, errors.New("Cannot load " + key)
+}
+
+func (s *ClientState) Store(key string, value string) error {
+    var result int
+    if s.Fenced {
+        token, err := s.client.FencingToken()
+        if err != nil {
+            return err
+        }
+        result = s.client.StoreFenced([]byte(key), []byte(value), token, s.Level)
+    } else {
+        result = s.client.Store([]byte(key), []byte(value), s.Level)
+    }
+
+    switch result {
+    case cluster.STORE_SUCCESS, cluster.STORE_PARTIAL_SUCCESS:
+        return nil
+    case cluster.STORE_FENCED:
+        return cluster.ErrFenced
+    }
+
+    return errors.New("Cannot store " + key)
+}
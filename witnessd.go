@@ -6,9 +6,11 @@ import (
     "os"
     "strings"
     "flag"
+    "time"
     
     "github.com/noroutine/witnessd/protocol"
     "github.com/noroutine/witnessd/cluster"
+    "github.com/noroutine/witnessd/rules"
     "net"
 )
 
@@ -22,6 +24,16 @@ type Options struct {
     name string
     join string
     announce bool
+    dataDir string
+    fsync string
+    tombstoneGrace time.Duration
+    seeds string
+    peersFile string
+    dnsSrv string
+    rules string
+    rulesDryRun bool
+    site string
+    voters int
 }
 
 func main() {
@@ -32,6 +44,16 @@ func main() {
     flag.IntVar(&opts.partitions, "partitions", cluster.DefaultPartitions, "amount of storage partitions")
     flag.StringVar(&opts.name, "name", "", "name of the player")
     flag.StringVar(&opts.join, "join", "", "name of the group of the node")
+    flag.StringVar(&opts.dataDir, "data-dir", "", "directory for persistent storage, in-memory if empty")
+    flag.StringVar(&opts.fsync, "fsync", "interval", "when to flush storage to disk: always, interval or never")
+    flag.DurationVar(&opts.tombstoneGrace, "tombstone-grace", cluster.DefaultTombstoneGracePeriod, "how long deleted keys are remembered before purging")
+    flag.StringVar(&opts.seeds, "seeds", "", "comma separated host:port of peers to discover others through, instead of Bonjour")
+    flag.StringVar(&opts.peersFile, "peers-file", "", "file with host:port of seed peers per line, instead of Bonjour")
+    flag.StringVar(&opts.dnsSrv, "dns-srv", "", "DNS name with SRV records of seed peers, instead of Bonjour")
+    flag.StringVar(&opts.rules, "rules", "", "file with switchover rules to evaluate")
+    flag.BoolVar(&opts.rulesDryRun, "rules-dry-run", false, "only log actions of rules instead of taking them")
+    flag.StringVar(&opts.site, "site", "", "site the node runs in, campaigns for primary lease on its behalf; witness if empty")
+    flag.IntVar(&opts.voters, "voters", 0, "number of all voters in all sites, witnesses included; current group size if 0")
     flag.Parse()
 
     if net.ParseIP(opts.bind) == nil {
@@ -61,16 +83,86 @@ func main() {
         os.Exit(42)
     }
 
-    clusterClient, err := cluster.NewClient("local.", opts.name, opts.join, opts.partitions, opts.bind, opts.port);
+    storage := cluster.NewInMemoryStorage()
+    if len(opts.dataDir) > 0 {
+        var policy cluster.SyncPolicy
+        switch opts.fsync {
+        case "always": policy = cluster.SyncAlways
+        case "interval": policy = cluster.SyncInterval
+        case "never": policy = cluster.SyncNever
+        default:
+            fmt.Printf("Invalid fsync policy: %v\n", opts.fsync)
+            os.Exit(42)
+        }
+
+        diskStorage, err := cluster.NewDiskStorage(opts.dataDir, policy)
+        if err != nil {
+            log.Fatal(fmt.Sprintln("Cannot open storage", err))
+        }
+        storage = diskStorage
+    }
+
+    var discovery cluster.Discovery = cluster.NewBonjourDiscovery()
+    switch {
+    case len(opts.seeds) > 0:
+        discovery = cluster.NewStaticDiscovery(strings.Split(opts.seeds, ","))
+    case len(opts.peersFile) > 0:
+        discovery = cluster.NewFileDiscovery(opts.peersFile)
+    case len(opts.dnsSrv) > 0:
+        discovery = cluster.NewDNSDiscovery(opts.dnsSrv, nil)
+    }
+
+    clusterClient, err := cluster.NewClientWithDiscovery("local.", opts.name, opts.join, opts.partitions, opts.bind, opts.port, storage, discovery);
 
     if err != nil {
         log.Fatal(fmt.Sprintln("Cannot start cluster", err))
     }
+    clusterClient.Cluster.TombstoneGracePeriod = opts.tombstoneGrace
+
+    if len(opts.dataDir) > 0 {
+        txnLog, err := cluster.NewFileTxnLog(opts.dataDir)
+        if err != nil {
+            log.Fatal(fmt.Sprintln("Cannot open transaction log", err))
+        }
+        clusterClient.Cluster.SetTxnLog(txnLog)
+    }
+
+    if len(opts.site) > 0 {
+        clusterClient.Campaign(opts.site, opts.voters)
+    }
+
+    clusterClient.Elect(opts.voters)
+    go func() {
+        for change := range clusterClient.LeaderChanges() {
+            if len(change.Leader) == 0 {
+                log.Println("No leader")
+                continue
+            }
+            log.Printf("Leader is %s, term %d", change.Leader, change.Term)
+        }
+    }()
 
     httpClient := protocol.NewHttpClient(fmt.Sprintf(":%d", opts.port), clusterClient)
     go httpClient.Serve()
 
     replClient := protocol.NewReplClient(opts.name, description, clusterClient);
+
+    if len(opts.rules) > 0 {
+        rs, err := rules.LoadRules(opts.rules)
+        if err != nil {
+            log.Fatal(fmt.Sprintln("Cannot read rules", err))
+        }
+
+        // only leader takes actions, site state is written with its fencing token
+        state := rules.NewClientState(clusterClient)
+        state.Fenced = true
+        engine := rules.NewEngine(state, rs)
+        engine.Leads = clusterClient.IsLeader
+        engine.SetDryRun(opts.rulesDryRun)
+        engine.Start()
+        replClient.SetRuleEngine(engine)
+    }
+
     replClient.Serve()
 
 }